@@ -1,29 +1,46 @@
 package main
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
 
 	"github.com/kawabatas/toy-wasm-runtime/vm"
-	"github.com/kawabatas/toy-wasm-runtime/wasm"
 )
 
+const path = "./testdata/helloworld.wasm"
+
+// The arguments are passed through to the guest, after its name, and the
+// command exits with the exit code of the guest.
 func main() {
-	data, err := os.ReadFile("./testdata/helloworld.wasm")
+	data, err := os.ReadFile(path)
 	if err != nil {
 		panic(err)
 	}
 
-	mod, err := wasm.DecodeModule(data)
+	args := append([]string{filepath.Base(path)}, os.Args[1:]...)
+	config := vm.NewConfig().WithWASI(vm.NewWASIConfig().WithArgs(args...))
+	if dir, err := os.UserCacheDir(); err == nil {
+		if cache, err := vm.NewCompilationCache(filepath.Join(dir, "toy-wasm-runtime")); err == nil {
+			config = config.WithCompilationCache(cache)
+		}
+	}
+
+	compiled, err := vm.CompileBinary(data, config)
 	if err != nil {
 		panic(err)
 	}
 
-	vm, err := vm.InstantiateModule(mod)
+	instance, err := vm.InstantiateCompiledModule(compiled, config)
 	if err != nil {
-		panic(vm)
+		panic(err)
 	}
 
-	if _, err := vm.InvokeFunction("_start"); err != nil {
+	if _, err := instance.InvokeFunction("_start"); err != nil {
+		var exitErr *vm.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(int(exitErr.Code))
+		}
 		panic(err)
 	}
 }
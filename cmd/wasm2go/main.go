@@ -0,0 +1,55 @@
+// Command wasm2go translates a wasm module into a Go package.
+//
+//	wasm2go [-pkg name] [-o file.go] module.wasm
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+	"github.com/kawabatas/toy-wasm-runtime/wasm2go"
+)
+
+func main() {
+	pkg := flag.String("pkg", "guest", "name of the generated package")
+	out := flag.String("o", "", "output file (default stdout)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: wasm2go [-pkg name] [-o file.go] module.wasm\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *pkg, *out); err != nil {
+		fmt.Fprintf(os.Stderr, "wasm2go: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path, pkg, out string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	mod, err := wasm.DecodeModule(data)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	src, err := wasm2go.Generate(mod, pkg)
+	if err != nil {
+		return fmt.Errorf("generate %s: %w", path, err)
+	}
+
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return os.WriteFile(out, src, 0o644)
+}
@@ -0,0 +1,26 @@
+(module
+  (func $loop (param $n i32) (result i32)
+    (local $acc i32)
+    (block $done
+      (loop $continue
+        ;; if n == 0 then break
+        local.get $n
+        i32.eqz
+        br_if $done
+        ;; acc += n
+        local.get $acc
+        local.get $n
+        i32.add
+        local.set $acc
+        ;; n -= 1
+        local.get $n
+        i32.const 1
+        i32.sub
+        local.set $n
+        br $continue
+      )
+    )
+    local.get $acc
+  )
+  (export "loop" (func $loop))
+)
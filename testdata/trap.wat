@@ -0,0 +1,29 @@
+(module
+  (memory 1)
+  (export "memory" (memory 0))
+  (global $g (mut i32) (i32.const 7))
+
+  (func $load (param $addr i32) (result i32)
+    local.get $addr
+    i32.load offset=8)
+  (export "load" (func $load))
+
+  (func $store (param $addr i32) (param $v i32)
+    local.get $addr
+    local.get $v
+    i32.store)
+  (export "store" (func $store))
+
+  ;; inc adds x to g and returns it.
+  (func $inc (param $x i32) (result i32)
+    global.get $g
+    local.get $x
+    i32.add
+    global.set $g
+    global.get $g)
+  (export "inc" (func $inc))
+
+  (func $trap
+    unreachable)
+  (export "trap" (func $trap))
+)
@@ -0,0 +1,432 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// Version is the version of the runtime. It is part of the cache key, so
+// that a release never loads the functions compiled by another.
+const Version = "0.1.0"
+
+// cacheMagic starts every cache file, followed by cacheFormatVersion.
+const cacheMagic = "TWRC"
+
+// cacheFormatVersion is the version of the encoding of the compiled
+// functions, which is part of the cache key. It must change whenever the
+// encoding or the code the compilers emit does, which TestCacheFormat checks.
+const cacheFormatVersion = 1
+
+// CompilationCache stores compiled functions in a directory, keyed by the
+// SHA-256 of the module binary, the runtime and cache format versions and
+// the engine. Cache files that can't be read or written are ignored, and the
+// module compiled. Loaded functions are validated against the module, as the
+// files may have been modified.
+type CompilationCache struct {
+	dir string
+}
+
+// NewCompilationCache returns a cache in dir, creating it if needed.
+func NewCompilationCache(dir string) (*CompilationCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &CompilationCache{dir: dir}, nil
+}
+
+func cacheKey(bin []byte, engine Engine) string {
+	h := sha256.New()
+	h.Write([]byte(Version))
+	h.Write([]byte{0})
+	h.Write(binary.LittleEndian.AppendUint32(nil, cacheFormatVersion))
+	h.Write([]byte{byte(engine)})
+	h.Write([]byte(runtime.GOARCH))
+	h.Write([]byte{0})
+	h.Write(bin)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *CompilationCache) path(key string) string {
+	return filepath.Join(c.dir, key+".twrc")
+}
+
+// load reads the compiled functions stored for key into cm, and reports whether they were found.
+func (c *CompilationCache) load(key string, cm *CompiledModule) bool {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return false
+	}
+	if err := decodeCompiledFunctions(data, cm); err != nil {
+		for _, f := range cm.functions {
+			f.Code, f.heights, f.maxHeight, f.regCode = nil, nil, 0, nil
+		}
+		return false
+	}
+	return true
+}
+
+// store writes the compiled functions of cm. It writes a temporary file and
+// renames it, so that concurrent loads never see a partial file.
+func (c *CompilationCache) store(key string, cm *CompiledModule) {
+	f, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(encodeCompiledFunctions(cm))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// encodeCompiledFunctions encodes the code of the functions of cm, followed
+// by the CRC-32 of the encoding.
+func encodeCompiledFunctions(cm *CompiledModule) []byte {
+	e := &cacheEncoder{buf: []byte(cacheMagic)}
+	e.u32(cacheFormatVersion)
+	e.u32(uint32(len(cm.functions)))
+	for _, f := range cm.functions {
+		e.u32(uint32(f.maxHeight))
+		e.u32(uint32(len(f.Code)))
+		for i, in := range f.Code {
+			e.u8(in.op)
+			e.u64(in.u1)
+			e.u64(in.u2)
+			e.u32(uint32(f.heights[i]))
+		}
+
+		rc := f.regCode
+		if rc == nil {
+			e.u8(0)
+			continue
+		}
+		e.u8(1)
+		e.u32(uint32(rc.numParams))
+		e.u32(uint32(rc.numLocals))
+		e.u32(uint32(rc.numRegs))
+		e.u32(uint32(rc.constBase))
+		e.u32(uint32(len(rc.consts)))
+		for _, v := range rc.consts {
+			e.u64(v)
+		}
+		e.u32(uint32(len(rc.code)))
+		for _, in := range rc.code {
+			e.u8(in.op)
+			e.u32(uint32(in.dst))
+			e.u32(uint32(in.a))
+			e.u32(uint32(in.b))
+			e.u32(uint32(in.n))
+			e.u64(in.u1)
+			e.u32(uint32(in.from))
+			e.u32(uint32(in.to))
+		}
+	}
+	e.u32(crc32.ChecksumIEEE(e.buf))
+	return e.buf
+}
+
+func decodeCompiledFunctions(data []byte, cm *CompiledModule) error {
+	if len(data) < len(cacheMagic)+4 || string(data[:len(cacheMagic)]) != cacheMagic {
+		return errors.New("invalid cache header")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return errors.New("cache checksum mismatch")
+	}
+
+	d := &cacheDecoder{buf: body[len(cacheMagic):]}
+	if d.u32() != cacheFormatVersion {
+		return errors.New("cache format version mismatch")
+	}
+	if int(d.u32()) != len(cm.functions) {
+		return errors.New("cache function count mismatch")
+	}
+	for _, f := range cm.functions {
+		f.maxHeight = int(d.u32())
+		f.Code = make([]instruction, d.len(21))
+		f.heights = make([]int, len(f.Code))
+		for i := range f.Code {
+			f.Code[i] = instruction{op: d.u8(), u1: d.u64(), u2: d.u64()}
+			f.heights[i] = int(d.u32())
+		}
+
+		if d.u8() == 0 {
+			continue
+		}
+		rc := &registerCode{
+			numParams: int(d.u32()),
+			numLocals: int(d.u32()),
+			numRegs:   int(d.u32()),
+			constBase: int(d.u32()),
+		}
+		rc.consts = make([]uint64, d.len(8))
+		for i := range rc.consts {
+			rc.consts[i] = d.u64()
+		}
+		rc.code = make([]regInstruction, d.len(33))
+		for i := range rc.code {
+			rc.code[i] = regInstruction{
+				op:   d.u8(),
+				dst:  int32(d.u32()),
+				a:    int32(d.u32()),
+				b:    int32(d.u32()),
+				n:    int32(d.u32()),
+				u1:   d.u64(),
+				from: int32(d.u32()),
+				to:   int32(d.u32()),
+			}
+		}
+		f.regCode = rc
+	}
+	if d.err != nil || len(d.buf) != 0 {
+		return errors.New("invalid cache data")
+	}
+	for i, f := range cm.functions {
+		if err := cm.validateCode(f); err != nil {
+			return fmt.Errorf("func[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validateCode checks that the code of f, loaded from the cache or about to
+// be compiled by compileJIT, only refers to locals, globals, functions,
+// registers and pcs of f and its module, and has a register code exactly if
+// the engine needs one. The native code of EngineJIT uses the register
+// indexes as offsets without bounds checks.
+func (c *CompiledModule) validateCode(f *WasmFunction) error {
+	numLocals := len(f.FunctionType.Params) + len(f.LocalTypes)
+	globals := c.module.GlobalSection
+	if len(f.Code) == 0 || f.Code[len(f.Code)-1].op != wasm.OpcodeReturn {
+		return errors.New("code doesn't end with return")
+	}
+	if f.maxHeight < 0 {
+		return fmt.Errorf("invalid max height: %d", f.maxHeight)
+	}
+	for pc, in := range f.Code {
+		if h := f.heights[pc]; h < 0 || h > f.maxHeight {
+			return fmt.Errorf("pc %d: invalid height: %d", pc, h)
+		}
+		var err error
+		switch in.op {
+		case wasm.OpcodeUnreachable, wasm.OpcodeDrop, wasm.OpcodeI32Eqz, wasm.OpcodeI32Eq,
+			wasm.OpcodeI32Ne, wasm.OpcodeI32Lts, wasm.OpcodeI32Add, wasm.OpcodeI32Sub:
+		case wasm.OpcodeIf, wasm.OpcodeElse:
+			err = checkIndex("pc", in.u1, len(f.Code))
+		case wasm.OpcodeBr, wasm.OpcodeBrIf, wasm.OpcodeReturn:
+			if in.op != wasm.OpcodeReturn {
+				err = checkIndex("pc", in.u1, len(f.Code))
+			}
+			if keep, drop := splitUnwind(in.u2); keep < 0 || drop < 0 || keep+drop > f.heights[pc] {
+				err = fmt.Errorf("invalid unwind: %d, %d", keep, drop)
+			}
+		case wasm.OpcodeCall:
+			err = checkIndex("function index", in.u1, len(c.funcTypes))
+		case wasm.OpcodeLocalGet, wasm.OpcodeLocalSet, wasm.OpcodeLocalTee:
+			err = checkIndex("local index", in.u1, numLocals)
+		case wasm.OpcodeGlobalGet, wasm.OpcodeGlobalSet:
+			err = checkGlobal(globals, in.op, in.u1)
+		case wasm.OpcodeI32Load, wasm.OpcodeI32Store:
+			err = checkMemory(c.module, in.u1)
+		case wasm.OpcodeI32Const:
+			if in.u1 > math.MaxUint32 {
+				err = fmt.Errorf("invalid i32 constant: %#x", in.u1)
+			}
+		default:
+			err = errors.New("vm instruction not defined")
+		}
+		if err != nil {
+			return fmt.Errorf("pc %d: %#x: %w", pc, in.op, err)
+		}
+	}
+
+	rc := f.regCode
+	if (rc != nil) != (c.engine == EngineRegister || c.engine == EngineJIT) {
+		return errors.New("register code doesn't match the engine")
+	}
+	if rc == nil {
+		return nil
+	}
+	if rc.numParams != len(f.FunctionType.Params) || rc.numLocals != numLocals ||
+		rc.constBase != numLocals+f.maxHeight || rc.numRegs != rc.constBase+len(rc.consts) {
+		return errors.New("invalid register file layout")
+	}
+	for _, v := range rc.consts {
+		if v > math.MaxUint32 {
+			return fmt.Errorf("invalid i32 constant: %#x", v)
+		}
+	}
+	if len(rc.code) == 0 || rc.code[len(rc.code)-1].op != wasm.OpcodeReturn {
+		return errors.New("register code doesn't end with return")
+	}
+
+	// src and dst check the registers read and written. The constants are
+	// reloaded on every call, but must not change during one.
+	src := func(reg, n int32) error { return checkRegisters(reg, n, rc.numRegs) }
+	dst := func(reg, n int32) error { return checkRegisters(reg, n, rc.constBase) }
+	for pc, in := range rc.code {
+		if in.from < 0 || in.to < in.from || int(in.to) > len(f.Code) {
+			return fmt.Errorf("register pc %d: invalid code range: %d-%d", pc, in.from, in.to)
+		}
+
+		var err error
+		switch in.op {
+		case wasm.OpcodeNop, wasm.OpcodeUnreachable:
+		case regOpMove:
+			err = errors.Join(dst(in.dst, 1), src(in.a, 1))
+		case wasm.OpcodeIf:
+			err = errors.Join(src(in.a, 1), checkIndex("pc", in.u1, len(rc.code)))
+		case wasm.OpcodeElse:
+			err = checkIndex("pc", in.u1, len(rc.code))
+		case wasm.OpcodeBr, wasm.OpcodeBrIf:
+			err = errors.Join(dst(in.dst, in.n), src(in.a, in.n), checkIndex("pc", in.u1, len(rc.code)))
+			if in.op == wasm.OpcodeBrIf {
+				err = errors.Join(err, src(in.b, 1))
+			}
+		case wasm.OpcodeReturn:
+			if len(f.FunctionType.Results) > 0 {
+				err = src(in.a, 1)
+			} else if in.a != -1 {
+				err = fmt.Errorf("invalid register: %d", in.a)
+			}
+		case wasm.OpcodeCall:
+			if err = checkIndex("function index", in.u1, len(c.funcTypes)); err != nil {
+				break
+			}
+			ft := c.funcTypes[in.u1]
+			if int(in.n) != len(ft.Params) {
+				err = fmt.Errorf("invalid argument count: %d", in.n)
+			} else if len(ft.Results) > 0 {
+				err = errors.Join(dst(in.dst, 1), src(in.a, in.n))
+			} else if in.dst != -1 {
+				err = fmt.Errorf("invalid register: %d", in.dst)
+			} else {
+				err = src(in.a, in.n)
+			}
+		case wasm.OpcodeGlobalGet:
+			err = errors.Join(dst(in.dst, 1), checkGlobal(globals, in.op, in.u1))
+		case wasm.OpcodeGlobalSet:
+			err = errors.Join(src(in.a, 1), checkGlobal(globals, in.op, in.u1))
+		case wasm.OpcodeI32Load:
+			err = errors.Join(dst(in.dst, 1), src(in.a, 1), checkMemory(c.module, in.u1))
+		case wasm.OpcodeI32Store:
+			err = errors.Join(src(in.a, 1), src(in.b, 1), checkMemory(c.module, in.u1))
+		case wasm.OpcodeI32Eqz:
+			err = errors.Join(dst(in.dst, 1), src(in.a, 1))
+		case wasm.OpcodeI32Eq, wasm.OpcodeI32Ne, wasm.OpcodeI32Lts, wasm.OpcodeI32Add, wasm.OpcodeI32Sub:
+			err = errors.Join(dst(in.dst, 1), src(in.a, 1), src(in.b, 1))
+		default:
+			err = errors.New("vm instruction not defined")
+		}
+		if err != nil {
+			return fmt.Errorf("register pc %d: %#x: %w", pc, in.op, err)
+		}
+	}
+	return nil
+}
+
+func checkIndex(kind string, index uint64, n int) error {
+	if index >= uint64(n) {
+		return fmt.Errorf("invalid %s: %d", kind, index)
+	}
+	return nil
+}
+
+// checkRegisters checks that the n registers from reg are below limit.
+func checkRegisters(reg, n int32, limit int) error {
+	if reg < 0 || n < 0 || int64(reg)+int64(n) > int64(limit) {
+		return fmt.Errorf("invalid registers: %d-%d", reg, int64(reg)+int64(n))
+	}
+	return nil
+}
+
+func checkGlobal(globals []wasm.Global, op wasm.Opcode, index uint64) error {
+	if err := checkIndex("global index", index, len(globals)); err != nil {
+		return err
+	}
+	if op == wasm.OpcodeGlobalSet && !globals[index].Type.Mutable {
+		return fmt.Errorf("global %d is immutable", index)
+	}
+	return nil
+}
+
+func checkMemory(module *wasm.Module, offset uint64) error {
+	if module.MemorySection == nil {
+		return errors.New("memory instruction requires a memory")
+	}
+	if offset > math.MaxUint32 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	return nil
+}
+
+type cacheEncoder struct {
+	buf []byte
+}
+
+func (e *cacheEncoder) u8(v byte) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *cacheEncoder) u32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *cacheEncoder) u64(v uint64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+// cacheDecoder reads values until the data runs out, after which it returns
+// zeros and err is set.
+type cacheDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *cacheDecoder) next(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.err = errors.New("unexpected end of cache data")
+		return make([]byte, n)
+	}
+	ret := d.buf[:n]
+	d.buf = d.buf[n:]
+	return ret
+}
+
+func (d *cacheDecoder) u8() byte {
+	return d.next(1)[0]
+}
+
+func (d *cacheDecoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *cacheDecoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+// len reads the length of a list of elements of size bytes, which must fit
+// in the remaining data.
+func (d *cacheDecoder) len(size int) int {
+	n := int(d.u32())
+	if n > len(d.buf)/size {
+		d.err = errors.New("invalid cache length")
+		return 0
+	}
+	return n
+}
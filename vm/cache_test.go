@@ -0,0 +1,178 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// TestCacheFormat fails when the encoding of the compiled functions changes,
+// as cacheFormatVersion must then change too so that old files aren't loaded.
+func TestCacheFormat(t *testing.T) {
+	cm, err := CompileBinary(engineTestModule().binary(), NewConfig().WithEngine(EngineRegister))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(encodeCompiledFunctions(cm))
+	const (
+		version = 1
+		digest  = "5df99871952474ffa09e3610fa7b6e12aafb3ad8f8bb41062f065d66d9017a5e"
+	)
+	if cacheFormatVersion != version || hex.EncodeToString(sum[:]) != digest {
+		t.Errorf("the encoding changed to %x with format version %d: increment cacheFormatVersion and update the test",
+			sum, cacheFormatVersion)
+	}
+}
+
+func TestCompilationCache(t *testing.T) {
+	bin := engineTestModule().binary()
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			cache, err := NewCompilationCache(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := NewConfig().WithEngine(e.engine).WithCompilationCache(cache)
+			if _, err := CompileBinary(bin, config); err != nil {
+				t.Fatal(err)
+			}
+			path := cache.path(cacheKey(bin, e.engine))
+			if _, err := os.Stat(path); err != nil {
+				t.Fatal(err)
+			}
+
+			// Compile from the cache, then from a corrupted file.
+			for _, corrupt := range []bool{false, true} {
+				if corrupt {
+					data, err := os.ReadFile(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					data[len(data)/2] ^= 0xff
+					if err := os.WriteFile(path, data, 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				cm, err := CompileBinary(bin, config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				vm, err := InstantiateCompiledModule(cm, config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ret, err := vm.InvokeFunction("sum", 10); err != nil || ret != 55 {
+					t.Errorf("sum(10) = %d, %v, want 55", ret, err)
+				}
+			}
+		})
+	}
+}
+
+// TestCompilationCacheValidate checks that functions loaded from a cache
+// file referring to anything outside of the function or the module are
+// rejected, as if the file was modified.
+func TestCompilationCacheValidate(t *testing.T) {
+	bin := engineTestModule().binary()
+	find := func(f *WasmFunction, op wasm.Opcode) *regInstruction {
+		for i := range f.regCode.code {
+			if f.regCode.code[i].op == op {
+				return &f.regCode.code[i]
+			}
+		}
+		t.Fatalf("no %#x", op)
+		return nil
+	}
+	findIR := func(f *WasmFunction, op wasm.Opcode) *instruction {
+		for i := range f.Code {
+			if f.Code[i].op == op {
+				return &f.Code[i]
+			}
+		}
+		t.Fatalf("no %#x", op)
+		return nil
+	}
+	sum := func(cm *CompiledModule) *WasmFunction { return cm.functions[0] }
+
+	tests := []struct {
+		name   string
+		modify func(cm *CompiledModule)
+		err    string
+	}{
+		{"register", func(cm *CompiledModule) { find(sum(cm), wasm.OpcodeI32Add).a = 1 << 20 }, "invalid registers"},
+		{"negative register", func(cm *CompiledModule) { find(sum(cm), wasm.OpcodeI32Lts).b = -2 }, "invalid registers"},
+		{"constant register written", func(cm *CompiledModule) {
+			f := sum(cm)
+			find(f, wasm.OpcodeI32Sub).dst = int32(f.regCode.constBase)
+		}, "invalid registers"},
+		{"register count", func(cm *CompiledModule) { sum(cm).regCode.numRegs++ }, "invalid register file layout"},
+		{"branch count", func(cm *CompiledModule) { find(sum(cm), wasm.OpcodeIf).u1 = 1000 }, "invalid pc"},
+		{"call", func(cm *CompiledModule) { find(sum(cm), wasm.OpcodeCall).u1 = 1000 }, "invalid function index"},
+		{"call arguments", func(cm *CompiledModule) { find(sum(cm), wasm.OpcodeCall).n = 2 }, "invalid argument count"},
+		{"return", func(cm *CompiledModule) { find(sum(cm), wasm.OpcodeReturn).a = -1 }, "invalid register"},
+		{"fuel range", func(cm *CompiledModule) { find(sum(cm), wasm.OpcodeI32Add).to = 1000 }, "invalid code range"},
+		{"constant", func(cm *CompiledModule) { sum(cm).regCode.consts[0] = 1 << 32 }, "invalid i32 constant"},
+		{"global", func(cm *CompiledModule) {
+			for _, f := range cm.functions {
+				for i := range f.regCode.code {
+					if f.regCode.code[i].op == wasm.OpcodeGlobalGet {
+						f.regCode.code[i].u1 = 1
+						return
+					}
+				}
+			}
+		}, "invalid global index"},
+		{"memory offset", func(cm *CompiledModule) {
+			for _, f := range cm.functions {
+				for i := range f.regCode.code {
+					if f.regCode.code[i].op == wasm.OpcodeI32Load {
+						f.regCode.code[i].u1 = 1 << 32
+						return
+					}
+				}
+			}
+		}, "invalid offset"},
+		{"missing register code", func(cm *CompiledModule) { sum(cm).regCode = nil }, "register code doesn't match the engine"},
+		{"local", func(cm *CompiledModule) { findIR(sum(cm), wasm.OpcodeLocalGet).u1 = 1 }, "invalid local index"},
+		{"unwind", func(cm *CompiledModule) { findIR(sum(cm), wasm.OpcodeReturn).u2 = unwind(5, 0) }, "invalid unwind"},
+		{"height", func(cm *CompiledModule) { sum(cm).heights[1] = -1 }, "invalid height"},
+		{"opcode", func(cm *CompiledModule) { findIR(sum(cm), wasm.OpcodeI32Add).op = 0xff }, "vm instruction not defined"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewConfig().WithEngine(EngineRegister)
+			cm, err := CompileBinary(bin, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.modify(cm)
+			data := encodeCompiledFunctions(cm)
+
+			loaded, err := newCompiledModule(cm.module, EngineRegister)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = decodeCompiledFunctions(data, loaded)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("decode error = %v, want %q", err, tc.err)
+			}
+
+			// CompileBinary compiles the module again instead.
+			cache, err := NewCompilationCache(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(cache.path(cacheKey(bin, EngineJIT)), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			vm := engineTestModule().instantiate(t, NewConfig().WithEngine(EngineJIT).WithCompilationCache(cache))
+			if ret, err := vm.InvokeFunction("sum", 10); err != nil || ret != 55 {
+				t.Errorf("sum(10) = %d, %v, want 55", ret, err)
+			}
+		})
+	}
+}
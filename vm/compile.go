@@ -0,0 +1,372 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// instruction is an instruction of a compiled function body. Immediates are
+// decoded and branch targets resolved at instantiation, so the interpreter
+// never looks at the raw body.
+type instruction struct {
+	op wasm.Opcode
+	// u1 and u2 are the immediates:
+	//   - i32.const: u1 is the value
+	//   - local.*, global.*, call: u1 is the index
+	//   - i32.load, i32.store: u1 is the offset
+	//   - if: u1 is the pc of the else branch, or of the end without else
+	//   - else, br, br_if: u1 is the pc to jump to
+	//   - br, br_if, return: u2 is the values kept and dropped, see unwind
+	u1, u2 uint64
+}
+
+// unwind encodes the number of values kept on top of the stack and the
+// number of values dropped below them when branching out of blocks.
+func unwind(keep, drop int) uint64 {
+	return uint64(keep)<<32 | uint64(uint32(drop))
+}
+
+func splitUnwind(u uint64) (keep, drop int) {
+	return int(u >> 32), int(uint32(u))
+}
+
+// controlFrame is a block, loop, if or the function body being compiled.
+type controlFrame struct {
+	blockType *wasm.FunctionType
+	// height is the stack height below the block params.
+	height int
+	isLoop bool
+	// startPC is the pc branched to by br to a loop.
+	startPC int
+	// ifPC is the pc of the if instruction waiting for its else or end, or -1.
+	ifPC int
+	// patches are the pcs of forward branches to the end.
+	patches []int
+}
+
+type compiler struct {
+	module    *wasm.Module
+	funcTypes []*wasm.FunctionType
+	numLocals int
+	body      []byte
+	pc        int
+
+	code      []instruction
+	heights   []int
+	maxHeight int
+	frames    []*controlFrame
+	height    int
+	// before is the height before the current instruction.
+	before int
+	// dead is true in unreachable code after br, return and unreachable
+	// until the end of the block. deadDepth counts the blocks nested in it.
+	dead      bool
+	deadDepth int
+}
+
+// compile lowers the body of a function into f.Code. funcTypes are the types
+// of all functions in the module, imported ones first.
+func compile(module *wasm.Module, funcTypes []*wasm.FunctionType, f *WasmFunction) error {
+	c := &compiler{
+		module:    module,
+		funcTypes: funcTypes,
+		numLocals: len(f.FunctionType.Params) + len(f.LocalTypes),
+		body:      f.Body,
+		frames:    []*controlFrame{{blockType: f.FunctionType, ifPC: -1}},
+	}
+
+	for c.pc < len(c.body) {
+		if len(c.frames) == 0 {
+			return errors.New("instructions after the end of the function")
+		}
+		op := c.body[c.pc]
+		c.pc++
+		if err := c.compileInstruction(op); err != nil {
+			return fmt.Errorf("compile %#x at %d: %w", op, c.pc-1, err)
+		}
+		c.maxHeight = max(c.maxHeight, c.height)
+	}
+
+	if len(c.frames) > 0 {
+		return errors.New("ill-nested block exists")
+	}
+	f.Code, f.heights, f.maxHeight = c.code, c.heights, c.maxHeight
+	return nil
+}
+
+func (c *compiler) compileInstruction(op wasm.Opcode) error {
+	// Decode immediates first, even in dead code, to find the next instruction.
+	var u1 uint64
+	var bt *wasm.FunctionType
+	var err error
+	switch op {
+	case wasm.OpcodeBlock, wasm.OpcodeLoop, wasm.OpcodeIf:
+		bt, err = c.readBlockType()
+	case wasm.OpcodeBr, wasm.OpcodeBrIf, wasm.OpcodeCall,
+		wasm.OpcodeLocalGet, wasm.OpcodeLocalSet, wasm.OpcodeLocalTee,
+		wasm.OpcodeGlobalGet, wasm.OpcodeGlobalSet:
+		u1, err = c.readUint32()
+	case wasm.OpcodeI32Load, wasm.OpcodeI32Store:
+		if _, err = c.readUint32(); err != nil { // ignore memory align
+			return err
+		}
+		u1, err = c.readUint32()
+	case wasm.OpcodeI32Const:
+		var v int32
+		var num uint64
+		v, num, err = wasm.LoadInt32(c.body[c.pc:])
+		c.pc += int(num)
+		u1 = uint64(uint32(v))
+	}
+	if err != nil {
+		return fmt.Errorf("read immediate: %w", err)
+	}
+
+	wasDead := c.dead
+	if c.dead {
+		switch op {
+		case wasm.OpcodeBlock, wasm.OpcodeLoop, wasm.OpcodeIf:
+			c.deadDepth++
+			return nil
+		case wasm.OpcodeElse, wasm.OpcodeEnd:
+			if c.deadDepth > 0 {
+				if op == wasm.OpcodeEnd {
+					c.deadDepth--
+				}
+				return nil
+			}
+			c.dead = false
+		default:
+			return nil
+		}
+	}
+
+	c.before = c.height
+	switch op {
+	case wasm.OpcodeUnreachable:
+		c.emit(op, 0, 0)
+		c.dead = true
+	case wasm.OpcodeNop:
+	case wasm.OpcodeBlock:
+		if _, err := c.pushFrame(bt); err != nil {
+			return err
+		}
+	case wasm.OpcodeLoop:
+		fr, err := c.pushFrame(bt)
+		if err != nil {
+			return err
+		}
+		fr.isLoop = true
+		fr.startPC = len(c.code)
+	case wasm.OpcodeIf:
+		if err := c.pop(1); err != nil {
+			return err
+		}
+		fr, err := c.pushFrame(bt)
+		if err != nil {
+			return err
+		}
+		fr.ifPC = c.emit(op, 0, 0)
+	case wasm.OpcodeElse:
+		fr := c.frames[len(c.frames)-1]
+		if fr.ifPC < 0 {
+			return errors.New("else without if")
+		}
+		if err := c.checkResults(fr, wasDead); err != nil {
+			return err
+		}
+		fr.patches = append(fr.patches, c.emit(op, 0, 0))
+		c.code[fr.ifPC].u1 = uint64(len(c.code))
+		fr.ifPC = -1
+		c.height = fr.height + len(fr.blockType.Params)
+	case wasm.OpcodeEnd:
+		fr := c.frames[len(c.frames)-1]
+		if err := c.checkResults(fr, wasDead); err != nil {
+			return err
+		}
+		if fr.ifPC >= 0 && len(fr.blockType.Params) != len(fr.blockType.Results) {
+			return errors.New("if without else must have as many results as params")
+		}
+		c.frames = c.frames[:len(c.frames)-1]
+		end := len(c.code)
+		if len(c.frames) == 0 {
+			c.before = fr.height + len(fr.blockType.Results)
+			c.emit(wasm.OpcodeReturn, 0, unwind(len(fr.blockType.Results), 0))
+		}
+		if fr.ifPC >= 0 {
+			c.code[fr.ifPC].u1 = uint64(end)
+		}
+		for _, pc := range fr.patches {
+			c.code[pc].u1 = uint64(end)
+		}
+		c.height = fr.height + len(fr.blockType.Results)
+	case wasm.OpcodeBr, wasm.OpcodeBrIf:
+		if op == wasm.OpcodeBrIf {
+			if err := c.pop(1); err != nil {
+				return err
+			}
+		}
+		if u1 >= uint64(len(c.frames)) {
+			return fmt.Errorf("invalid label: %d", u1)
+		}
+		fr := c.frames[len(c.frames)-1-int(u1)]
+		keep := len(fr.blockType.Results)
+		if fr.isLoop {
+			keep = len(fr.blockType.Params)
+		}
+		if err := c.need(keep); err != nil {
+			return err
+		}
+		pc := c.emit(op, uint64(fr.startPC), unwind(keep, c.height-fr.height-keep))
+		if !fr.isLoop {
+			fr.patches = append(fr.patches, pc)
+		}
+		c.dead = op == wasm.OpcodeBr
+	case wasm.OpcodeReturn:
+		keep := len(c.frames[0].blockType.Results)
+		if err := c.need(keep); err != nil {
+			return err
+		}
+		c.emit(op, 0, unwind(keep, c.height-keep))
+		c.dead = true
+	case wasm.OpcodeCall:
+		if u1 >= uint64(len(c.funcTypes)) {
+			return fmt.Errorf("invalid function index: %d", u1)
+		}
+		ft := c.funcTypes[u1]
+		if err := c.pop(len(ft.Params)); err != nil {
+			return err
+		}
+		c.height += len(ft.Results)
+		c.emit(op, u1, 0)
+	case wasm.OpcodeDrop:
+		if err := c.pop(1); err != nil {
+			return err
+		}
+		c.emit(op, 0, 0)
+	case wasm.OpcodeLocalGet, wasm.OpcodeLocalSet, wasm.OpcodeLocalTee:
+		if u1 >= uint64(c.numLocals) {
+			return fmt.Errorf("invalid local index: %d", u1)
+		}
+		switch op {
+		case wasm.OpcodeLocalGet:
+			c.height++
+		case wasm.OpcodeLocalSet:
+			if err := c.pop(1); err != nil {
+				return err
+			}
+		case wasm.OpcodeLocalTee:
+			if err := c.need(1); err != nil {
+				return err
+			}
+		}
+		c.emit(op, u1, 0)
+	case wasm.OpcodeGlobalGet, wasm.OpcodeGlobalSet:
+		if u1 >= uint64(len(c.module.GlobalSection)) {
+			return fmt.Errorf("invalid global index: %d", u1)
+		}
+		if op == wasm.OpcodeGlobalGet {
+			c.height++
+		} else if !c.module.GlobalSection[u1].Type.Mutable {
+			return fmt.Errorf("global %d is immutable", u1)
+		} else if err := c.pop(1); err != nil {
+			return err
+		}
+		c.emit(op, u1, 0)
+	case wasm.OpcodeI32Load, wasm.OpcodeI32Store:
+		if c.module.MemorySection == nil {
+			return errors.New("memory instruction requires a memory")
+		}
+		n := 1
+		if op == wasm.OpcodeI32Store {
+			n = 2
+		}
+		if err := c.pop(n); err != nil {
+			return err
+		}
+		if op == wasm.OpcodeI32Load {
+			c.height++
+		}
+		c.emit(op, u1, 0)
+	case wasm.OpcodeI32Const:
+		c.height++
+		c.emit(op, u1, 0)
+	case wasm.OpcodeI32Eqz:
+		if err := c.need(1); err != nil {
+			return err
+		}
+		c.emit(op, 0, 0)
+	case wasm.OpcodeI32Eq, wasm.OpcodeI32Ne, wasm.OpcodeI32Lts, wasm.OpcodeI32Add, wasm.OpcodeI32Sub:
+		if err := c.pop(2); err != nil {
+			return err
+		}
+		c.height++
+		c.emit(op, 0, 0)
+	default:
+		return errors.New("vm instruction not defined")
+	}
+	return nil
+}
+
+// emit appends an instruction along with the stack height before it.
+func (c *compiler) emit(op wasm.Opcode, u1, u2 uint64) int {
+	c.code = append(c.code, instruction{op: op, u1: u1, u2: u2})
+	c.heights = append(c.heights, c.before)
+	return len(c.code) - 1
+}
+
+// pushFrame enters a block taking its params from the stack.
+func (c *compiler) pushFrame(bt *wasm.FunctionType) (*controlFrame, error) {
+	if err := c.need(len(bt.Params)); err != nil {
+		return nil, err
+	}
+	fr := &controlFrame{
+		blockType: bt,
+		height:    c.height - len(bt.Params),
+		ifPC:      -1,
+	}
+	c.frames = append(c.frames, fr)
+	return fr, nil
+}
+
+// need checks that the innermost block has n values on the stack. Values
+// below its params belong to the enclosing blocks.
+func (c *compiler) need(n int) error {
+	if c.height-n < c.frames[len(c.frames)-1].height {
+		return errors.New("stack underflow")
+	}
+	return nil
+}
+
+// pop removes n values of the innermost block from the stack.
+func (c *compiler) pop(n int) error {
+	if err := c.need(n); err != nil {
+		return err
+	}
+	c.height -= n
+	return nil
+}
+
+// checkResults checks that the stack holds exactly the results of fr at its
+// end or else. The stack of unreachable code is not tracked.
+func (c *compiler) checkResults(fr *controlFrame, unreachable bool) error {
+	if want := fr.height + len(fr.blockType.Results); !unreachable && c.height != want {
+		return fmt.Errorf("block has %d values at its end, want %d", c.height-fr.height, len(fr.blockType.Results))
+	}
+	return nil
+}
+
+func (c *compiler) readUint32() (uint64, error) {
+	v, num, err := wasm.LoadUint32(c.body[c.pc:])
+	c.pc += int(num)
+	return uint64(v), err
+}
+
+// readBlockType reads the block type, see wasm.Module.LoadBlockType.
+func (c *compiler) readBlockType() (*wasm.FunctionType, error) {
+	bt, num, err := c.module.LoadBlockType(c.body[c.pc:])
+	c.pc += int(num)
+	return bt, err
+}
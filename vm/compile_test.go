@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func TestCompileMalformed(t *testing.T) {
+	none := []wasm.ValueType(nil)
+	one := []wasm.ValueType{i32}
+	tests := []struct {
+		name    string
+		results []wasm.ValueType
+		// body returns the body of the function, given m to add block types to.
+		body    func(m *testModule) []any
+		wantErr string
+	}{
+		{"add on empty stack", one, func(*testModule) []any {
+			return []any{wasm.OpcodeI32Add}
+		}, "stack underflow"},
+		{"drop on empty stack", none, func(*testModule) []any {
+			return []any{wasm.OpcodeDrop}
+		}, "stack underflow"},
+		{"store of one value", none, func(*testModule) []any {
+			return []any{i32c(0), imm(wasm.OpcodeI32Store, 2), wasm.EncodeUint32(0)}
+		}, "stack underflow"},
+		{"call without params", one, func(m *testModule) []any {
+			callee := m.function("", []wasm.ValueType{i32, i32}, one, nil, i32c(0))
+			return []any{i32c(1), imm(wasm.OpcodeCall, callee)}
+		}, "stack underflow"},
+		{"if without condition", none, func(*testModule) []any {
+			return []any{imm(wasm.OpcodeIf, 0x40), wasm.OpcodeEnd}
+		}, "stack underflow"},
+		{"block params over the stack", one, func(m *testModule) []any {
+			bt := m.typeIndex([]wasm.ValueType{i32, i32}, one)
+			return []any{i32c(1), imm(wasm.OpcodeBlock, bt), wasm.OpcodeI32Add, wasm.OpcodeEnd}
+		}, "stack underflow"},
+		{"pop below the block", one, func(*testModule) []any {
+			return []any{i32c(1), imm(wasm.OpcodeBlock, uint32(i32)), wasm.OpcodeI32Eqz, wasm.OpcodeEnd}
+		}, "stack underflow"},
+		{"br without its values", one, func(*testModule) []any {
+			return []any{i32c(1), imm(wasm.OpcodeBlock, uint32(i32)), imm(wasm.OpcodeBr, 0), wasm.OpcodeEnd}
+		}, "stack underflow"},
+		{"return without its values", one, func(*testModule) []any {
+			return []any{imm(wasm.OpcodeBlock, 0x40), wasm.OpcodeReturn, wasm.OpcodeEnd, i32c(0)}
+		}, "stack underflow"},
+		{"missing block result", none, func(*testModule) []any {
+			return []any{imm(wasm.OpcodeBlock, uint32(i32)), wasm.OpcodeEnd, wasm.OpcodeDrop}
+		}, "block has 0 values at its end, want 1"},
+		{"extra block result", none, func(*testModule) []any {
+			return []any{imm(wasm.OpcodeBlock, 0x40), i32c(1), wasm.OpcodeEnd}
+		}, "block has 1 values at its end, want 0"},
+		{"missing function result", one, func(*testModule) []any {
+			return nil
+		}, "block has 0 values at its end, want 1"},
+		{"missing then result", none, func(*testModule) []any {
+			return []any{i32c(1), imm(wasm.OpcodeIf, uint32(i32)), wasm.OpcodeElse, i32c(2), wasm.OpcodeEnd, wasm.OpcodeDrop}
+		}, "block has 0 values at its end, want 1"},
+		{"if without else", none, func(*testModule) []any {
+			return []any{i32c(1), imm(wasm.OpcodeIf, uint32(i32)), i32c(2), wasm.OpcodeEnd, wasm.OpcodeDrop}
+		}, "if without else must have as many results as params"},
+		{"else without if", none, func(*testModule) []any {
+			return []any{imm(wasm.OpcodeBlock, 0x40), wasm.OpcodeElse, wasm.OpcodeEnd}
+		}, "else without if"},
+		{"invalid label", none, func(*testModule) []any {
+			return []any{imm(wasm.OpcodeBr, 1)}
+		}, "invalid label: 1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &testModule{}
+			m.withMemory(1, 1)
+			body := tc.body(m)
+			m.function("f", nil, tc.results, nil, body...)
+			_, err := CompileBinary(m.binary(), NewConfig())
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("CompileBinary() error = %v, want %s", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestCompileUnreachable checks that the stack of unreachable code is not
+// checked against the block results.
+func TestCompileUnreachable(t *testing.T) {
+	m := &testModule{}
+	m.function("f", nil, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeBlock, uint32(i32)), i32c(1), imm(wasm.OpcodeBr, 0), wasm.OpcodeI32Add, wasm.OpcodeEnd,
+		wasm.OpcodeUnreachable)
+	if _, err := CompileBinary(m.binary(), NewConfig()); err != nil {
+		t.Errorf("CompileBinary() error = %v", err)
+	}
+}
+
+// TestInstantiateMalformed checks that every engine fails to instantiate a
+// malformed body instead of panicking.
+func TestInstantiateMalformed(t *testing.T) {
+	m := &testModule{}
+	m.function("f", nil, []wasm.ValueType{i32}, nil, wasm.OpcodeI32Add)
+	mod, err := wasm.DecodeModule(m.binary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			_, err := InstantiateModuleWithConfig(mod, NewConfig().WithEngine(e.engine))
+			if err == nil || !strings.Contains(err.Error(), "stack underflow") {
+				t.Errorf("InstantiateModuleWithConfig() error = %v, want stack underflow", err)
+			}
+		})
+	}
+}
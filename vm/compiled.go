@@ -0,0 +1,189 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// CompiledModule is a module compiled for an engine. It can be instantiated
+// many times without compiling the functions again. A CompiledModule is
+// immutable and safe for concurrent use by multiple goroutines, provided the
+// wasm.Module it was compiled from isn't modified.
+type CompiledModule struct {
+	module    *wasm.Module
+	engine    Engine
+	funcTypes []*wasm.FunctionType
+	// functions are the defined functions, shared by all instances.
+	functions []*WasmFunction
+	// data are the data segments copied into the memory of each instance,
+	// and globals the initial values of the globals.
+	data    []dataSegment
+	globals []uint64
+}
+
+type dataSegment struct {
+	offset uint32
+	init   []byte
+}
+
+// CompileModule compiles the functions of module for the engine of config.
+func CompileModule(module *wasm.Module, config *Config) (*CompiledModule, error) {
+	c, err := newCompiledModule(module, config.engine)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.compile(); err != nil {
+		return nil, err
+	}
+	if err := c.compileJIT(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CompileBinary decodes and compiles a module binary. With the compilation
+// cache of config, the compiled functions are loaded from and stored to it.
+func CompileBinary(binary []byte, config *Config) (*CompiledModule, error) {
+	module, err := wasm.DecodeModule(binary)
+	if err != nil {
+		return nil, err
+	}
+	if config.cache == nil {
+		return CompileModule(module, config)
+	}
+
+	c, err := newCompiledModule(module, config.engine)
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(binary, config.engine)
+	if !config.cache.load(key, c) {
+		if err := c.compile(); err != nil {
+			return nil, err
+		}
+		config.cache.store(key, c)
+	}
+	if err := c.compileJIT(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Module returns the decoded module.
+func (c *CompiledModule) Module() *wasm.Module {
+	return c.module
+}
+
+func newCompiledModule(module *wasm.Module, engine Engine) (*CompiledModule, error) {
+	if len(module.FunctionSection) != len(module.CodeSection) {
+		return nil, fmt.Errorf("function and code section have inconsistent lengths")
+	}
+
+	c := &CompiledModule{
+		module:    module,
+		engine:    engine,
+		funcTypes: make([]*wasm.FunctionType, int(module.ImportFunctionCount)+len(module.FunctionSection)),
+	}
+	for _, imp := range module.ImportSection {
+		// Only functions can be imported, the module can't refer to
+		// memories, globals and tables outside of it.
+		if imp.Type != wasm.ExternTypeFunc {
+			return nil, fmt.Errorf("unsupported import: %s %s.%s", wasm.ExternTypeName(imp.Type), imp.Module, imp.Name)
+		}
+		c.funcTypes[imp.IndexPerType] = &module.TypeSection[imp.DescFunc]
+	}
+	if err := c.initData(); err != nil {
+		return nil, err
+	}
+	for i := range module.GlobalSection {
+		val, err := evalConstantExpression(&module.GlobalSection[i].Init)
+		if err != nil {
+			return nil, fmt.Errorf("global[%d]: %w", i, err)
+		}
+		c.globals = append(c.globals, val)
+	}
+
+	for i, fidx := range module.FunctionSection {
+		c.funcTypes[int(module.ImportFunctionCount)+i] = &module.TypeSection[fidx]
+		c.functions = append(c.functions, &WasmFunction{
+			FunctionType:            &module.TypeSection[fidx],
+			LocalTypes:              module.CodeSection[i].LocalTypes,
+			Body:                    module.CodeSection[i].Body,
+			BodyOffsetInCodeSection: module.CodeSection[i].BodyOffsetInCodeSection,
+		})
+	}
+	return c, nil
+}
+
+// initData checks the initial size of the memory, evaluates the offsets of
+// the data segments and checks they fit in it.
+func (c *CompiledModule) initData() error {
+	m := c.module
+	if m.MemorySection == nil {
+		if len(m.DataSection) > 0 {
+			return fmt.Errorf("data segments require a memory")
+		}
+		return nil
+	}
+
+	if m.MemorySection.Min > maxMemoryPages {
+		return fmt.Errorf("memory size out of limit: %d pages, up to %d", m.MemorySection.Min, maxMemoryPages)
+	}
+	size := uint64(m.MemorySection.Min) * uint64(wasm.MemoryPageSize)
+	for i, ds := range m.DataSection {
+		if ds.OffsetExpression.Opcode != wasm.OpcodeI32Const {
+			return fmt.Errorf("data[%d]: invalid opcode: %#x", i, ds.OffsetExpression.Opcode)
+		}
+		offset, _, err := wasm.LoadInt32(ds.OffsetExpression.Data)
+		if err != nil {
+			return fmt.Errorf("data[%d]: decode int32 error: %w", i, err)
+		}
+		if offset < 0 || uint64(offset)+uint64(len(ds.Init)) > size {
+			return fmt.Errorf("data[%d]: memory size out of limit", i)
+		}
+		c.data = append(c.data, dataSegment{offset: uint32(offset), init: ds.Init})
+	}
+	return nil
+}
+
+// compile compiles the functions for the interpreters.
+func (c *CompiledModule) compile() error {
+	for i, f := range c.functions {
+		if err := compile(c.module, c.funcTypes, f); err != nil {
+			return fmt.Errorf("func[%d]: %w", i, err)
+		}
+		if c.engine == EngineRegister || c.engine == EngineJIT {
+			rc, err := translateRegister(f, c.funcTypes)
+			if err != nil {
+				return fmt.Errorf("func[%d]: %w", i, err)
+			}
+			f.regCode = rc
+		}
+	}
+	return nil
+}
+
+// compileJIT compiles the register code into native code for EngineJIT.
+// The native code isn't cached, being quick to generate from the register code.
+// The code is validated first, as the native code has no bounds checks.
+func (c *CompiledModule) compileJIT() error {
+	if c.engine != EngineJIT {
+		return nil
+	}
+	for i, f := range c.functions {
+		if err := c.validateCode(f); err != nil {
+			return fmt.Errorf("func[%d]: %w", i, err)
+		}
+		jc, err := compileJIT(f)
+		if errors.Is(err, errJITUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("func[%d]: %w", i, err)
+		}
+		f.jitCode = jc
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package vm
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestCompiledModuleConcurrent instantiates one CompiledModule and invokes
+// the instances from many goroutines, which share the compiled functions.
+func TestCompiledModuleConcurrent(t *testing.T) {
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			config := NewConfig().WithEngine(e.engine)
+			compiled, err := CompileBinary(engineTestModule().binary(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for i := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					vm, err := InstantiateCompiledModule(compiled, config)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					for j := range 50 {
+						n := uint64(i*50 + j)
+						if got, err := vm.InvokeFunction("sum", n); err != nil || got != n*(n+1)/2 {
+							t.Errorf("sum(%d) = %d, %v, want %d", n, got, err, n*(n+1)/2)
+							return
+						}
+						if got, err := vm.InvokeFunction("storeLoad", 100, n); err != nil || got != n {
+							t.Errorf("storeLoad(100, %d) = %d, %v, want %d", n, got, err, n)
+							return
+						}
+					}
+					// Each instance has its own global, starting at 7.
+					if got, err := vm.InvokeFunction("inc", 1); err != nil || got != 8 {
+						t.Errorf("inc(1) = %d, %v, want 8", got, err)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package vm
+
+import "fmt"
+
+const (
+	// DefaultMaxStackSize is the default maximum number of values on the value stack.
+	DefaultMaxStackSize = 1 << 20
+	// DefaultMaxCallDepth is the default maximum number of nested function calls.
+	DefaultMaxCallDepth = 10000
+)
+
+// Engine selects how compiled functions are executed.
+type Engine int
+
+const (
+	// EngineStack interprets compiled instructions on the value stack.
+	EngineStack Engine = iota
+	// EngineRegister translates compiled instructions for a register
+	// machine, which keeps locals and temporaries in a register file per
+	// frame and moves fewer values around than EngineStack.
+	EngineRegister
+	// EngineJIT compiles functions into native code on linux/amd64.
+	// Elsewhere, and while fuel metering is enabled, functions run on
+	// EngineRegister instead.
+	EngineJIT
+)
+
+// Config configures a VM on InstantiateModuleWithConfig.
+// The With methods return a modified copy, so a Config can be shared.
+type Config struct {
+	maxStackSize int
+	maxCallDepth int
+	engine       Engine
+	cache        *CompilationCache
+	wasi         *WASIConfig
+}
+
+func NewConfig() *Config {
+	return &Config{
+		maxStackSize: DefaultMaxStackSize,
+		maxCallDepth: DefaultMaxCallDepth,
+		wasi:         NewWASIConfig(),
+	}
+}
+
+// WithMaxStackSize limits the number of values on the value stack. The stack
+// grows on demand up to this size, beyond which calls trap with
+// ErrCallStackExhausted. It panics if n isn't positive.
+func (c *Config) WithMaxStackSize(n int) *Config {
+	if n <= 0 {
+		panic(fmt.Sprintf("vm: non-positive max stack size %d", n))
+	}
+	ret := c.clone()
+	ret.maxStackSize = n
+	return ret
+}
+
+// WithMaxCallDepth limits the number of nested function calls, beyond which
+// calls trap with ErrCallStackExhausted.
+func (c *Config) WithMaxCallDepth(n int) *Config {
+	ret := c.clone()
+	ret.maxCallDepth = n
+	return ret
+}
+
+// WithEngine selects the engine executing functions. The default is EngineStack.
+func (c *Config) WithEngine(e Engine) *Config {
+	ret := c.clone()
+	ret.engine = e
+	return ret
+}
+
+// WithCompilationCache makes CompileBinary load compiled functions from and
+// store them to cache.
+func (c *Config) WithCompilationCache(cache *CompilationCache) *Config {
+	ret := c.clone()
+	ret.cache = cache
+	return ret
+}
+
+// WithWASI configures the WASI functions imported by the module. The
+// default is NewWASIConfig.
+func (c *Config) WithWASI(wasi *WASIConfig) *Config {
+	ret := c.clone()
+	ret.wasi = wasi
+	return ret
+}
+
+func (c *Config) clone() *Config {
+	ret := *c
+	return &ret
+}
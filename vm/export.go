@@ -0,0 +1,58 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// ExportedMemory returns the memory exported under the given name.
+func (vm *VM) ExportedMemory(name string) (*MemoryInstance, error) {
+	exp, err := vm.export(name, wasm.ExternTypeMemory)
+	if err != nil {
+		return nil, err
+	}
+
+	if exp.Index != 0 || vm.Store.Memory == nil {
+		return nil, fmt.Errorf("export memory index out of range")
+	}
+	return vm.Store.Memory, nil
+}
+
+// ExportedGlobal returns the global exported under the given name.
+func (vm *VM) ExportedGlobal(name string) (*GlobalInstance, error) {
+	exp, err := vm.export(name, wasm.ExternTypeGlobal)
+	if err != nil {
+		return nil, err
+	}
+
+	if int(exp.Index) >= len(vm.Store.Globals) {
+		return nil, fmt.Errorf("export global index out of range")
+	}
+	return vm.Store.Globals[exp.Index], nil
+}
+
+// ExportedTable returns the table exported under the given name.
+func (vm *VM) ExportedTable(name string) (*TableInstance, error) {
+	exp, err := vm.export(name, wasm.ExternTypeTable)
+	if err != nil {
+		return nil, err
+	}
+
+	if int(exp.Index) >= len(vm.Store.Tables) {
+		return nil, fmt.Errorf("export table index out of range")
+	}
+	return vm.Store.Tables[exp.Index], nil
+}
+
+func (vm *VM) export(name string, et wasm.ExternType) (*wasm.Export, error) {
+	exp, ok := vm.Store.ModuleInstance.Exports[name]
+	if !ok {
+		return nil, fmt.Errorf("export %s %s is not found", wasm.ExternTypeName(et), name)
+	}
+
+	if exp.Type != et {
+		return nil, fmt.Errorf("export %s %s is not %s type", wasm.ExternTypeName(et), name, wasm.ExternTypeName(et))
+	}
+	return exp, nil
+}
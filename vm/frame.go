@@ -1,17 +1,15 @@
 package vm
 
 type Frame struct {
-	PC         uint64
-	Function   *WasmFunction
-	Locals     []uint64
-	LabelStack *LabelStack
+	PC       uint64
+	Function *WasmFunction
+	Locals   []uint64
 }
 
 func NewFrame(f *WasmFunction, locals []uint64) *Frame {
 	return &Frame{
-		PC:         0,
-		Function:   f,
-		Locals:     locals,
-		LabelStack: NewLabelStack(),
+		PC:       0,
+		Function: f,
+		Locals:   locals,
 	}
 }
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"errors"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// ErrOutOfFuel is the trap raised when an instruction costs more fuel than remains.
+var ErrOutOfFuel = errors.New("out of fuel")
+
+// DefaultFuelCost is charged for opcodes missing from a FuelCostTable.
+const DefaultFuelCost = 1
+
+// FuelCostTable is the fuel charged for each dispatched instruction.
+// block, loop, nop and end are resolved on compilation and cost nothing,
+// except the end of a function which is charged as return.
+type FuelCostTable map[wasm.Opcode]uint64
+
+// EnableFuel turns on fuel metering with the given costs; a nil table charges
+// DefaultFuelCost for every instruction. The VM starts with no fuel, so
+// AddFuel must be called before invoking functions.
+func (vm *VM) EnableFuel(costs FuelCostTable) {
+	for i := range vm.fuelCosts {
+		cost, ok := costs[wasm.Opcode(i)]
+		if !ok {
+			cost = DefaultFuelCost
+		}
+		vm.fuelCosts[i] = cost
+	}
+	vm.fuelEnabled = true
+}
+
+// AddFuel refuels the VM by delta.
+func (vm *VM) AddFuel(delta uint64) {
+	vm.fuel += delta
+}
+
+// Fuel returns the remaining fuel.
+func (vm *VM) Fuel() uint64 {
+	return vm.fuel
+}
+
+// FuelConsumed returns the total fuel consumed since the VM was instantiated.
+func (vm *VM) FuelConsumed() uint64 {
+	return vm.fuelConsumed
+}
+
+// consumeFuel charges the cost of op, or traps with ErrOutOfFuel.
+func (vm *VM) consumeFuel(op wasm.Opcode) {
+	cost := vm.fuelCosts[op]
+	if cost > vm.fuel {
+		panic(ErrOutOfFuel)
+	}
+	vm.fuel -= cost
+	vm.fuelConsumed += cost
+}
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func TestFuel(t *testing.T) {
+	m := sumModule()
+	m.function("add", []wasm.ValueType{i32, i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), wasm.OpcodeI32Add)
+
+	// sumConsumed is the fuel consumed by sum(10) on the stack engine, which
+	// the other engines must charge too.
+	var sumConsumed uint64
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			vm := m.instantiate(t, NewConfig().WithEngine(e.engine))
+			// add costs 2 local.get, an i32.add and the end of the function.
+			vm.EnableFuel(FuelCostTable{wasm.OpcodeI32Add: 10})
+
+			if _, err := vm.InvokeFunction("add", 1, 2); !errors.Is(err, ErrOutOfFuel) || err.Error() != "wasm error: out of fuel" {
+				t.Errorf("error = %v without fuel, want wasm error: out of fuel", err)
+			}
+			vm.AddFuel(12)
+			if _, err := vm.InvokeFunction("add", 1, 2); !errors.Is(err, ErrOutOfFuel) {
+				t.Errorf("error = %v with 12 fuel, want %v", err, ErrOutOfFuel)
+			}
+			// The fuel consumed before the trap isn't refunded.
+			if vm.Fuel() != 0 || vm.FuelConsumed() != 12 {
+				t.Errorf("fuel = %d, consumed %d after the trap, want 0, 12", vm.Fuel(), vm.FuelConsumed())
+			}
+			vm.AddFuel(13)
+			if got, err := vm.InvokeFunction("add", 1, 2); err != nil || got != 3 {
+				t.Errorf("add(1, 2) = %d, %v, want 3", got, err)
+			}
+			if vm.Fuel() != 0 || vm.FuelConsumed() != 25 {
+				t.Errorf("fuel = %d, consumed %d, want 0, 25", vm.Fuel(), vm.FuelConsumed())
+			}
+
+			vm.EnableFuel(nil)
+			vm.AddFuel(1000)
+			consumed := vm.FuelConsumed()
+			if got, err := vm.InvokeFunction("sum", 10); err != nil || got != 55 {
+				t.Fatalf("sum(10) = %d, %v, want 55", got, err)
+			}
+			consumed = vm.FuelConsumed() - consumed
+			if sumConsumed == 0 {
+				sumConsumed = consumed
+			} else if consumed != sumConsumed {
+				t.Errorf("sum(10) consumed %d fuel, want %d as on the stack engine", consumed, sumConsumed)
+			}
+			if vm.Fuel()+consumed != 1000 {
+				t.Errorf("fuel = %d, want %d", vm.Fuel(), 1000-consumed)
+			}
+		})
+	}
+}
@@ -1,33 +1,47 @@
 package vm
 
 import (
+	"time"
+
 	"github.com/kawabatas/toy-wasm-runtime/wasm"
 )
 
 type (
 	Function interface {
 		Call(vm *VM)
+		Type() *wasm.FunctionType
 		// In the current version of WebAssembly,
 		// the length of the result type vector of a valid function type may be at most 1.
 		// This restriction may be removed in future versions.
 		HasResult() bool
 	}
 
+	// HostFunction is a function imported from the host.
 	HostFunction struct {
-		FdWrite *wasiFdWrite
+		FunctionType *wasm.FunctionType
+		// Module and Name are the names the function is imported with.
+		Module, Name string
+		// fn is called with the parameters and returns the result, if any.
+		fn func(vm *VM, params []uint64) uint64
+		// trace, if not nil, is called after fn with the parameters, the
+		// result and the duration of the call, even if fn panics.
+		trace func(vm *VM, params []uint64, result uint64, d time.Duration)
 	}
 
 	WasmFunction struct {
 		FunctionType            *wasm.FunctionType
+		LocalTypes              []wasm.ValueType
 		BodyOffsetInCodeSection uint64
 		Body                    []byte
-		Blocks                  map[uint64]*WasmFunctionBlock
-	}
-
-	WasmFunctionBlock struct {
-		StartAt, ElseAt, EndAt uint64
-		BlockType              *wasm.FunctionType
-		BlockTypeBytes         uint64
+		// Code is Body compiled on instantiation.
+		Code []instruction
+		// heights are the stack heights before each instruction of Code.
+		heights   []int
+		maxHeight int
+		// regCode is Code translated for EngineRegister, or nil.
+		regCode *registerCode
+		// jitCode is regCode compiled for EngineJIT, or nil.
+		jitCode *jitCode
 	}
 )
 
@@ -36,19 +50,35 @@ var (
 	_ Function = (*WasmFunction)(nil)
 )
 
+func (f *HostFunction) Type() *wasm.FunctionType {
+	return f.FunctionType
+}
+
 func (f *HostFunction) HasResult() bool {
-	return false
+	return len(f.FunctionType.Results) > 0
 }
 
 func (f *HostFunction) Call(vm *VM) {
-	// only support $fd_write (param i32 i32 i32 i32) (result i32)
-	in := make([]int32, 4)
-	for i := len(in) - 1; i >= 0; i-- {
-		raw := vm.stack.Pop()
-		in[i] = int32(raw)
+	params := make([]uint64, len(f.FunctionType.Params))
+	for i := len(params) - 1; i >= 0; i-- {
+		params[i] = vm.stack.Pop()
 	}
 
-	f.FdWrite.Call(in[0], in[1], in[2], in[3])
+	var ret uint64
+	if f.trace != nil {
+		start := time.Now()
+		defer func() {
+			f.trace(vm, params, ret, time.Since(start))
+		}()
+	}
+	ret = f.fn(vm, params)
+	if f.HasResult() {
+		vm.stack.Push(ret)
+	}
+}
+
+func (f *WasmFunction) Type() *wasm.FunctionType {
+	return f.FunctionType
 }
 
 func (f *WasmFunction) HasResult() bool {
@@ -56,37 +86,111 @@ func (f *WasmFunction) HasResult() bool {
 }
 
 func (f *WasmFunction) Call(vm *VM) {
+	vm.enterCall()
+	if f.regCode != nil {
+		vm.callRegister(f)
+		vm.callDepth--
+		return
+	}
+
+	// The locals are kept in the register file, and the frame is reused by
+	// the next call at the same depth, so that calls don't allocate.
 	paramCount := len(f.FunctionType.Params)
-	locals := make([]uint64, f.BodyOffsetInCodeSection+uint64(paramCount))
-	for i := 0; i < paramCount; i++ {
-		locals[paramCount-1-i] = vm.stack.Pop()
+	base := vm.reserveRegisters(paramCount + len(f.LocalTypes))
+	locals := vm.regs[base:vm.regTop]
+	clear(locals[paramCount:])
+	for i := paramCount - 1; i >= 0; i-- {
+		locals[i] = vm.stack.Pop()
 	}
 
 	prev := vm.activeFrame
-	vm.activeFrame = NewFrame(f, locals)
+	vm.activeFrame = vm.frame(f, locals)
 	vm.invokeActiveFunction()
 	vm.activeFrame = prev
+	vm.regTop = base
+	vm.callDepth--
+}
+
+// frame returns the frame of the current call depth set to run f with locals.
+func (vm *VM) frame(f *WasmFunction, locals []uint64) *Frame {
+	for len(vm.frames) < vm.callDepth {
+		vm.frames = append(vm.frames, &Frame{})
+	}
+	frame := vm.frames[vm.callDepth-1]
+	*frame = Frame{Function: f, Locals: locals}
+	return frame
+}
+
+// enterCall checks the context and the call depth before a function call.
+func (vm *VM) enterCall() {
+	vm.checkContext()
+	if vm.callDepth >= vm.maxCallDepth {
+		panic(ErrCallStackExhausted)
+	}
+	vm.callDepth++
 }
 
 func (vm *VM) invokeActiveFunction() {
-	var total int
-	for ; int(vm.activeFrame.PC) < len(vm.activeFrame.Function.Body); vm.activeFrame.PC++ {
-		total++
-		op := vm.activeFrame.Function.Body[vm.activeFrame.PC]
-		switch wasm.Opcode(op) {
-		case wasm.OpcodeReturn:
-			return
-		default:
-			f, ok := instructionMap[op]
-			if !ok {
-				panic("vm instruction not defined")
-			}
-			f(vm)
+	frame := vm.activeFrame
+	code := frame.Function.Code
+	for frame.PC < uint64(len(code)) {
+		vm.ticks++
+		if vm.ticks&ctxCheckInterval == 0 {
+			vm.checkContext()
 		}
 
-		// forced termination
-		if total == 100000 {
-			break
+		in := &code[frame.PC]
+		frame.PC++
+		if vm.fuelEnabled {
+			vm.consumeFuel(in.op)
+		}
+		switch in.op {
+		case wasm.OpcodeUnreachable:
+			panic("unreachable")
+		case wasm.OpcodeIf:
+			ifInst(vm, in)
+		case wasm.OpcodeElse:
+			elseInst(vm, in)
+		case wasm.OpcodeBr:
+			br(vm, in)
+		case wasm.OpcodeBrIf:
+			brIf(vm, in)
+		case wasm.OpcodeReturn:
+			returnInst(vm, in)
+		case wasm.OpcodeCall:
+			call(vm, in)
+		case wasm.OpcodeDrop:
+			drop(vm, in)
+		case wasm.OpcodeLocalGet:
+			localGet(vm, in)
+		case wasm.OpcodeLocalSet:
+			localSet(vm, in)
+		case wasm.OpcodeLocalTee:
+			localTee(vm, in)
+		case wasm.OpcodeGlobalGet:
+			globalGet(vm, in)
+		case wasm.OpcodeGlobalSet:
+			globalSet(vm, in)
+		case wasm.OpcodeI32Load:
+			i32Load(vm, in)
+		case wasm.OpcodeI32Store:
+			i32Store(vm, in)
+		case wasm.OpcodeI32Const:
+			i32Const(vm, in)
+		case wasm.OpcodeI32Eqz:
+			i32Eqz(vm, in)
+		case wasm.OpcodeI32Eq:
+			i32Eq(vm, in)
+		case wasm.OpcodeI32Ne:
+			i32Ne(vm, in)
+		case wasm.OpcodeI32Lts:
+			i32Lts(vm, in)
+		case wasm.OpcodeI32Add:
+			i32Add(vm, in)
+		case wasm.OpcodeI32Sub:
+			i32Sub(vm, in)
+		default:
+			panic("vm instruction not defined")
 		}
 	}
 }
@@ -0,0 +1,34 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// GlobalInstance is the runtime representation of a global variable.
+// Val holds the raw bits: i32 and f32 values use the lower 32 bits.
+// See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#global-instances%E2%91%A0
+type GlobalInstance struct {
+	Type wasm.GlobalType
+	Val  uint64
+}
+
+// Get returns the raw bits of the current value.
+func (g *GlobalInstance) Get() uint64 {
+	return g.Val
+}
+
+// Set updates the value of a mutable global. 32-bit values must fit in the
+// lower 32 bits, either zero or sign extended, as the params of InvokeFunction.
+func (g *GlobalInstance) Set(v uint64) error {
+	if !g.Type.Mutable {
+		return fmt.Errorf("global is immutable")
+	}
+	v, err := checkValue(g.Type.ValType, v)
+	if err != nil {
+		return err
+	}
+	g.Val = v
+	return nil
+}
@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func TestGlobalInstanceSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		vt      wasm.ValueType
+		mutable bool
+		v       uint64
+		want    uint64
+		wantErr string
+	}{
+		{name: "i32", vt: i32, mutable: true, v: 0xffffffff, want: 0xffffffff},
+		{name: "i32 sign extended", vt: i32, mutable: true, v: 0xffffffff_fffffffe, want: 0xfffffffe},
+		{name: "i32 overflow", vt: i32, mutable: true, v: 1 << 32, wantErr: "0x100000000 overflows i32"},
+		{name: "f32 overflow", vt: wasm.ValueTypeF32, mutable: true, v: 1 << 40, wantErr: "0x10000000000 overflows f32"},
+		{name: "i64", vt: i64, mutable: true, v: 1 << 40, want: 1 << 40},
+		{name: "immutable", vt: i32, v: 1, wantErr: "global is immutable"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &GlobalInstance{Type: wasm.GlobalType{ValType: tc.vt, Mutable: tc.mutable}}
+			err := g.Set(tc.v)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Set() error = %v, want %s", err, tc.wantErr)
+				}
+				if g.Get() != 0 {
+					t.Errorf("Get() = %#x after a failed Set, want 0", g.Get())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := g.Get(); got != tc.want {
+				t.Errorf("Get() = %#x, want %#x", got, tc.want)
+			}
+		})
+	}
+}
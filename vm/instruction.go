@@ -2,110 +2,138 @@ package vm
 
 import (
 	"encoding/binary"
-
-	"github.com/kawabatas/toy-wasm-runtime/wasm"
+	"errors"
 )
 
-var instructionMap = map[wasm.Opcode]func(vm *VM){
-	wasm.OpcodeUnreachable: func(vm *VM) { panic("unreachable") },
-	wasm.OpcodeNop:         func(vm *VM) {},
-	wasm.OpcodeIf:          ifInst,
-	wasm.OpcodeElse:        elseInst,
-	wasm.OpcodeEnd:         func(vm *VM) {},
-	wasm.OpcodeReturn:      func(vm *VM) {},
-	wasm.OpcodeCall:        call,
-	wasm.OpcodeDrop:        drop,
-	wasm.OpcodeLocalGet:    localGet,
-	wasm.OpcodeI32Load:     i32Load,
-	wasm.OpcodeI32Store:    i32Store,
-	wasm.OpcodeI32Const:    i32Const,
-	wasm.OpcodeI32Lts:      i32Lts,
-	wasm.OpcodeI32Add:      i32Add,
-	wasm.OpcodeI32Sub:      i32Sub,
-}
-
-func ifInst(vm *VM) {
-	ctx := vm.activeFrame
-	block, ok := ctx.Function.Blocks[vm.activeFrame.PC]
-	if !ok {
-		panic("function block not initialized")
-	}
-	ctx.PC += block.BlockTypeBytes
+// ErrOutOfBoundsMemoryAccess is the trap raised when a load or store exceeds the memory size.
+var ErrOutOfBoundsMemoryAccess = errors.New("out of bounds memory access")
 
-	if vm.stack.Pop() == 0 {
+func ifInst(vm *VM, in *instruction) {
+	if uint32(vm.stack.Pop()) == 0 {
 		// enter else
-		vm.activeFrame.PC = block.ElseAt
+		vm.activeFrame.PC = in.u1
 	}
+}
+
+func elseInst(vm *VM, in *instruction) {
+	vm.activeFrame.PC = in.u1
+}
 
-	ctx.LabelStack.Push(&Label{
-		Arity:          len(block.BlockType.Results),
-		ContinuationPC: block.EndAt,
-		EndPC:          block.EndAt,
-	})
+func br(vm *VM, in *instruction) {
+	vm.stack.Unwind(splitUnwind(in.u2))
+	vm.activeFrame.PC = in.u1
 }
 
-func elseInst(vm *VM) {
-	l := vm.activeFrame.LabelStack.Pop()
-	vm.activeFrame.PC = l.EndPC
+func brIf(vm *VM, in *instruction) {
+	if uint32(vm.stack.Pop()) != 0 {
+		br(vm, in)
+	}
+}
+
+func returnInst(vm *VM, in *instruction) {
+	vm.stack.Unwind(splitUnwind(in.u2))
+	vm.activeFrame.PC = uint64(len(vm.activeFrame.Function.Code))
 }
 
-func call(vm *VM) {
-	vm.activeFrame.PC++
-	index := vm.FetchUint32()
-	vm.Store.Functions[index].Call(vm)
+func call(vm *VM, in *instruction) {
+	vm.Store.Functions[in.u1].Call(vm)
 }
 
-func drop(vm *VM) {
+func drop(vm *VM, in *instruction) {
 	vm.stack.Drop()
 }
 
-func localGet(vm *VM) {
-	vm.activeFrame.PC++
-	id := vm.FetchUint32()
-	vm.stack.Push(vm.activeFrame.Locals[id])
+func localGet(vm *VM, in *instruction) {
+	vm.stack.Push(vm.activeFrame.Locals[in.u1])
+}
+
+func localSet(vm *VM, in *instruction) {
+	vm.activeFrame.Locals[in.u1] = vm.stack.Pop()
 }
 
-func _memoryBase(vm *VM) uint64 {
-	vm.activeFrame.PC++
-	_ = vm.FetchUint32() // ignore memory align
-	vm.activeFrame.PC++
-	return uint64(vm.FetchUint32()) + vm.stack.Pop()
+func localTee(vm *VM, in *instruction) {
+	vm.activeFrame.Locals[in.u1] = vm.stack.Peek()
 }
 
-func i32Load(vm *VM) {
-	base := _memoryBase(vm)
-	vm.stack.Push(uint64(binary.LittleEndian.Uint32(vm.Store.Memory[base:])))
+func globalGet(vm *VM, in *instruction) {
+	vm.stack.Push(vm.Store.Globals[in.u1].Val)
 }
 
-func i32Store(vm *VM) {
+func globalSet(vm *VM, in *instruction) {
+	vm.Store.Globals[in.u1].Val = vm.stack.Pop()
+}
+
+// _memoryBase returns the effective address of a load or store of size bytes.
+func _memoryBase(vm *VM, in *instruction, size uint64) uint64 {
+	base := uint64(uint32(vm.stack.Pop())) + in.u1
+	if base+size > uint64(len(vm.Store.Memory.Buffer)) {
+		panic(ErrOutOfBoundsMemoryAccess)
+	}
+	return base
+}
+
+func i32Load(vm *VM, in *instruction) {
+	base := _memoryBase(vm, in, 4)
+	vm.stack.Push(uint64(binary.LittleEndian.Uint32(vm.Store.Memory.Buffer[base:])))
+}
+
+func i32Store(vm *VM, in *instruction) {
 	val := vm.stack.Pop()
-	base := _memoryBase(vm)
-	binary.LittleEndian.PutUint32(vm.Store.Memory[base:], uint32(val))
+	base := _memoryBase(vm, in, 4)
+	binary.LittleEndian.PutUint32(vm.Store.Memory.Buffer[base:], uint32(val))
+	vm.Store.Memory.markDirty(base, 4)
 }
 
-func i32Const(vm *VM) {
-	vm.activeFrame.PC++
-	vm.stack.Push(uint64(vm.FetchInt32()))
+func i32Const(vm *VM, in *instruction) {
+	vm.stack.Push(in.u1)
+}
+
+func i32Eqz(vm *VM, in *instruction) {
+	if uint32(vm.stack.Pop()) == 0 {
+		vm.stack.Push(1)
+	} else {
+		vm.stack.Push(0)
+	}
+}
+
+func i32Eq(vm *VM, in *instruction) {
+	v2 := vm.stack.Pop()
+	v1 := vm.stack.Pop()
+	if uint32(v1) == uint32(v2) {
+		vm.stack.Push(1)
+	} else {
+		vm.stack.Push(0)
+	}
+}
+
+func i32Ne(vm *VM, in *instruction) {
+	v2 := vm.stack.Pop()
+	v1 := vm.stack.Pop()
+	if uint32(v1) != uint32(v2) {
+		vm.stack.Push(1)
+	} else {
+		vm.stack.Push(0)
+	}
 }
 
-func i32Lts(vm *VM) {
+func i32Lts(vm *VM, in *instruction) {
 	v2 := vm.stack.Pop()
 	v1 := vm.stack.Pop()
-	if v1 < v2 {
+	if int32(v1) < int32(v2) {
 		vm.stack.Push(1)
 	} else {
 		vm.stack.Push(0)
 	}
 }
 
-func i32Add(vm *VM) {
+func i32Add(vm *VM, in *instruction) {
 	v2 := vm.stack.Pop()
 	v1 := vm.stack.Pop()
-	vm.stack.Push(uint64(v1 + v2))
+	vm.stack.Push(uint64(uint32(v1 + v2)))
 }
 
-func i32Sub(vm *VM) {
+func i32Sub(vm *VM, in *instruction) {
 	v2 := vm.stack.Pop()
 	v1 := vm.stack.Pop()
-	vm.stack.Push(uint64(v1 - v2))
+	vm.stack.Push(uint64(uint32(v1 - v2)))
 }
@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// errJITUnsupported is returned by compileJIT on platforms without a JIT,
+// where functions run on the register engine instead.
+var errJITUnsupported = errors.New("jit is not supported on this platform")
+
+// jitContext is shared between Go and the native code of EngineJIT. The
+// trampoline loads the first four fields into registers on entry, and the
+// native code writes the exit fields before returning to Go. The layout is
+// also hard-coded in jit_amd64.s and jit_amd64.go.
+type jitContext struct {
+	regs    uintptr // R8: the register file of the frame
+	mem     uintptr // R9: the memory buffer
+	memLen  uint64  // R10: the length of the memory buffer
+	globals uintptr // R11: the Store.Globals array
+
+	// dirty is the dirty page map of the memory, marked by stores.
+	dirty uintptr
+
+	// ticks is decremented at loop headers, which exit with jitStatusTick
+	// when it reaches zero so that the context is checked periodically.
+	ticks uint64
+
+	// status is why the native code returned to Go, and pc the index of the
+	// regInstruction it returned at. resume is the code offset to continue at.
+	status, pc, resume uint32
+}
+
+const (
+	jitStatusReturn uint32 = iota
+	jitStatusCall
+	jitStatusTick
+	jitStatusUnreachable
+	jitStatusOutOfBounds
+)
+
+// jitCode is a function compiled into executable memory.
+type jitCode struct {
+	buf  []byte
+	addr uintptr
+}
+
+// executeCompiled executes f with the register file at base on its engine.
+// The native code doesn't meter fuel, so functions fall back to the register
+// engine while fuel is enabled.
+func (vm *VM) executeCompiled(f *WasmFunction, base int) uint64 {
+	if f.jitCode != nil && !vm.fuelEnabled {
+		return vm.executeJIT(f, base)
+	}
+	return vm.executeRegister(f, base)
+}
+
+// executeJIT runs the native code of f, serving its calls and traps in Go.
+func (vm *VM) executeJIT(f *WasmFunction, base int) uint64 {
+	rc := f.regCode
+	ctx := &vm.jitCtx
+	if ctx.ticks == 0 {
+		ctx.ticks = ctxCheckInterval + 1
+	}
+	var offset uint32
+	for {
+		// Calls may grow the register file, host functions the memory.
+		ctx.regs = uintptr(unsafe.Pointer(unsafe.SliceData(vm.regs))) + uintptr(base)*8
+		ctx.mem, ctx.memLen, ctx.dirty = 0, 0, 0
+		if m := vm.Store.Memory; m != nil {
+			ctx.mem, ctx.memLen = uintptr(unsafe.Pointer(unsafe.SliceData(m.Buffer))), uint64(len(m.Buffer))
+			ctx.dirty = uintptr(unsafe.Pointer(unsafe.SliceData(m.dirty)))
+		}
+		ctx.globals = uintptr(unsafe.Pointer(unsafe.SliceData(vm.Store.Globals)))
+
+		jitcall(f.jitCode.addr+uintptr(offset), ctx)
+
+		// Read the exit before a call reuses the context.
+		in := &rc.code[ctx.pc]
+		status := ctx.status
+		offset = ctx.resume
+		switch status {
+		case jitStatusReturn:
+			if in.a < 0 {
+				return 0
+			}
+			return vm.regs[base+int(in.a)]
+		case jitStatusCall:
+			ret := vm.callFromRegister(in, vm.regs[base:base+rc.numRegs])
+			if in.dst >= 0 {
+				vm.regs[base+int(in.dst)] = ret
+			}
+		case jitStatusTick:
+			vm.checkContext()
+			ctx.ticks = ctxCheckInterval + 1
+		case jitStatusUnreachable:
+			panic("unreachable")
+		case jitStatusOutOfBounds:
+			panic(ErrOutOfBoundsMemoryAccess)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+//go:build linux && amd64
+
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// Offsets of the jitContext fields written by the native code, which
+// addresses the context with DI.
+const (
+	jitDirtyOffset  = uint32(unsafe.Offsetof(jitContext{}.dirty))
+	jitTicksOffset  = uint32(unsafe.Offsetof(jitContext{}.ticks))
+	jitStatusOffset = uint32(unsafe.Offsetof(jitContext{}.status))
+	jitPCOffset     = uint32(unsafe.Offsetof(jitContext{}.pc))
+	jitResumeOffset = uint32(unsafe.Offsetof(jitContext{}.resume))
+)
+
+// Registers, numbered as in the ModRM byte.
+const (
+	rax = 0
+	rcx = 1
+)
+
+// Condition codes of jcc and setcc.
+const (
+	condA  = 0x7
+	condE  = 0x4
+	condNE = 0x5
+	condL  = 0xc
+)
+
+// compileJIT compiles the register code of f into amd64 machine code. Every
+// regInstruction becomes a sequence working on the register file in memory
+// through EAX/RAX, ECX/RCX and EDX/RDX; i32 operations use 32-bit
+// instructions, which keep the upper half of the registers zero like the
+// interpreters do. Instructions needing Go, which are calls, returns and
+// traps, return from the native code with their pc and where to resume.
+func compileJIT(f *WasmFunction) (*jitCode, error) {
+	code := f.regCode.code
+
+	loopHeaders := make([]bool, len(code))
+	for pc, in := range code {
+		switch in.op {
+		case wasm.OpcodeIf, wasm.OpcodeElse, wasm.OpcodeBr, wasm.OpcodeBrIf:
+			if int(in.u1) <= pc {
+				loopHeaders[in.u1] = true
+			}
+		}
+	}
+
+	a := &jitAssembler{}
+	offsets := make([]int, len(code))
+	var jumps []jitJump
+	var traps []int
+	for pc := range code {
+		in := &code[pc]
+		offsets[pc] = len(a.buf)
+		if loopHeaders[pc] {
+			// dec qword [rdi+ticks]; jnz over the exit
+			a.emit(0x48, 0xff, 0x8f)
+			a.imm32(jitTicksOffset)
+			a.emit(0x75, jitExitSize)
+			a.exit(jitStatusTick, pc)
+		}
+
+		switch in.op {
+		case wasm.OpcodeNop:
+		case regOpMove:
+			a.load64(rax, in.a)
+			a.store64(in.dst, rax)
+		case wasm.OpcodeUnreachable:
+			a.exit(jitStatusUnreachable, pc)
+		case wasm.OpcodeIf:
+			a.load32(rax, in.a)
+			a.emit(0x85, 0xc0) // test eax, eax
+			jumps = append(jumps, jitJump{a.jcc(condE), in.u1})
+		case wasm.OpcodeElse:
+			jumps = append(jumps, jitJump{a.jmp(), in.u1})
+		case wasm.OpcodeBr:
+			a.copyRegs(in.dst, in.a, in.n)
+			jumps = append(jumps, jitJump{a.jmp(), in.u1})
+		case wasm.OpcodeBrIf:
+			a.load32(rax, in.b)
+			a.emit(0x85, 0xc0) // test eax, eax
+			if in.n == 0 || in.dst == in.a {
+				jumps = append(jumps, jitJump{a.jcc(condNE), in.u1})
+				break
+			}
+			skip := a.jcc(condE)
+			a.copyRegs(in.dst, in.a, in.n)
+			jumps = append(jumps, jitJump{a.jmp(), in.u1})
+			a.patch(skip, len(a.buf))
+		case wasm.OpcodeReturn:
+			a.exit(jitStatusReturn, pc)
+		case wasm.OpcodeCall:
+			a.exit(jitStatusCall, pc)
+		case wasm.OpcodeGlobalGet:
+			a.loadGlobal(in.u1)
+			a.emit(0x48, 0x8b, 0x80) // mov rax, [rax+Val]
+			a.imm32(uint32(unsafe.Offsetof(GlobalInstance{}.Val)))
+			a.store64(in.dst, rax)
+		case wasm.OpcodeGlobalSet:
+			a.loadGlobal(in.u1)
+			a.load64(rcx, in.a)
+			a.emit(0x48, 0x89, 0x88) // mov [rax+Val], rcx
+			a.imm32(uint32(unsafe.Offsetof(GlobalInstance{}.Val)))
+		case wasm.OpcodeI32Load:
+			traps = append(traps, a.address(in.a, in.u1, 4))
+			a.emit(0x41, 0x8b, 0x04, 0x01) // mov eax, [r9+rax]
+			a.store64(in.dst, rax)
+		case wasm.OpcodeI32Store:
+			traps = append(traps, a.address(in.a, in.u1, 4))
+			a.load32(rcx, in.b)
+			a.emit(0x41, 0x89, 0x0c, 0x01) // mov [r9+rax], ecx
+			a.markDirty()
+		case wasm.OpcodeI32Eqz:
+			a.load32(rax, in.a)
+			a.emit(0x85, 0xc0) // test eax, eax
+			a.setcc(condE)
+			a.store64(in.dst, rax)
+		case wasm.OpcodeI32Eq, wasm.OpcodeI32Ne, wasm.OpcodeI32Lts:
+			a.load32(rax, in.a)
+			a.load32(rcx, in.b)
+			a.emit(0x39, 0xc8) // cmp eax, ecx
+			switch in.op {
+			case wasm.OpcodeI32Eq:
+				a.setcc(condE)
+			case wasm.OpcodeI32Ne:
+				a.setcc(condNE)
+			default:
+				a.setcc(condL)
+			}
+			a.store64(in.dst, rax)
+		case wasm.OpcodeI32Add:
+			a.load32(rax, in.a)
+			a.load32(rcx, in.b)
+			a.emit(0x01, 0xc8) // add eax, ecx
+			a.store64(in.dst, rax)
+		case wasm.OpcodeI32Sub:
+			a.load32(rax, in.a)
+			a.load32(rcx, in.b)
+			a.emit(0x29, 0xc8) // sub eax, ecx
+			a.store64(in.dst, rax)
+		default:
+			return nil, fmt.Errorf("jit instruction not defined: %#x", in.op)
+		}
+	}
+
+	for _, j := range jumps {
+		a.patch(j.pos, offsets[j.target])
+	}
+	trap := len(a.buf)
+	a.exit(jitStatusOutOfBounds, 0)
+	for _, pos := range traps {
+		a.patch(pos, trap)
+	}
+	return mmapCode(a.buf)
+}
+
+// jitJump is a rel32 at pos to be patched to the code of the regInstruction at target.
+type jitJump struct {
+	pos    int
+	target uint64
+}
+
+type jitAssembler struct {
+	buf []byte
+}
+
+func (a *jitAssembler) emit(b ...byte) {
+	a.buf = append(a.buf, b...)
+}
+
+func (a *jitAssembler) imm32(v uint32) {
+	a.buf = binary.LittleEndian.AppendUint32(a.buf, v)
+}
+
+// load32 emits mov r32, [r8+reg*8].
+func (a *jitAssembler) load32(r byte, reg int32) {
+	a.emit(0x41, 0x8b, 0x80|r<<3)
+	a.imm32(uint32(reg * 8))
+}
+
+// load64 emits mov r64, [r8+reg*8].
+func (a *jitAssembler) load64(r byte, reg int32) {
+	a.emit(0x49, 0x8b, 0x80|r<<3)
+	a.imm32(uint32(reg * 8))
+}
+
+// store64 emits mov [r8+reg*8], r64.
+func (a *jitAssembler) store64(reg int32, r byte) {
+	a.emit(0x49, 0x89, 0x80|r<<3)
+	a.imm32(uint32(reg * 8))
+}
+
+// loadGlobal emits mov rax, [r11+index*8], the *GlobalInstance.
+func (a *jitAssembler) loadGlobal(index uint64) {
+	a.emit(0x49, 0x8b, 0x83)
+	a.imm32(uint32(index * 8))
+}
+
+// setcc emits setcc al; movzx eax, al.
+func (a *jitAssembler) setcc(cond byte) {
+	a.emit(0x0f, 0x90|cond, 0xc0, 0x0f, 0xb6, 0xc0)
+}
+
+func (a *jitAssembler) copyRegs(dst, src, n int32) {
+	if dst == src {
+		return
+	}
+	for i := int32(0); i < n; i++ {
+		a.load64(rax, src+i)
+		a.store64(dst+i, rax)
+	}
+}
+
+// address emits rax = uint32(regs[reg]) + offset and a jump to be patched to
+// the out of bounds trap unless size bytes from it are within the memory.
+// It returns the position of the jump.
+func (a *jitAssembler) address(reg int32, offset uint64, size byte) int {
+	a.load32(rax, reg)
+	if offset != 0 {
+		a.emit(0x48, 0xb9) // mov rcx, offset
+		a.buf = binary.LittleEndian.AppendUint64(a.buf, offset)
+		a.emit(0x48, 0x01, 0xc8) // add rax, rcx
+	}
+	a.emit(0x48, 0x8d, 0x50, size) // lea rdx, [rax+size]
+	a.emit(0x4c, 0x39, 0xd2)       // cmp rdx, r10
+	return a.jcc(condA)
+}
+
+// markDirty emits the marking of the pages of the store from rax to rdx as
+// dirty, as done by MemoryInstance.markDirty.
+func (a *jitAssembler) markDirty() {
+	a.emit(0x48, 0x8b, 0x8f) // mov rcx, [rdi+dirty]
+	a.imm32(jitDirtyOffset)
+	a.emit(0x48, 0xc1, 0xe8, dirtyPageShift) // shr rax, dirtyPageShift
+	a.emit(0xc6, 0x04, 0x01, 0x01)           // mov byte [rcx+rax], 1
+	a.emit(0x48, 0xff, 0xca)                 // dec rdx
+	a.emit(0x48, 0xc1, 0xea, dirtyPageShift) // shr rdx, dirtyPageShift
+	a.emit(0xc6, 0x04, 0x11, 0x01)           // mov byte [rcx+rdx], 1
+}
+
+// jmp emits a jmp rel32 and returns the position of rel32.
+func (a *jitAssembler) jmp() int {
+	a.emit(0xe9)
+	a.imm32(0)
+	return len(a.buf) - 4
+}
+
+// jcc emits a jcc rel32 and returns the position of rel32.
+func (a *jitAssembler) jcc(cond byte) int {
+	a.emit(0x0f, 0x80|cond)
+	a.imm32(0)
+	return len(a.buf) - 4
+}
+
+func (a *jitAssembler) patch(pos, target int) {
+	binary.LittleEndian.PutUint32(a.buf[pos:], uint32(target-(pos+4)))
+}
+
+// jitExitSize is the size of the code emitted by exit.
+const jitExitSize = 31
+
+// exit emits the return to Go with the status and the pc, which resumes
+// right after it.
+func (a *jitAssembler) exit(status uint32, pc int) {
+	a.emit(0xc7, 0x87) // mov dword [rdi+status], status
+	a.imm32(jitStatusOffset)
+	a.imm32(status)
+	a.emit(0xc7, 0x87) // mov dword [rdi+pc], pc
+	a.imm32(jitPCOffset)
+	a.imm32(uint32(pc))
+	a.emit(0xc7, 0x87) // mov dword [rdi+resume], resume
+	a.imm32(jitResumeOffset)
+	a.imm32(uint32(len(a.buf) + 4 + 1))
+	a.emit(0xc3) // ret
+}
+
+// mmapCode copies code into executable memory, which is unmapped when the
+// returned jitCode is garbage collected.
+func mmapCode(code []byte) (*jitCode, error) {
+	buf, err := syscall.Mmap(-1, 0, len(code), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	copy(buf, code)
+	if err := syscall.Mprotect(buf, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		syscall.Munmap(buf)
+		return nil, fmt.Errorf("mprotect: %w", err)
+	}
+
+	jc := &jitCode{buf: buf, addr: uintptr(unsafe.Pointer(&buf[0]))}
+	runtime.SetFinalizer(jc, func(jc *jitCode) {
+		syscall.Munmap(jc.buf)
+	})
+	return jc, nil
+}
+
+//go:noescape
+func jitcall(code uintptr, ctx *jitContext)
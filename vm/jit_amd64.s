@@ -0,0 +1,14 @@
+//go:build linux && amd64
+
+#include "textflag.h"
+
+// func jitcall(code uintptr, ctx *jitContext)
+TEXT ·jitcall(SB), NOSPLIT, $0-16
+	MOVQ ctx+8(FP), DI
+	MOVQ 0(DI), R8   // jitContext.regs
+	MOVQ 8(DI), R9   // jitContext.mem
+	MOVQ 16(DI), R10 // jitContext.memLen
+	MOVQ 24(DI), R11 // jitContext.globals
+	MOVQ code+0(FP), AX
+	CALL AX
+	RET
@@ -0,0 +1,11 @@
+//go:build !(linux && amd64)
+
+package vm
+
+func compileJIT(f *WasmFunction) (*jitCode, error) {
+	return nil, errJITUnsupported
+}
+
+func jitcall(code uintptr, ctx *jitContext) {
+	panic("jit is not supported on this platform")
+}
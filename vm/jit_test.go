@@ -0,0 +1,225 @@
+package vm
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// engineTestModule exports functions covering the instructions the engines
+// support, each with its own path through the native code of EngineJIT.
+func engineTestModule() *testModule {
+	m := sumModule()
+	m.withMemory(1, 1)
+	m.global("g", i32, true, 7)
+	binary := func(name string, op wasm.Opcode) {
+		m.function(name, []wasm.ValueType{i32, i32}, []wasm.ValueType{i32}, nil,
+			imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), op)
+	}
+	binary("add", wasm.OpcodeI32Add)
+	binary("sub", wasm.OpcodeI32Sub)
+	binary("eq", wasm.OpcodeI32Eq)
+	binary("ne", wasm.OpcodeI32Ne)
+	binary("lts", wasm.OpcodeI32Lts)
+	m.function("eqz", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), wasm.OpcodeI32Eqz)
+
+	m.function("load", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), memarg(wasm.OpcodeI32Load, 0))
+	m.function("loadOffset", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), memarg(wasm.OpcodeI32Load, 8))
+	m.function("store", []wasm.ValueType{i32, i32}, nil, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), memarg(wasm.OpcodeI32Store, 0))
+	m.function("storeOffset", []wasm.ValueType{i32, i32}, nil, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), memarg(wasm.OpcodeI32Store, 8))
+	m.function("storeLoad", []wasm.ValueType{i32, i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), memarg(wasm.OpcodeI32Store, 0),
+		imm(wasm.OpcodeLocalGet, 0), memarg(wasm.OpcodeI32Load, 0))
+
+	// inc adds x to g and returns it.
+	m.function("inc", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeGlobalGet, 0), imm(wasm.OpcodeLocalGet, 0), wasm.OpcodeI32Add,
+		imm(wasm.OpcodeGlobalSet, 0), imm(wasm.OpcodeGlobalGet, 0))
+	// double adds 2 to a local n times in a loop.
+	m.function("double", []wasm.ValueType{i32}, []wasm.ValueType{i32}, []wasm.ValueType{i32},
+		imm(wasm.OpcodeBlock, 0x40), imm(wasm.OpcodeLoop, 0x40),
+		imm(wasm.OpcodeLocalGet, 0), wasm.OpcodeI32Eqz, imm(wasm.OpcodeBrIf, 1),
+		imm(wasm.OpcodeLocalGet, 0), i32c(1), wasm.OpcodeI32Sub, imm(wasm.OpcodeLocalSet, 0),
+		imm(wasm.OpcodeLocalGet, 1), i32c(2), wasm.OpcodeI32Add, imm(wasm.OpcodeLocalSet, 1),
+		imm(wasm.OpcodeBr, 0),
+		wasm.OpcodeEnd, wasm.OpcodeEnd,
+		imm(wasm.OpcodeLocalGet, 1))
+	// branch returns 2 if x is not zero, branching out of two blocks and
+	// dropping the 1 below, and 1+3 otherwise.
+	m.function("branch", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeBlock, uint32(i32)), i32c(1),
+		imm(wasm.OpcodeBlock, uint32(i32)), i32c(2), imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeBrIf, 1),
+		wasm.OpcodeDrop, i32c(3),
+		wasm.OpcodeEnd, wasm.OpcodeI32Add,
+		wasm.OpcodeEnd)
+	m.function("ifElse", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeIf, uint32(i32)), i32c(10), wasm.OpcodeElse, i32c(20), wasm.OpcodeEnd)
+	// calls returns a+b-c, calling add and sub.
+	m.function("calls", []wasm.ValueType{i32, i32, i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), imm(wasm.OpcodeCall, 1),
+		imm(wasm.OpcodeLocalGet, 2), imm(wasm.OpcodeCall, 2))
+	m.function("unreachable", nil, nil, nil, wasm.OpcodeUnreachable)
+	m.function("spin", nil, nil, nil, imm(wasm.OpcodeLoop, 0x40), imm(wasm.OpcodeBr, 0), wasm.OpcodeEnd)
+	return m
+}
+
+func TestEngines(t *testing.T) {
+	const memSize = uint64(wasm.MemoryPageSize)
+	tests := []struct {
+		name string
+		fn   string
+		args []uint64
+		want uint64
+		// wantErr is the error of the call instead of want.
+		wantErr string
+		// fuel enables fuel metering with that much fuel.
+		fuel uint64
+		// timeout is the deadline of the call.
+		timeout time.Duration
+	}{
+		{name: "add", fn: "add", args: []uint64{40, 2}, want: 42},
+		{name: "add wraps", fn: "add", args: []uint64{0xffffffff, 2}, want: 1},
+		{name: "sub wraps", fn: "sub", args: []uint64{0, 1}, want: 0xffffffff},
+		{name: "sub min", fn: "sub", args: []uint64{0x80000000, 1}, want: 0x7fffffff},
+		{name: "eq", fn: "eq", args: []uint64{3, 3}, want: 1},
+		{name: "eq upper bits", fn: "eq", args: []uint64{0xffffffff_ffffffff, 0xffffffff}, want: 1},
+		{name: "ne", fn: "ne", args: []uint64{3, 3}, want: 0},
+		{name: "lts negative", fn: "lts", args: []uint64{0xffffffff, 1}, want: 1},
+		{name: "lts positive", fn: "lts", args: []uint64{1, 0xffffffff}, want: 0},
+		{name: "eqz", fn: "eqz", args: []uint64{0}, want: 1},
+		{name: "eqz non-zero", fn: "eqz", args: []uint64{0x80000000}, want: 0},
+
+		{name: "store load", fn: "storeLoad", args: []uint64{100, 0xdeadbeef}, want: 0xdeadbeef},
+		{name: "store load last", fn: "storeLoad", args: []uint64{memSize - 4, 0xcafe}, want: 0xcafe},
+		{name: "load", fn: "load", args: []uint64{memSize - 4}},
+		{name: "load out of bounds", fn: "load", args: []uint64{memSize - 3}, wantErr: "wasm error: out of bounds memory access"},
+		{name: "load max address", fn: "load", args: []uint64{0xffffffff}, wantErr: "wasm error: out of bounds memory access"},
+		{name: "load offset", fn: "loadOffset", args: []uint64{memSize - 12}},
+		{name: "load offset out of bounds", fn: "loadOffset", args: []uint64{memSize - 8}, wantErr: "wasm error: out of bounds memory access"},
+		{name: "load offset overflow", fn: "loadOffset", args: []uint64{0xfffffff8}, wantErr: "wasm error: out of bounds memory access"},
+		{name: "store out of bounds", fn: "store", args: []uint64{memSize - 2, 1}, wantErr: "wasm error: out of bounds memory access"},
+		{name: "store max address", fn: "store", args: []uint64{0xffffffff, 1}, wantErr: "wasm error: out of bounds memory access"},
+		{name: "store offset out of bounds", fn: "storeOffset", args: []uint64{memSize - 8, 1}, wantErr: "wasm error: out of bounds memory access"},
+		{name: "store offset overflow", fn: "storeOffset", args: []uint64{0xfffffffc, 1}, wantErr: "wasm error: out of bounds memory access"},
+
+		{name: "global", fn: "inc", args: []uint64{5}, want: 12},
+		{name: "global wraps", fn: "inc", args: []uint64{0xfffffff9}, want: 0},
+		{name: "loop", fn: "double", args: []uint64{21}, want: 42},
+		{name: "br_if taken", fn: "branch", args: []uint64{1}, want: 2},
+		{name: "br_if not taken", fn: "branch", args: []uint64{0}, want: 4},
+		{name: "if", fn: "ifElse", args: []uint64{1}, want: 10},
+		{name: "else", fn: "ifElse", args: []uint64{0}, want: 20},
+		{name: "calls", fn: "calls", args: []uint64{40, 5, 3}, want: 42},
+		{name: "recursion", fn: "sum", args: []uint64{1000}, want: 500500},
+
+		{name: "unreachable", fn: "unreachable", wantErr: "wasm error: unreachable"},
+		{name: "call depth", fn: "sum", args: []uint64{DefaultMaxCallDepth + 1}, wantErr: "wasm error: call stack exhausted"},
+		{name: "deadline", fn: "spin", timeout: 10 * time.Millisecond, wantErr: "wasm error: context deadline exceeded"},
+		{name: "fuel", fn: "double", args: []uint64{3}, fuel: 1000, want: 6},
+		{name: "out of fuel", fn: "double", args: []uint64{1000}, fuel: 1000, wantErr: "wasm error: out of fuel"},
+		{name: "out of fuel recursion", fn: "sum", args: []uint64{1000}, fuel: 1000, wantErr: "wasm error: out of fuel"},
+	}
+
+	m := engineTestModule()
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			config := NewConfig().WithEngine(e.engine)
+			compiled, err := CompileBinary(m.binary(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.engine == EngineJIT && runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+				for i, f := range compiled.functions {
+					if f.jitCode == nil {
+						t.Fatalf("func[%d] isn't compiled into native code", i)
+					}
+				}
+			}
+
+			for _, tc := range tests {
+				vm, err := InstantiateCompiledModule(compiled, config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.fuel != 0 {
+					vm.EnableFuel(nil)
+					vm.AddFuel(tc.fuel)
+				}
+				ctx := context.Background()
+				if tc.timeout != 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+					defer cancel()
+				}
+
+				got, err := vm.InvokeFunctionContext(ctx, tc.fn, tc.args...)
+				if tc.wantErr != "" {
+					if err == nil || err.Error() != tc.wantErr {
+						t.Errorf("%s: %s%v error = %v, want %s", tc.name, tc.fn, tc.args, err, tc.wantErr)
+					}
+					continue
+				}
+				if err != nil || got != tc.want {
+					t.Errorf("%s: %s%v = %#x, %v, want %#x", tc.name, tc.fn, tc.args, got, err, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// TestCompileJITInvalidCode checks that register code moving values out of
+// the register file is rejected before being compiled into native code.
+func TestCompileJITInvalidCode(t *testing.T) {
+	compiled, err := CompileBinary(engineTestModule().binary(), NewConfig().WithEngine(EngineJIT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := false
+	for _, f := range compiled.functions {
+		for pc := range f.regCode.code {
+			if in := &f.regCode.code[pc]; !corrupted && (in.op == wasm.OpcodeBr || in.op == wasm.OpcodeBrIf) {
+				in.dst = -4
+				corrupted = true
+			}
+		}
+	}
+	if !corrupted {
+		t.Fatal("no br in the register code")
+	}
+	if err := compiled.compileJIT(); err == nil || !strings.Contains(err.Error(), "invalid registers: -4") {
+		t.Errorf("compileJIT() error = %v, want invalid registers", err)
+	}
+}
+
+func TestEnginesMarkDirty(t *testing.T) {
+	m := engineTestModule()
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			vm := m.instantiate(t, NewConfig().WithEngine(e.engine))
+			// The store spans the pages 1 and 2.
+			if _, err := vm.InvokeFunction("store", 2*dirtyPageSize-2, 0x01020304); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := vm.InvokeFunction("storeOffset", 5*dirtyPageSize, 1); err != nil {
+				t.Fatal(err)
+			}
+			for i, d := range vm.Store.Memory.dirty {
+				if want := i == 1 || i == 2 || i == 5; (d != 0) != want {
+					t.Errorf("page %d dirty = %v, want %v", i, d != 0, want)
+				}
+			}
+			if got, _ := vm.Store.Memory.ReadUint32Le(2*dirtyPageSize - 2); got != 0x01020304 {
+				t.Errorf("memory = %#x, want 0x01020304", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package vm
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// MemoryInstance is the runtime representation of a linear memory.
+// See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#memory-instances%E2%91%A0
+//
+// Writes by the VM and the Write methods mark the written pages dirty, which
+// lets an InstancePool restore only those. Writes to Buffer or to views
+// returned by Read aren't tracked.
+type MemoryInstance struct {
+	Buffer   []byte
+	Min, Max uint32
+
+	// dirty has a non-zero byte for each page of dirtyPageSize bytes written
+	// since it was last cleared.
+	dirty []byte
+}
+
+// dirtyPageShift is the log2 of dirtyPageSize, the granularity at which
+// writes to memory are tracked.
+const (
+	dirtyPageShift = 12
+	dirtyPageSize  = 1 << dirtyPageShift
+)
+
+// maxMemoryPages is the maximum size of a memory in pages, whose size in
+// bytes must fit in a uint32: 65535 pages, one less than the limit of the
+// spec.
+const maxMemoryPages = math.MaxUint32 / wasm.MemoryPageSize
+
+// NewMemoryInstance returns a memory of mem.Min pages, which must not exceed
+// maxMemoryPages.
+func NewMemoryInstance(mem *wasm.Memory) *MemoryInstance {
+	size := int(mem.Min) * int(wasm.MemoryPageSize)
+	return &MemoryInstance{
+		Buffer: make([]byte, size),
+		Min:    mem.Min,
+		Max:    mem.Max,
+		dirty:  make([]byte, size/dirtyPageSize),
+	}
+}
+
+// Size returns the size in bytes available.
+func (m *MemoryInstance) Size() uint32 {
+	return uint32(len(m.Buffer))
+}
+
+// Pages returns the size in pages (64KB) available.
+func (m *MemoryInstance) Pages() uint32 {
+	return uint32(len(m.Buffer) / int(wasm.MemoryPageSize))
+}
+
+// Grow increases the size by deltaPages and returns the previous size in pages.
+// ok is false when the result would exceed Max or maxMemoryPages.
+// See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#grow-mem
+func (m *MemoryInstance) Grow(deltaPages uint32) (previousPages uint32, ok bool) {
+	previousPages = m.Pages()
+	pages := uint64(previousPages) + uint64(deltaPages)
+	if pages > uint64(m.Max) || pages > uint64(maxMemoryPages) {
+		return 0, false
+	}
+	if deltaPages == 0 {
+		return previousPages, true
+	}
+	buf := make([]byte, int(pages)*int(wasm.MemoryPageSize))
+	copy(buf, m.Buffer)
+	m.Buffer = buf
+	dirty := make([]byte, len(buf)/dirtyPageSize)
+	copy(dirty, m.dirty)
+	m.dirty = dirty
+	return previousPages, true
+}
+
+// Read returns a view of byteCount bytes at the given offset, or false if out of range.
+// The returned slice is invalidated by Grow.
+func (m *MemoryInstance) Read(offset, byteCount uint32) ([]byte, bool) {
+	if !m.hasSize(offset, uint64(byteCount)) {
+		return nil, false
+	}
+	return m.Buffer[offset : offset+byteCount : offset+byteCount], true
+}
+
+// Write copies v into memory at the given offset, or returns false if out of range.
+func (m *MemoryInstance) Write(offset uint32, v []byte) bool {
+	if !m.hasSize(offset, uint64(len(v))) {
+		return false
+	}
+	copy(m.Buffer[offset:], v)
+	m.markDirty(uint64(offset), uint64(len(v)))
+	return true
+}
+
+// ReadUint32Le reads a uint32 in little-endian encoding from the given offset.
+func (m *MemoryInstance) ReadUint32Le(offset uint32) (uint32, bool) {
+	if !m.hasSize(offset, 4) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(m.Buffer[offset:]), true
+}
+
+// WriteUint32Le writes v in little-endian encoding at the given offset.
+func (m *MemoryInstance) WriteUint32Le(offset, v uint32) bool {
+	if !m.hasSize(offset, 4) {
+		return false
+	}
+	binary.LittleEndian.PutUint32(m.Buffer[offset:], v)
+	m.markDirty(uint64(offset), 4)
+	return true
+}
+
+// ReadUint64Le reads a uint64 in little-endian encoding from the given offset.
+func (m *MemoryInstance) ReadUint64Le(offset uint32) (uint64, bool) {
+	if !m.hasSize(offset, 8) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(m.Buffer[offset:]), true
+}
+
+// WriteUint64Le writes v in little-endian encoding at the given offset.
+func (m *MemoryInstance) WriteUint64Le(offset uint32, v uint64) bool {
+	if !m.hasSize(offset, 8) {
+		return false
+	}
+	binary.LittleEndian.PutUint64(m.Buffer[offset:], v)
+	m.markDirty(uint64(offset), 8)
+	return true
+}
+
+// markDirty marks the pages of byteCount bytes at offset, which must be in range, as written.
+func (m *MemoryInstance) markDirty(offset, byteCount uint64) {
+	if byteCount == 0 {
+		return
+	}
+	for p := offset >> dirtyPageShift; p <= (offset+byteCount-1)>>dirtyPageShift; p++ {
+		m.dirty[p] = 1
+	}
+}
+
+func (m *MemoryInstance) hasSize(offset uint32, byteCount uint64) bool {
+	return uint64(offset)+byteCount <= uint64(len(m.Buffer))
+}
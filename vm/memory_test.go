@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func TestMemoryInstanceGrow(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       uint32
+		delta     uint32
+		wantOK    bool
+		wantPages uint32
+	}{
+		{name: "zero", max: 4, delta: 0, wantOK: true, wantPages: 1},
+		{name: "up to max", max: 4, delta: 3, wantOK: true, wantPages: 4},
+		{name: "over max", max: 4, delta: 4, wantPages: 1},
+		// 65536 pages are 2^32 bytes, which don't fit in the uint32 size.
+		{name: "over the uint32 size", max: wasm.MemoryLimitPages, delta: wasm.MemoryLimitPages - 1, wantPages: 1},
+		{name: "overflow", max: wasm.MemoryLimitPages, delta: 0xffffffff, wantPages: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewMemoryInstance(&wasm.Memory{Min: 1, Max: tc.max})
+			m.Buffer[10] = 42
+			prev, ok := m.Grow(tc.delta)
+			if ok != tc.wantOK || ok && prev != 1 {
+				t.Errorf("Grow(%d) = %d, %v, want 1, %v", tc.delta, prev, ok, tc.wantOK)
+			}
+			if m.Pages() != tc.wantPages || m.Size() != tc.wantPages*wasm.MemoryPageSize || m.Buffer[10] != 42 {
+				t.Errorf("%d pages, %d bytes after Grow(%d), want %d pages", m.Pages(), m.Size(), tc.delta, tc.wantPages)
+			}
+		})
+	}
+}
+
+func TestCompileMemoryTooLarge(t *testing.T) {
+	m := &testModule{}
+	m.withMemory(wasm.MemoryLimitPages, wasm.MemoryLimitPages)
+	want := "memory size out of limit: 65536 pages, up to 65535"
+	if _, err := CompileBinary(m.binary(), NewConfig()); err == nil || err.Error() != want {
+		t.Errorf("CompileBinary() error = %v, want %s", err, want)
+	}
+}
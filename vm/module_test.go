@@ -0,0 +1,200 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// testEngines are the engines the tests run on. They share an error contract,
+// so the same results and traps are expected from all of them.
+var testEngines = []struct {
+	name   string
+	engine Engine
+}{
+	{"stack", EngineStack},
+	{"register", EngineRegister},
+	{"jit", EngineJIT},
+}
+
+var (
+	i32 = wasm.ValueTypeI32
+	i64 = wasm.ValueTypeI64
+)
+
+// testModule builds the binary of a module for the tests. Imports must be
+// added before the functions, whose indexes follow the imported ones.
+type testModule struct {
+	types, imports, funcs, tables, globals, exports, codes, data [][]byte
+	memory                                                       []byte
+	importedFuncs                                                uint32
+}
+
+func (m *testModule) typeIndex(params, results []wasm.ValueType) uint32 {
+	t := append([]byte{0x60}, vec(params)...)
+	t = append(t, vec(results)...)
+	for i, u := range m.types {
+		if string(u) == string(t) {
+			return uint32(i)
+		}
+	}
+	m.types = append(m.types, t)
+	return uint32(len(m.types) - 1)
+}
+
+// importFunction imports a function and returns its index.
+func (m *testModule) importFunction(module, name string, params, results []wasm.ValueType) uint32 {
+	m.importDesc(module, name, wasm.ExternTypeFunc, wasm.EncodeUint32(m.typeIndex(params, results)))
+	m.importedFuncs++
+	return m.importedFuncs - 1
+}
+
+// importDesc imports an extern of type et described by desc.
+func (m *testModule) importDesc(module, name string, et wasm.ExternType, desc []byte) {
+	imp := append(str(module), str(name)...)
+	imp = append(imp, et)
+	m.imports = append(m.imports, append(imp, desc...))
+}
+
+// function adds a function with the locals and body, exported as export
+// unless empty, and returns its index.
+func (m *testModule) function(export string, params, results, locals []wasm.ValueType, body ...any) uint32 {
+	m.funcs = append(m.funcs, wasm.EncodeUint32(m.typeIndex(params, results)))
+	code := wasm.EncodeUint32(uint32(len(locals)))
+	for _, l := range locals {
+		code = append(code, 1, l)
+	}
+	code = append(code, instrs(body...)...)
+	code = append(code, wasm.OpcodeEnd)
+	m.codes = append(m.codes, append(wasm.EncodeUint32(uint32(len(code))), code...))
+
+	index := m.importedFuncs + uint32(len(m.funcs)) - 1
+	m.export(export, wasm.ExternTypeFunc, index)
+	return index
+}
+
+// withMemory adds a memory of min pages, up to max pages, exported as "memory".
+func (m *testModule) withMemory(min, max uint32) *testModule {
+	m.memory = append([]byte{1}, wasm.EncodeUint32(min)...)
+	m.memory = append(m.memory, wasm.EncodeUint32(max)...)
+	m.export("memory", wasm.ExternTypeMemory, 0)
+	return m
+}
+
+// global adds a global initialized with v and returns its index.
+func (m *testModule) global(export string, vt wasm.ValueType, mutable bool, v uint64) uint32 {
+	g := []byte{vt, byte(b2u(mutable))}
+	if vt == wasm.ValueTypeI64 {
+		g = append(append(g, wasm.OpcodeI64Const), wasm.EncodeInt64(int64(v))...)
+	} else {
+		g = append(append(g, wasm.OpcodeI32Const), wasm.EncodeInt32(int32(v))...)
+	}
+	m.globals = append(m.globals, append(g, wasm.OpcodeEnd))
+	index := uint32(len(m.globals) - 1)
+	m.export(export, wasm.ExternTypeGlobal, index)
+	return index
+}
+
+// table adds a funcref table of min elements.
+func (m *testModule) table(export string, min uint32) {
+	m.tables = append(m.tables, append([]byte{0x70, 0}, wasm.EncodeUint32(min)...))
+	m.export(export, wasm.ExternTypeTable, uint32(len(m.tables)-1))
+}
+
+// dataSegment adds an active data segment at offset.
+func (m *testModule) dataSegment(offset int32, init []byte) {
+	ds := append([]byte{0, wasm.OpcodeI32Const}, wasm.EncodeInt32(offset)...)
+	ds = append(ds, wasm.OpcodeEnd)
+	ds = append(ds, wasm.EncodeUint32(uint32(len(init)))...)
+	m.data = append(m.data, append(ds, init...))
+}
+
+func (m *testModule) export(name string, et wasm.ExternType, index uint32) {
+	if name == "" {
+		return
+	}
+	exp := append(str(name), et)
+	m.exports = append(m.exports, append(exp, wasm.EncodeUint32(index)...))
+}
+
+// binary returns the binary of the module.
+func (m *testModule) binary() []byte {
+	bin := []byte("\x00asm\x01\x00\x00\x00")
+	section := func(id wasm.SectionID, items [][]byte) {
+		if len(items) == 0 {
+			return
+		}
+		payload := wasm.EncodeUint32(uint32(len(items)))
+		for _, item := range items {
+			payload = append(payload, item...)
+		}
+		bin = append(bin, id)
+		bin = append(bin, wasm.EncodeUint32(uint32(len(payload)))...)
+		bin = append(bin, payload...)
+	}
+	section(wasm.SectionIDType, m.types)
+	section(wasm.SectionIDImport, m.imports)
+	section(wasm.SectionIDFunction, m.funcs)
+	section(wasm.SectionIDTable, m.tables)
+	if m.memory != nil {
+		section(wasm.SectionIDMemory, [][]byte{m.memory})
+	}
+	section(wasm.SectionIDGlobal, m.globals)
+	section(wasm.SectionIDExport, m.exports)
+	section(wasm.SectionIDCode, m.codes)
+	section(wasm.SectionIDData, m.data)
+	return bin
+}
+
+// instantiate compiles the module with config and instantiates it.
+func (m *testModule) instantiate(t testing.TB, config *Config) *VM {
+	t.Helper()
+	compiled, err := CompileBinary(m.binary(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := InstantiateCompiledModule(compiled, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+// instrs concatenates opcodes and instructions built by imm, i32c and memarg.
+func instrs(parts ...any) []byte {
+	var b []byte
+	for _, p := range parts {
+		switch p := p.(type) {
+		case byte:
+			b = append(b, p)
+		case []byte:
+			b = append(b, p...)
+		default:
+			panic("invalid instruction")
+		}
+	}
+	return b
+}
+
+// imm returns op with a uint32 immediate: an index, a label or a block type.
+func imm(op wasm.Opcode, v uint32) []byte {
+	return append([]byte{op}, wasm.EncodeUint32(v)...)
+}
+
+// i32c returns i32.const v.
+func i32c(v int32) []byte {
+	return append([]byte{wasm.OpcodeI32Const}, wasm.EncodeInt32(v)...)
+}
+
+// memarg returns the memory instruction op with an alignment of 4 bytes and offset.
+func memarg(op wasm.Opcode, offset uint32) []byte {
+	return append([]byte{op, 2}, wasm.EncodeUint32(offset)...)
+}
+
+func vec(types []wasm.ValueType) []byte {
+	return append(wasm.EncodeUint32(uint32(len(types))), types...)
+}
+
+func str(s string) []byte {
+	return append(wasm.EncodeUint32(uint32(len(s))), s...)
+}
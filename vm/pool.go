@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"io"
+	"sync"
+)
+
+// InstancePool keeps instances of a compiled module for reuse, so that each
+// request can run in a fresh instance without instantiating the module
+// again. Instances put back are reset to their state right after
+// instantiation: only the memory pages written since they were taken are
+// restored, and the tables are cleared. An InstancePool is safe for concurrent use by multiple
+// goroutines.
+type InstancePool struct {
+	compiled *CompiledModule
+	config   *Config
+
+	// memory is the content of the memory right after instantiation.
+	memory []byte
+
+	mu   sync.Mutex
+	free []*VM
+}
+
+// NewInstancePool returns a pool of instances of compiled, instantiated with config.
+func NewInstancePool(compiled *CompiledModule, config *Config) *InstancePool {
+	p := &InstancePool{
+		compiled: compiled,
+		config:   config,
+	}
+	if mem := compiled.module.MemorySection; mem != nil {
+		p.memory = NewMemoryInstance(mem).Buffer
+		for _, ds := range compiled.data {
+			copy(p.memory[ds.offset:], ds.init)
+		}
+	}
+	return p
+}
+
+// Get returns an instance from the pool, instantiating one if it is empty.
+func (p *InstancePool) Get() (*VM, error) {
+	p.mu.Lock()
+	if n := len(p.free); n > 0 {
+		vm := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		p.mu.Unlock()
+		return vm, nil
+	}
+	p.mu.Unlock()
+	return InstantiateCompiledModule(p.compiled, p.config)
+}
+
+// GetWithStdio returns an instance from the pool as Get does, with the file
+// descriptors 0, 1 and 2 of the guest connected to stdin, stdout and stderr
+// instead of the streams of the WASIConfig until it is put back.
+func (p *InstancePool) GetWithStdio(stdin io.Reader, stdout, stderr io.Writer) (*VM, error) {
+	vm, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	vm.wasi.setStdio(stdin, stdout, stderr)
+	return vm, nil
+}
+
+// Put resets vm, which must have been returned by Get and no longer be in
+// use, and returns it to the pool.
+func (p *InstancePool) Put(vm *VM) {
+	p.reset(vm)
+	p.mu.Lock()
+	p.free = append(p.free, vm)
+	p.mu.Unlock()
+}
+
+// reset restores the memory, globals, tables, fuel and WASI file descriptors
+// of vm to their state right after instantiation.
+func (p *InstancePool) reset(vm *VM) {
+	if mem := vm.Store.Memory; mem != nil {
+		if len(mem.Buffer) != len(p.memory) {
+			// The memory has grown, so it is replaced as a whole.
+			mem.Buffer = append([]byte(nil), p.memory...)
+			mem.dirty = make([]byte, len(p.memory)/dirtyPageSize)
+		} else {
+			for i, d := range mem.dirty {
+				if d != 0 {
+					start := i * dirtyPageSize
+					copy(mem.Buffer[start:start+dirtyPageSize], p.memory[start:])
+					mem.dirty[i] = 0
+				}
+			}
+		}
+	}
+
+	for i, g := range vm.Store.Globals {
+		g.Val = p.compiled.globals[i]
+	}
+
+	// Tables start with null references, as there are no element segments.
+	for i, t := range vm.Store.Tables {
+		if min := p.compiled.module.TableSection[i].Min; uint32(len(t.References)) != min {
+			t.References = make([]Reference, min)
+		} else {
+			clear(t.References)
+		}
+	}
+
+	vm.fuelEnabled = false
+	vm.fuel, vm.fuelConsumed = 0, 0
+	vm.wasi.reset()
+}
@@ -0,0 +1,124 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func TestInstancePoolReset(t *testing.T) {
+	m := &testModule{}
+	m.withMemory(1, 2)
+	m.global("g", i32, true, 7)
+	m.table("t", 2)
+	m.dataSegment(0, []byte("data"))
+	m.function("store", []wasm.ValueType{i32, i32}, nil, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), memarg(wasm.OpcodeI32Store, 0))
+
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			config := NewConfig().WithEngine(e.engine)
+			compiled, err := CompileBinary(m.binary(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool := NewInstancePool(compiled, config)
+			vm, err := pool.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mem, _ := vm.ExportedMemory("memory")
+			g, _ := vm.ExportedGlobal("g")
+			table, _ := vm.ExportedTable("t")
+
+			for _, grow := range []bool{false, true} {
+				if _, err := vm.InvokeFunction("store", 0, 0x12345678); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := vm.InvokeFunction("store", 40000, 1); err != nil {
+					t.Fatal(err)
+				}
+				if grow {
+					mem.Grow(1)
+				}
+				g.Val = 42
+				table.Set(0, vm.Store.Functions[0])
+				if _, ok := table.Grow(3, vm.Store.Functions[0]); !ok {
+					t.Fatal("table.Grow failed")
+				}
+
+				pool.Put(vm)
+				if got, err := pool.Get(); err != nil || got != vm {
+					t.Fatalf("Get() = %p, %v, want the instance put back", got, err)
+				}
+				if len(mem.Buffer) != int(wasm.MemoryPageSize) || string(mem.Buffer[:4]) != "data" ||
+					binary.LittleEndian.Uint32(mem.Buffer[40000:]) != 0 {
+					t.Errorf("memory not restored, grown %v", grow)
+				}
+				if g.Val != 7 {
+					t.Errorf("global = %d, want 7", g.Val)
+				}
+				if table.Size() != 2 || table.References[0] != nil {
+					t.Errorf("table = %v, want 2 null references", table.References)
+				}
+			}
+		})
+	}
+}
+
+// helloModule exports hello, which writes "hello\n" to the standard output.
+func helloModule() *testModule {
+	m := &testModule{}
+	fdWrite := m.importFunction("wasi_snapshot_preview1", "fd_write",
+		[]wasm.ValueType{i32, i32, i32, i32}, []wasm.ValueType{i32})
+	m.withMemory(1, 1)
+	// The iovec at 0 points to the string at 16.
+	m.dataSegment(0, []byte{16, 0, 0, 0, 6, 0, 0, 0})
+	m.dataSegment(16, []byte("hello\n"))
+	m.function("hello", nil, nil, nil,
+		i32c(1), i32c(0), i32c(1), i32c(8), imm(wasm.OpcodeCall, fdWrite), wasm.OpcodeDrop)
+	return m
+}
+
+func TestInstancePoolGetWithStdio(t *testing.T) {
+	var stdout bytes.Buffer
+	config := NewConfig().WithWASI(NewWASIConfig().WithStdout(&stdout))
+	compiled, err := CompileBinary(helloModule().binary(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewInstancePool(compiled, config)
+
+	var outs [2]bytes.Buffer
+	var vms [2]*VM
+	for i := range vms {
+		if vms[i], err = pool.GetWithStdio(nil, &outs[i], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, vm := range vms {
+		for range i + 1 {
+			if _, err := vm.InvokeFunction("hello"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pool.Put(vm)
+	}
+	if outs[0].String() != "hello\n" || outs[1].String() != "hello\nhello\n" {
+		t.Errorf("outputs = %q, %q, want one hello each call", outs[0].String(), outs[1].String())
+	}
+
+	// Instances put back write to the stdout of the config again.
+	vm, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.InvokeFunction("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "hello\n" {
+		t.Errorf("stdout = %q, want hello", stdout.String())
+	}
+}
@@ -0,0 +1,479 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// regInstruction is an instruction of the register machine. dst, a and b are
+// indexes into the register file of the frame, which holds the locals, then
+// a register for each stack slot, then the constants of the function.
+//
+//   - mov: regs[dst] = regs[a]
+//   - binary operators: regs[dst] = regs[a] op regs[b]
+//   - if: jumps to u1 if regs[a] is zero
+//   - else: jumps to u1
+//   - br: moves n registers from a to dst and jumps to u1
+//   - br_if: does the same as br if regs[b] is not zero
+//   - return: returns regs[a], or nothing if a is negative
+//   - call: calls function u1 with n arguments from a, the result goes to dst
+//   - loads and stores: the address is regs[a]+u1, the value regs[dst] or regs[b]
+type regInstruction struct {
+	op           wasm.Opcode
+	dst, a, b, n int32
+	u1           uint64
+	// from and to are the range of WasmFunction.Code this instruction
+	// stands for, which is charged for fuel as in the stack engine.
+	from, to int32
+}
+
+// regOpMove is the opcode of mov, borrowed from local.set.
+const regOpMove = wasm.OpcodeLocalSet
+
+type registerCode struct {
+	code      []regInstruction
+	numParams int
+	numLocals int
+	numRegs   int
+	// consts are copied to the registers from constBase on every call.
+	consts    []uint64
+	constBase int
+}
+
+// regTranslator translates the compiled instructions of a function into
+// registerCode. It keeps the register holding the value of each stack slot:
+// local.get and i32.const push the register of the local or the constant
+// without moving anything, and the values are only moved to the register of
+// their slot ("materialized") where control flow joins.
+type regTranslator struct {
+	f         *WasmFunction
+	funcTypes []*wasm.FunctionType
+	rc        *registerCode
+	operands  []int32
+	constRegs map[uint64]int32
+	// lastLabel is the pc of the last jump target, before which instructions must not be rewritten.
+	lastLabel int
+	// fuelFrom is the first instruction of f.Code not yet covered by a regInstruction,
+	// and fuelTo the one after the instruction being translated.
+	fuelFrom, fuelTo int32
+}
+
+func translateRegister(f *WasmFunction, funcTypes []*wasm.FunctionType) (*registerCode, error) {
+	numLocals := len(f.FunctionType.Params) + len(f.LocalTypes)
+	t := &regTranslator{
+		f:         f,
+		funcTypes: funcTypes,
+		rc: &registerCode{
+			numParams: len(f.FunctionType.Params),
+			numLocals: numLocals,
+			constBase: numLocals + f.maxHeight,
+		},
+		constRegs: map[uint64]int32{},
+	}
+
+	code := f.Code
+	targets := make([]bool, len(code)+1)
+	for _, in := range code {
+		switch in.op {
+		case wasm.OpcodeIf, wasm.OpcodeElse, wasm.OpcodeBr, wasm.OpcodeBrIf:
+			targets[in.u1] = true
+		}
+	}
+
+	labels := make([]int32, len(code)+1)
+	var jumps []int
+	live := true
+	for i, in := range code {
+		if targets[i] || !live {
+			t.fuelTo = int32(i)
+			if live {
+				// Fall through into a jump target: the values must be where jumps put them.
+				t.materialize()
+				if t.fuelFrom < t.fuelTo {
+					t.emit(regInstruction{op: wasm.OpcodeNop})
+				}
+			} else {
+				t.operands = t.operands[:0]
+				for k := 0; k < f.heights[i]; k++ {
+					t.operands = append(t.operands, t.slot(k))
+				}
+				t.fuelFrom = int32(i)
+			}
+			t.lastLabel = len(t.rc.code)
+		}
+		labels[i] = int32(len(t.rc.code))
+
+		t.fuelTo = int32(i) + 1
+		var err error
+		if live, err = t.translate(in); err != nil {
+			return nil, fmt.Errorf("pc %d: %#x: %w", i, in.op, err)
+		}
+		switch in.op {
+		case wasm.OpcodeIf, wasm.OpcodeElse, wasm.OpcodeBr, wasm.OpcodeBrIf:
+			jumps = append(jumps, len(t.rc.code)-1)
+		}
+	}
+
+	for _, pc := range jumps {
+		in := &t.rc.code[pc]
+		in.u1 = uint64(labels[in.u1])
+	}
+	t.rc.numRegs = t.rc.constBase + len(t.rc.consts)
+	return t.rc, nil
+}
+
+// translate appends the instructions for in and returns false if it never falls through.
+func (t *regTranslator) translate(in instruction) (bool, error) {
+	if n := t.numPopped(in); n > len(t.operands) {
+		return false, errors.New("stack underflow")
+	}
+	switch in.op {
+	case wasm.OpcodeUnreachable:
+		t.emit(regInstruction{op: in.op})
+		return false, nil
+	case wasm.OpcodeIf:
+		cond := t.pop()
+		t.materialize()
+		t.emit(regInstruction{op: in.op, a: cond, u1: in.u1})
+	case wasm.OpcodeElse:
+		t.materialize()
+		t.emit(regInstruction{op: in.op, u1: in.u1})
+		return false, nil
+	case wasm.OpcodeBr, wasm.OpcodeBrIf:
+		var cond int32
+		if in.op == wasm.OpcodeBrIf {
+			cond = t.pop()
+		}
+		t.materialize()
+		keep, drop := splitUnwind(in.u2)
+		h := len(t.operands)
+		if keep+drop > h {
+			return false, fmt.Errorf("invalid unwind: %d, %d", keep, drop)
+		}
+		t.emit(regInstruction{
+			op:  in.op,
+			dst: t.slot(h - keep - drop),
+			a:   t.slot(h - keep),
+			b:   cond,
+			n:   int32(keep),
+			u1:  in.u1,
+		})
+		return in.op == wasm.OpcodeBrIf, nil
+	case wasm.OpcodeReturn:
+		a := int32(-1)
+		if keep, _ := splitUnwind(in.u2); keep > 0 {
+			a = t.operands[len(t.operands)-1]
+		}
+		t.emit(regInstruction{op: in.op, a: a})
+		return false, nil
+	case wasm.OpcodeCall:
+		ft := t.funcTypes[in.u1]
+		n := len(ft.Params)
+		h := len(t.operands) - n
+		for k := h; k < len(t.operands); k++ {
+			t.materializeSlot(k)
+		}
+		t.operands = t.operands[:h]
+		dst := int32(-1)
+		if len(ft.Results) > 0 {
+			dst = t.slot(h)
+			t.push(dst)
+		}
+		t.emit(regInstruction{op: in.op, dst: dst, a: t.slot(h), n: int32(n), u1: in.u1})
+	case wasm.OpcodeDrop:
+		t.pop()
+	case wasm.OpcodeLocalGet:
+		t.push(int32(in.u1))
+	case wasm.OpcodeLocalSet:
+		t.setLocal(int32(in.u1), t.pop())
+	case wasm.OpcodeLocalTee:
+		t.setLocal(int32(in.u1), t.pop())
+		t.push(int32(in.u1))
+	case wasm.OpcodeGlobalGet:
+		dst := t.slot(len(t.operands))
+		t.emit(regInstruction{op: in.op, dst: dst, u1: in.u1})
+		t.push(dst)
+	case wasm.OpcodeGlobalSet:
+		t.emit(regInstruction{op: in.op, a: t.pop(), u1: in.u1})
+	case wasm.OpcodeI32Load:
+		a := t.pop()
+		dst := t.slot(len(t.operands))
+		t.emit(regInstruction{op: in.op, dst: dst, a: a, u1: in.u1})
+		t.push(dst)
+	case wasm.OpcodeI32Store:
+		b := t.pop()
+		a := t.pop()
+		t.emit(regInstruction{op: in.op, a: a, b: b, u1: in.u1})
+	case wasm.OpcodeI32Const:
+		t.push(t.constReg(in.u1))
+	case wasm.OpcodeI32Eqz:
+		a := t.pop()
+		dst := t.slot(len(t.operands))
+		t.emit(regInstruction{op: in.op, dst: dst, a: a})
+		t.push(dst)
+	default: // binary operators
+		b := t.pop()
+		a := t.pop()
+		dst := t.slot(len(t.operands))
+		t.emit(regInstruction{op: in.op, dst: dst, a: a, b: b})
+		t.push(dst)
+	}
+	return true, nil
+}
+
+// numPopped returns the number of values in takes from the stack.
+func (t *regTranslator) numPopped(in instruction) int {
+	switch in.op {
+	case wasm.OpcodeUnreachable, wasm.OpcodeElse, wasm.OpcodeBr,
+		wasm.OpcodeLocalGet, wasm.OpcodeGlobalGet, wasm.OpcodeI32Const:
+		return 0
+	case wasm.OpcodeIf, wasm.OpcodeBrIf, wasm.OpcodeDrop, wasm.OpcodeLocalSet, wasm.OpcodeLocalTee,
+		wasm.OpcodeGlobalSet, wasm.OpcodeI32Load, wasm.OpcodeI32Eqz:
+		return 1
+	case wasm.OpcodeReturn:
+		keep, _ := splitUnwind(in.u2)
+		return min(keep, 1)
+	case wasm.OpcodeCall:
+		return len(t.funcTypes[in.u1].Params)
+	default: // i32.store and binary operators
+		return 2
+	}
+}
+
+func (t *regTranslator) emit(in regInstruction) {
+	in.from, in.to = t.fuelFrom, t.fuelTo
+	t.fuelFrom = t.fuelTo
+	t.rc.code = append(t.rc.code, in)
+}
+
+// slot returns the register of the k-th stack slot.
+func (t *regTranslator) slot(k int) int32 {
+	return int32(t.rc.numLocals + k)
+}
+
+func (t *regTranslator) push(reg int32) {
+	t.operands = append(t.operands, reg)
+}
+
+func (t *regTranslator) pop() int32 {
+	ret := t.operands[len(t.operands)-1]
+	t.operands = t.operands[:len(t.operands)-1]
+	return ret
+}
+
+func (t *regTranslator) constReg(v uint64) int32 {
+	if reg, ok := t.constRegs[v]; ok {
+		return reg
+	}
+	reg := int32(t.rc.constBase + len(t.rc.consts))
+	t.rc.consts = append(t.rc.consts, v)
+	t.constRegs[v] = reg
+	return reg
+}
+
+// materialize moves all values to the registers of their slots.
+func (t *regTranslator) materialize() {
+	for k := range t.operands {
+		t.materializeSlot(k)
+	}
+}
+
+func (t *regTranslator) materializeSlot(k int) {
+	if reg := t.slot(k); t.operands[k] != reg {
+		t.emit(regInstruction{op: regOpMove, dst: reg, a: t.operands[k]})
+		t.operands[k] = reg
+	}
+}
+
+// setLocal writes the value in reg to the local.
+func (t *regTranslator) setLocal(local, reg int32) {
+	// Values still read from the local must be saved before it is overwritten.
+	for k, op := range t.operands {
+		if op == local {
+			t.materializeSlot(k)
+		}
+	}
+
+	// Have the instruction producing the value write to the local directly,
+	// unless a jump may land in between.
+	code := t.rc.code
+	if last := len(code) - 1; last >= t.lastLabel && code[last].dst == reg && t.isSlot(reg) {
+		switch code[last].op {
+		case wasm.OpcodeUnreachable, wasm.OpcodeNop, wasm.OpcodeIf, wasm.OpcodeElse,
+			wasm.OpcodeBr, wasm.OpcodeBrIf, wasm.OpcodeReturn,
+			wasm.OpcodeGlobalSet, wasm.OpcodeI32Store:
+		default:
+			code[last].dst = local
+			return
+		}
+	}
+	t.emit(regInstruction{op: regOpMove, dst: local, a: reg})
+}
+
+func (t *regTranslator) isSlot(reg int32) bool {
+	return int(reg) >= t.rc.numLocals && int(reg) < t.rc.constBase
+}
+
+// callRegister calls f taking the params from and pushing the result to the value stack.
+func (vm *VM) callRegister(f *WasmFunction) {
+	rc := f.regCode
+	base := vm.allocRegisters(rc)
+	regs := vm.regs[base : base+rc.numRegs]
+	for i := rc.numParams - 1; i >= 0; i-- {
+		regs[i] = vm.stack.Pop()
+	}
+
+	ret := vm.executeCompiled(f, base)
+	vm.regTop = base
+	if f.HasResult() {
+		vm.stack.Push(ret)
+	}
+}
+
+// allocRegisters reserves the register file of a new frame of rc and returns its base.
+// The locals except params are zeroed and the constants are loaded.
+func (vm *VM) allocRegisters(rc *registerCode) int {
+	base := vm.reserveRegisters(rc.numRegs)
+	regs := vm.regs[base:vm.regTop]
+	clear(regs[rc.numParams:rc.numLocals])
+	copy(regs[rc.constBase:], rc.consts)
+	return base
+}
+
+// reserveRegisters reserves n registers after regTop and returns their base.
+func (vm *VM) reserveRegisters(n int) int {
+	base := vm.regTop
+	need := base + n
+	if need > len(vm.regs) {
+		if need > vm.stack.max {
+			panic(ErrCallStackExhausted)
+		}
+		regs := make([]uint64, min(max(2*len(vm.regs), need), vm.stack.max))
+		copy(regs, vm.regs[:base])
+		vm.regs = regs
+	}
+	vm.regTop = need
+	return base
+}
+
+func (vm *VM) executeRegister(f *WasmFunction, base int) uint64 {
+	rc := f.regCode
+	code := rc.code
+	regs := vm.regs[base : base+rc.numRegs]
+	for pc := 0; pc < len(code); {
+		vm.ticks++
+		if vm.ticks&ctxCheckInterval == 0 {
+			vm.checkContext()
+		}
+
+		in := &code[pc]
+		pc++
+		if vm.fuelEnabled {
+			for i := in.from; i < in.to; i++ {
+				vm.consumeFuel(f.Code[i].op)
+			}
+		}
+
+		switch in.op {
+		case wasm.OpcodeNop:
+		case regOpMove:
+			regs[in.dst] = regs[in.a]
+		case wasm.OpcodeUnreachable:
+			panic("unreachable")
+		case wasm.OpcodeIf:
+			if uint32(regs[in.a]) == 0 {
+				pc = int(in.u1)
+			}
+		case wasm.OpcodeElse:
+			pc = int(in.u1)
+		case wasm.OpcodeBr:
+			copy(regs[in.dst:in.dst+in.n], regs[in.a:in.a+in.n])
+			pc = int(in.u1)
+		case wasm.OpcodeBrIf:
+			if uint32(regs[in.b]) != 0 {
+				copy(regs[in.dst:in.dst+in.n], regs[in.a:in.a+in.n])
+				pc = int(in.u1)
+			}
+		case wasm.OpcodeReturn:
+			if in.a < 0 {
+				return 0
+			}
+			return regs[in.a]
+		case wasm.OpcodeCall:
+			ret := vm.callFromRegister(in, regs)
+			// The register file may have been reallocated by the callee.
+			regs = vm.regs[base : base+rc.numRegs]
+			if in.dst >= 0 {
+				regs[in.dst] = ret
+			}
+		case wasm.OpcodeGlobalGet:
+			regs[in.dst] = vm.Store.Globals[in.u1].Val
+		case wasm.OpcodeGlobalSet:
+			vm.Store.Globals[in.u1].Val = regs[in.a]
+		case wasm.OpcodeI32Load:
+			addr := registerMemoryBase(vm, regs[in.a], in.u1, 4)
+			regs[in.dst] = uint64(binary.LittleEndian.Uint32(vm.Store.Memory.Buffer[addr:]))
+		case wasm.OpcodeI32Store:
+			addr := registerMemoryBase(vm, regs[in.a], in.u1, 4)
+			binary.LittleEndian.PutUint32(vm.Store.Memory.Buffer[addr:], uint32(regs[in.b]))
+			vm.Store.Memory.markDirty(addr, 4)
+		case wasm.OpcodeI32Eqz:
+			regs[in.dst] = b2u(uint32(regs[in.a]) == 0)
+		case wasm.OpcodeI32Eq:
+			regs[in.dst] = b2u(uint32(regs[in.a]) == uint32(regs[in.b]))
+		case wasm.OpcodeI32Ne:
+			regs[in.dst] = b2u(uint32(regs[in.a]) != uint32(regs[in.b]))
+		case wasm.OpcodeI32Lts:
+			regs[in.dst] = b2u(int32(regs[in.a]) < int32(regs[in.b]))
+		case wasm.OpcodeI32Add:
+			regs[in.dst] = uint64(uint32(regs[in.a] + regs[in.b]))
+		case wasm.OpcodeI32Sub:
+			regs[in.dst] = uint64(uint32(regs[in.a] - regs[in.b]))
+		default:
+			panic("vm instruction not defined")
+		}
+	}
+	return 0
+}
+
+// callFromRegister calls the function of in with the arguments in regs and returns its result.
+func (vm *VM) callFromRegister(in *regInstruction, regs []uint64) uint64 {
+	callee := vm.Store.Functions[in.u1]
+	args := regs[in.a : in.a+in.n]
+	if f, ok := callee.(*WasmFunction); ok && f.regCode != nil {
+		vm.enterCall()
+		base := vm.allocRegisters(f.regCode)
+		copy(vm.regs[base:], args)
+		ret := vm.executeCompiled(f, base)
+		vm.regTop = base
+		vm.callDepth--
+		return ret
+	}
+
+	for _, arg := range args {
+		vm.stack.Push(arg)
+	}
+	callee.Call(vm)
+	if callee.HasResult() {
+		return vm.stack.Pop()
+	}
+	return 0
+}
+
+func registerMemoryBase(vm *VM, addr, offset, size uint64) uint64 {
+	base := uint64(uint32(addr)) + offset
+	if base+size > uint64(len(vm.Store.Memory.Buffer)) {
+		panic(ErrOutOfBoundsMemoryAccess)
+	}
+	return base
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// TestTranslateRegisterMalformed checks that the translator rejects code
+// taking more values than the stack holds.
+func TestTranslateRegisterMalformed(t *testing.T) {
+	ft := &wasm.FunctionType{Results: []wasm.ValueType{i32}}
+	tests := []struct {
+		name    string
+		code    []instruction
+		wantErr string
+	}{
+		{"add", []instruction{
+			{op: wasm.OpcodeI32Add},
+			{op: wasm.OpcodeReturn, u2: unwind(1, 0)},
+		}, "pc 0: 0x6a: stack underflow"},
+		{"return", []instruction{
+			{op: wasm.OpcodeReturn, u2: unwind(1, 0)},
+		}, "pc 0: 0xf: stack underflow"},
+		{"br", []instruction{
+			{op: wasm.OpcodeI32Const, u1: 1},
+			{op: wasm.OpcodeBr, u1: 2, u2: unwind(1, 1)},
+			{op: wasm.OpcodeReturn, u2: unwind(1, 0)},
+		}, "pc 1: 0xc: invalid unwind: 1, 1"},
+	}
+	for _, tc := range tests {
+		f := &WasmFunction{FunctionType: ft, Code: tc.code, heights: make([]int, len(tc.code)), maxHeight: 1}
+		if _, err := translateRegister(f, nil); err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s: translateRegister() error = %v, want %s", tc.name, err, tc.wantErr)
+		}
+	}
+}
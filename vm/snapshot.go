@@ -0,0 +1,258 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// ErrInvalidSnapshot is returned by Restore for snapshots that are corrupt,
+// of another format version, or of another module.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// snapshotMagic starts every snapshot, followed by snapshotVersion.
+const (
+	snapshotMagic   = "TWRS"
+	snapshotVersion = 1
+)
+
+// Snapshot writes the state of vm to w: its memory, globals, tables, value
+// stack and fuel. The snapshot can be restored into any instance of the same
+// module with Restore. It must be taken between calls, and fails for tables
+// holding externref values, which can't be serialized. The WASI state, such
+// as the files opened by the guest and what it read from stdin, isn't part of
+// the snapshot, so instances restored keep their own.
+//
+// The snapshot is the magic and the format version, the digest of the
+// module, the state and the CRC-32 of all of it.
+func (vm *VM) Snapshot(w io.Writer) error {
+	if vm.callDepth != 0 {
+		return errors.New("snapshot during a call")
+	}
+
+	e := &cacheEncoder{buf: []byte(snapshotMagic)}
+	e.u32(snapshotVersion)
+	digest := moduleDigest(vm.Store.ModuleInstance)
+	e.buf = append(e.buf, digest[:]...)
+
+	if mem := vm.Store.Memory; mem == nil {
+		e.u8(0)
+	} else {
+		e.u8(1)
+		e.u32(uint32(len(mem.Buffer)))
+		e.buf = append(e.buf, mem.Buffer...)
+	}
+
+	e.u32(uint32(len(vm.Store.Globals)))
+	for _, g := range vm.Store.Globals {
+		e.u64(g.Val)
+	}
+
+	indexes := make(map[Function]uint32, len(vm.Store.Functions))
+	for i, f := range vm.Store.Functions {
+		indexes[f] = uint32(i)
+	}
+	e.u32(uint32(len(vm.Store.Tables)))
+	for i, t := range vm.Store.Tables {
+		e.u32(uint32(len(t.References)))
+		for _, ref := range t.References {
+			if ref == nil {
+				e.u8(0)
+				continue
+			}
+			f, ok := ref.(Function)
+			if !ok {
+				return fmt.Errorf("table[%d]: externref values can't be snapshotted", i)
+			}
+			index, ok := indexes[f]
+			if !ok {
+				return fmt.Errorf("table[%d]: function of another instance", i)
+			}
+			e.u8(1)
+			e.u32(index)
+		}
+	}
+
+	e.u32(uint32(vm.stack.sp + 1))
+	for _, v := range vm.stack.stack[:vm.stack.sp+1] {
+		e.u64(v)
+	}
+
+	e.u8(byte(b2u(vm.fuelEnabled)))
+	e.u64(vm.fuel)
+	e.u64(vm.fuelConsumed)
+	for _, cost := range vm.fuelCosts {
+		e.u64(cost)
+	}
+
+	e.u32(crc32.ChecksumIEEE(e.buf))
+	_, err := w.Write(e.buf)
+	return err
+}
+
+// Restore replaces the state of vm with the snapshot read from r, which
+// must have been taken from an instance of the same module. The state is
+// left unchanged when an error is returned.
+func (vm *VM) Restore(r io.Reader) error {
+	if vm.callDepth != 0 {
+		return errors.New("restore during a call")
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("%w: invalid header", ErrInvalidSnapshot)
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	d := &cacheDecoder{buf: body[len(snapshotMagic):]}
+	if v := d.u32(); v != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, v)
+	}
+	digest := moduleDigest(vm.Store.ModuleInstance)
+	if string(d.next(len(digest))) != string(digest[:]) {
+		return fmt.Errorf("%w: snapshot of another module", ErrInvalidSnapshot)
+	}
+
+	s := vm.Store
+	var buf []byte
+	if hasMemory := d.u8() == 1; hasMemory != (s.Memory != nil) {
+		return fmt.Errorf("%w: memory mismatch", ErrInvalidSnapshot)
+	} else if hasMemory {
+		buf = append([]byte(nil), d.next(d.len(1))...)
+		pages := uint64(len(buf)) / uint64(wasm.MemoryPageSize)
+		if uint64(len(buf))%uint64(wasm.MemoryPageSize) != 0 || pages < uint64(s.Memory.Min) || pages > uint64(s.Memory.Max) {
+			return fmt.Errorf("%w: memory size out of limit", ErrInvalidSnapshot)
+		}
+	}
+
+	if int(d.u32()) != len(s.Globals) {
+		return fmt.Errorf("%w: global count mismatch", ErrInvalidSnapshot)
+	}
+	globals := make([]uint64, len(s.Globals))
+	for i := range globals {
+		globals[i] = d.u64()
+	}
+
+	if int(d.u32()) != len(s.Tables) {
+		return fmt.Errorf("%w: table count mismatch", ErrInvalidSnapshot)
+	}
+	tables := make([][]Reference, len(s.Tables))
+	for i, t := range s.Tables {
+		refs := make([]Reference, d.len(1))
+		if uint32(len(refs)) < t.Min || t.Max != nil && uint32(len(refs)) > *t.Max {
+			return fmt.Errorf("%w: table[%d] size out of limit", ErrInvalidSnapshot, i)
+		}
+		for j := range refs {
+			if d.u8() == 0 {
+				continue
+			}
+			index := d.u32()
+			if int(index) >= len(s.Functions) {
+				return fmt.Errorf("%w: table[%d] function index out of range", ErrInvalidSnapshot, i)
+			}
+			refs[j] = s.Functions[index]
+		}
+		tables[i] = refs
+	}
+
+	stack := make([]uint64, d.len(8))
+	if len(stack) > vm.stack.max {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, ErrCallStackExhausted)
+	}
+	for i := range stack {
+		stack[i] = d.u64()
+	}
+
+	fuelEnabled := d.u8() == 1
+	fuel, fuelConsumed := d.u64(), d.u64()
+	var fuelCosts [256]uint64
+	for i := range fuelCosts {
+		fuelCosts[i] = d.u64()
+	}
+
+	if d.err != nil || len(d.buf) != 0 {
+		return fmt.Errorf("%w: invalid data", ErrInvalidSnapshot)
+	}
+
+	if s.Memory != nil {
+		s.Memory.Buffer = buf
+		s.Memory.dirty = make([]byte, len(buf)/dirtyPageSize)
+		for i := range s.Memory.dirty {
+			s.Memory.dirty[i] = 1
+		}
+	}
+	for i, g := range s.Globals {
+		g.Val = globals[i]
+	}
+	for i, t := range s.Tables {
+		t.References = tables[i]
+	}
+	vm.stack.sp = -1
+	for _, v := range stack {
+		vm.stack.Push(v)
+	}
+	vm.fuelEnabled, vm.fuel, vm.fuelConsumed, vm.fuelCosts = fuelEnabled, fuel, fuelConsumed, fuelCosts
+	return nil
+}
+
+// moduleDigest returns the SHA-256 of the parts of m defining the state of
+// its instances and the meaning of it.
+func moduleDigest(m *wasm.Module) [sha256.Size]byte {
+	e := &cacheEncoder{}
+	e.u32(uint32(len(m.ImportSection)))
+	for _, imp := range m.ImportSection {
+		e.str(imp.Module)
+		e.str(imp.Name)
+		e.u8(byte(imp.Type))
+	}
+	e.u32(uint32(len(m.TypeSection)))
+	for i := range m.TypeSection {
+		e.str(m.TypeSection[i].String())
+	}
+	e.u32(uint32(len(m.FunctionSection)))
+	for i, fidx := range m.FunctionSection {
+		e.u32(fidx)
+		e.str(string(m.CodeSection[i].Body))
+	}
+	e.u32(uint32(len(m.TableSection)))
+	for _, t := range m.TableSection {
+		e.u8(byte(t.Type))
+		e.u32(t.Min)
+	}
+	if m.MemorySection != nil {
+		e.u8(1)
+		e.u32(m.MemorySection.Min)
+		e.u32(m.MemorySection.Max)
+	} else {
+		e.u8(0)
+	}
+	e.u32(uint32(len(m.GlobalSection)))
+	for _, g := range m.GlobalSection {
+		e.u8(byte(g.Type.ValType))
+		e.u8(byte(b2u(g.Type.Mutable)))
+		e.str(string(g.Init.Data))
+	}
+	e.u32(uint32(len(m.DataSection)))
+	for _, ds := range m.DataSection {
+		e.str(string(ds.OffsetExpression.Data))
+		e.str(string(ds.Init))
+	}
+	return sha256.Sum256(e.buf)
+}
+
+// str encodes s with its length, for moduleDigest.
+func (e *cacheEncoder) str(s string) {
+	e.u32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+}
@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+func snapshotTestModule() *testModule {
+	m := engineTestModule()
+	m.table("t", 2)
+	return m
+}
+
+func TestSnapshot(t *testing.T) {
+	m := snapshotTestModule()
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			config := NewConfig().WithEngine(e.engine)
+			vm := m.instantiate(t, config)
+			if _, err := vm.InvokeFunction("store", 40000, 0x12345678); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := vm.InvokeFunction("inc", 1); err != nil {
+				t.Fatal(err)
+			}
+			table, _ := vm.ExportedTable("t")
+			table.Set(1, vm.Store.Functions[0])
+			vm.AddFuel(100)
+
+			var snapshot bytes.Buffer
+			if err := vm.Snapshot(&snapshot); err != nil {
+				t.Fatal(err)
+			}
+
+			// Restore into the same instance after changing it, and into a new one.
+			if _, err := vm.InvokeFunction("store", 40000, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := vm.InvokeFunction("inc", 1); err != nil {
+				t.Fatal(err)
+			}
+			table.Set(1, nil)
+			for _, restored := range []*VM{vm, m.instantiate(t, config)} {
+				if err := restored.Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+					t.Fatal(err)
+				}
+				if ret, err := restored.InvokeFunction("load", 40000); err != nil || ret != 0x12345678 {
+					t.Errorf("load(40000) = %#x, %v, want 0x12345678", ret, err)
+				}
+				if g, _ := restored.ExportedGlobal("g"); g.Val != 8 {
+					t.Errorf("g = %d, want 8", g.Val)
+				}
+				if table, _ := restored.ExportedTable("t"); table.References[1] != restored.Store.Functions[0] {
+					t.Errorf("table = %v, want function 0 at 1", table.References)
+				}
+				if fuel := restored.Fuel(); fuel != 100 {
+					t.Errorf("Fuel() = %d, want 100", fuel)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotOfAnotherModule(t *testing.T) {
+	var snapshot bytes.Buffer
+	if err := sumModule().instantiate(t, NewConfig()).Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	vm := snapshotTestModule().instantiate(t, NewConfig())
+	err := vm.Restore(&snapshot)
+	if !errors.Is(err, ErrInvalidSnapshot) || !strings.Contains(err.Error(), "another module") {
+		t.Errorf("Restore() = %v, want a snapshot of another module", err)
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	m := snapshotTestModule()
+	vm := m.instantiate(t, NewConfig())
+	if _, err := vm.InvokeFunction("store", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := vm.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	data := snapshot.Bytes()
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 1
+	// The CRC is valid, but the state ends early.
+	truncated := bytes.Clone(data[:len(data)-100])
+	e := &cacheEncoder{buf: truncated[:len(truncated)-4]}
+	e.u32(crc32.ChecksumIEEE(e.buf))
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "invalid header"},
+		{"magic", append([]byte("TWRC"), data[4:]...), "invalid header"},
+		{"checksum", flipped, "checksum mismatch"},
+		{"truncated", e.buf, "invalid data"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			restored := m.instantiate(t, NewConfig())
+			err := restored.Restore(bytes.NewReader(tc.data))
+			if !errors.Is(err, ErrInvalidSnapshot) || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("Restore() = %v, want %q", err, tc.err)
+			}
+			// The state is left unchanged.
+			if ret, err := restored.InvokeFunction("load", 0); err != nil || ret != 0 {
+				t.Errorf("load(0) = %d, %v, want 0", ret, err)
+			}
+		})
+	}
+}
@@ -1,16 +1,25 @@
 package vm
 
+import "errors"
+
+// ErrCallStackExhausted is the trap raised when the value stack or the call
+// depth exceeds its limit.
+var ErrCallStackExhausted = errors.New("call stack exhausted")
+
+// stackSize is the initial size of stacks, which grow on demand.
 const stackSize = 128
 
 type Stack struct {
 	stack []uint64
 	sp    int
+	max   int
 }
 
-func NewStack() *Stack {
+func NewStack(max int) *Stack {
 	return &Stack{
-		stack: make([]uint64, stackSize),
+		stack: make([]uint64, min(stackSize, max)),
 		sp:    -1,
+		max:   max,
 	}
 }
 
@@ -29,36 +38,27 @@ func (s *Stack) Peek() uint64 {
 }
 
 func (s *Stack) Push(val uint64) {
-	// TODO: FIXME: overflow StackSize
+	if s.sp+1 == len(s.stack) {
+		s.grow()
+	}
 	s.stack[s.sp+1] = val
 	s.sp++
 }
 
-type LabelStack struct {
-	Stack []*Label
-	SP    int
-}
-
-type Label struct {
-	Arity          int
-	ContinuationPC uint64
-	EndPC          uint64
-}
-
-func NewLabelStack() *LabelStack {
-	return &LabelStack{
-		Stack: make([]*Label, stackSize),
-		SP:    -1,
+// Unwind drops drop values below the top keep values.
+func (s *Stack) Unwind(keep, drop int) {
+	if drop == 0 {
+		return
 	}
+	copy(s.stack[s.sp-drop-keep+1:], s.stack[s.sp-keep+1:s.sp+1])
+	s.sp -= drop
 }
 
-func (s *LabelStack) Pop() *Label {
-	ret := s.Stack[s.SP]
-	s.SP--
-	return ret
-}
-
-func (s *LabelStack) Push(val *Label) {
-	s.Stack[s.SP+1] = val
-	s.SP++
+func (s *Stack) grow() {
+	if len(s.stack) >= s.max {
+		panic(ErrCallStackExhausted)
+	}
+	stack := make([]uint64, min(2*len(s.stack)+1, s.max))
+	copy(stack, s.stack)
+	s.stack = stack
 }
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCallStackExhausted(t *testing.T) {
+	m := sumModule()
+	tests := []struct {
+		name    string
+		config  *Config
+		n       uint64
+		wantErr bool
+	}{
+		{name: "default", config: NewConfig(), n: 5000},
+		{name: "call depth", config: NewConfig(), n: 20000, wantErr: true},
+		{name: "max call depth", config: NewConfig().WithMaxCallDepth(100), n: 100, wantErr: true},
+		{name: "max stack size", config: NewConfig().WithMaxCallDepth(1 << 20).WithMaxStackSize(1000), n: 1000, wantErr: true},
+		{name: "grown stack", config: NewConfig().WithMaxCallDepth(1 << 20), n: 50000},
+	}
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			for _, tc := range tests {
+				vm := m.instantiate(t, tc.config.WithEngine(e.engine))
+				got, err := vm.InvokeFunction("sum", tc.n)
+				if tc.wantErr {
+					if !errors.Is(err, ErrCallStackExhausted) || err.Error() != "wasm error: call stack exhausted" {
+						t.Errorf("%s: sum(%d) error = %v, want wasm error: call stack exhausted", tc.name, tc.n, err)
+					}
+					// The instance is still usable.
+					if got, err := vm.InvokeFunction("sum", 10); err != nil || got != 55 {
+						t.Errorf("%s: sum(10) = %d, %v after the trap, want 55", tc.name, got, err)
+					}
+					continue
+				}
+				if want := uint64(uint32(tc.n * (tc.n + 1) / 2)); err != nil || got != want {
+					t.Errorf("%s: sum(%d) = %d, %v, want %d", tc.name, tc.n, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithMaxStackSizeInvalid(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("WithMaxStackSize(%d) didn't panic", n)
+				}
+			}()
+			NewConfig().WithMaxStackSize(n)
+		}()
+	}
+}
@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"math"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// Reference is an element of a table: a Function for funcref tables or
+// an arbitrary host value for externref tables. nil is the null reference.
+type Reference = any
+
+// TableInstance is the runtime representation of a table.
+// See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#table-instances%E2%91%A0
+type TableInstance struct {
+	References []Reference
+	Min        uint32
+	Max        *uint32
+	Type       wasm.RefType
+}
+
+func NewTableInstance(t *wasm.Table) *TableInstance {
+	return &TableInstance{
+		References: make([]Reference, t.Min),
+		Min:        t.Min,
+		Max:        t.Max,
+		Type:       t.Type,
+	}
+}
+
+// Size returns the number of elements.
+func (t *TableInstance) Size() uint32 {
+	return uint32(len(t.References))
+}
+
+// Get returns the element at the given index, or false if out of range.
+func (t *TableInstance) Get(i uint32) (Reference, bool) {
+	if i >= t.Size() {
+		return nil, false
+	}
+	return t.References[i], true
+}
+
+// Set replaces the element at the given index. It returns false if the
+// index is out of range or ref does not match the table type.
+func (t *TableInstance) Set(i uint32, ref Reference) bool {
+	if i >= t.Size() || !t.accepts(ref) {
+		return false
+	}
+	t.References[i] = ref
+	return true
+}
+
+// Grow appends delta elements initialized with init and returns the previous size.
+// ok is false when the result would exceed Max.
+// See https://webassembly.github.io/spec/core/exec/instructions.html#xref-syntax-instructions-syntax-instr-table-mathsf-table-grow-x
+func (t *TableInstance) Grow(delta uint32, init Reference) (previous uint32, ok bool) {
+	previous = t.Size()
+	max := uint64(math.MaxUint32)
+	if t.Max != nil {
+		max = uint64(*t.Max)
+	}
+	if uint64(previous)+uint64(delta) > max || !t.accepts(init) {
+		return 0, false
+	}
+	for i := uint32(0); i < delta; i++ {
+		t.References = append(t.References, init)
+	}
+	return previous, true
+}
+
+func (t *TableInstance) accepts(ref Reference) bool {
+	if ref == nil || t.Type == wasm.RefTypeExternref {
+		return true
+	}
+	_, ok := ref.(Function)
+	return ok
+}
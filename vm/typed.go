@@ -0,0 +1,223 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// ExportFunc returns the function exported under the given name as a Go
+// function of type F, for example:
+//
+//	add, err := vm.ExportFunc[func(int32, int32) (int32, error)](inst, "add")
+//
+// F must be a func type whose parameters and results are int32, uint32,
+// int64, uint64, float32 or float64, and whose last result is error.
+// F may take a context.Context as its first parameter, which is then used as
+// in InvokeFunctionContext.
+// The signature is checked against wasm.FunctionType once, here; common
+// signatures are then called without reflection or extra allocation, others
+// through reflect.MakeFunc.
+func ExportFunc[F any](vm *VM, name string) (F, error) {
+	var fn F
+	f, err := vm.exportedFunction(name)
+	if err != nil {
+		return fn, err
+	}
+
+	t := reflect.TypeOf(fn)
+	if err := checkSignature(t, f.Type()); err != nil {
+		return fn, fmt.Errorf("export func %s: %w", name, err)
+	}
+
+	switch p := any(&fn).(type) {
+	case *func() error:
+		*p = func() error {
+			_, err := vm.invoke(context.Background(), f)
+			return err
+		}
+	case *func() (int32, error):
+		*p = func() (int32, error) {
+			ret, err := vm.invoke(context.Background(), f)
+			return int32(ret), err
+		}
+	case *func(int32) error:
+		*p = func(x int32) error {
+			_, err := vm.invoke(context.Background(), f, encodeI32(x))
+			return err
+		}
+	case *func(int32) (int32, error):
+		*p = func(x int32) (int32, error) {
+			ret, err := vm.invoke(context.Background(), f, encodeI32(x))
+			return int32(ret), err
+		}
+	case *func(int32, int32) (int32, error):
+		*p = func(x, y int32) (int32, error) {
+			ret, err := vm.invoke(context.Background(), f, encodeI32(x), encodeI32(y))
+			return int32(ret), err
+		}
+	case *func(int64) (int64, error):
+		*p = func(x int64) (int64, error) {
+			ret, err := vm.invoke(context.Background(), f, uint64(x))
+			return int64(ret), err
+		}
+	case *func(int64, int64) (int64, error):
+		*p = func(x, y int64) (int64, error) {
+			ret, err := vm.invoke(context.Background(), f, uint64(x), uint64(y))
+			return int64(ret), err
+		}
+	case *func(float64) (float64, error):
+		*p = func(x float64) (float64, error) {
+			ret, err := vm.invoke(context.Background(), f, math.Float64bits(x))
+			return math.Float64frombits(ret), err
+		}
+	case *func(float64, float64) (float64, error):
+		*p = func(x, y float64) (float64, error) {
+			ret, err := vm.invoke(context.Background(), f, math.Float64bits(x), math.Float64bits(y))
+			return math.Float64frombits(ret), err
+		}
+	case *func(context.Context) error:
+		*p = func(ctx context.Context) error {
+			_, err := vm.invoke(ctx, f)
+			return err
+		}
+	case *func(context.Context, int32) (int32, error):
+		*p = func(ctx context.Context, x int32) (int32, error) {
+			ret, err := vm.invoke(ctx, f, encodeI32(x))
+			return int32(ret), err
+		}
+	case *func(context.Context, int32, int32) (int32, error):
+		*p = func(ctx context.Context, x, y int32) (int32, error) {
+			ret, err := vm.invoke(ctx, f, encodeI32(x), encodeI32(y))
+			return int32(ret), err
+		}
+	default:
+		fn = reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+			return callReflect(vm, f, t, in)
+		}).Interface().(F)
+	}
+	return fn, nil
+}
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// hasContext returns true if the first parameter of the func type t is a context.Context.
+func hasContext(t reflect.Type) bool {
+	return t.NumIn() > 0 && t.In(0) == contextType
+}
+
+func checkSignature(t reflect.Type, ft *wasm.FunctionType) error {
+	if t == nil || t.Kind() != reflect.Func {
+		return fmt.Errorf("%v is not a func type", t)
+	}
+	if t.IsVariadic() {
+		return fmt.Errorf("%v must not be variadic", t)
+	}
+	if t.NumOut() == 0 || t.Out(t.NumOut()-1) != errorType {
+		return fmt.Errorf("%v must return error as its last result", t)
+	}
+
+	in := 0
+	if hasContext(t) {
+		in = 1
+	}
+	if t.NumIn()-in != len(ft.Params) {
+		return fmt.Errorf("%v has %d params but %s has %d", t, t.NumIn()-in, ft, len(ft.Params))
+	}
+	for i, vt := range ft.Params {
+		if goValueType(t.In(in+i)) != vt {
+			return fmt.Errorf("param[%d] %v does not match %s", i, t.In(in+i), wasm.ValueTypeName(vt))
+		}
+	}
+
+	if t.NumOut()-1 != len(ft.Results) {
+		return fmt.Errorf("%v has %d results but %s has %d", t, t.NumOut()-1, ft, len(ft.Results))
+	}
+	for i, vt := range ft.Results {
+		if goValueType(t.Out(i)) != vt {
+			return fmt.Errorf("result[%d] %v does not match %s", i, t.Out(i), wasm.ValueTypeName(vt))
+		}
+	}
+	return nil
+}
+
+// goValueType returns the wasm.ValueType a Go type is encoded as, or zero if unsupported.
+func goValueType(t reflect.Type) wasm.ValueType {
+	switch t.Kind() {
+	case reflect.Int32, reflect.Uint32:
+		return wasm.ValueTypeI32
+	case reflect.Int64, reflect.Uint64:
+		return wasm.ValueTypeI64
+	case reflect.Float32:
+		return wasm.ValueTypeF32
+	case reflect.Float64:
+		return wasm.ValueTypeF64
+	}
+	return 0
+}
+
+func callReflect(vm *VM, f Function, t reflect.Type, in []reflect.Value) []reflect.Value {
+	ctx := context.Background()
+	if hasContext(t) {
+		if c, ok := in[0].Interface().(context.Context); ok && c != nil {
+			ctx = c
+		}
+		in = in[1:]
+	}
+
+	args := make([]uint64, len(in))
+	for i, v := range in {
+		switch v.Kind() {
+		case reflect.Int32:
+			args[i] = encodeI32(int32(v.Int()))
+		case reflect.Int64:
+			args[i] = uint64(v.Int())
+		case reflect.Uint32, reflect.Uint64:
+			args[i] = v.Uint()
+		case reflect.Float32:
+			args[i] = uint64(math.Float32bits(float32(v.Float())))
+		case reflect.Float64:
+			args[i] = math.Float64bits(v.Float())
+		}
+	}
+
+	ret, err := vm.invoke(ctx, f, args...)
+
+	out := make([]reflect.Value, t.NumOut())
+	if t.NumOut() == 2 {
+		rt := t.Out(0)
+		r := reflect.New(rt).Elem()
+		switch rt.Kind() {
+		case reflect.Int32:
+			r.SetInt(int64(int32(ret)))
+		case reflect.Int64:
+			r.SetInt(int64(ret))
+		case reflect.Uint32:
+			r.SetUint(uint64(uint32(ret)))
+		case reflect.Uint64:
+			r.SetUint(ret)
+		case reflect.Float32:
+			r.SetFloat(float64(math.Float32frombits(uint32(ret))))
+		case reflect.Float64:
+			r.SetFloat(math.Float64frombits(ret))
+		}
+		out[0] = r
+	}
+
+	errVal := reflect.New(errorType).Elem()
+	if err != nil {
+		errVal.Set(reflect.ValueOf(err))
+	}
+	out[len(out)-1] = errVal
+	return out
+}
+
+func encodeI32(v int32) uint64 {
+	return uint64(uint32(v))
+}
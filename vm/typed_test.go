@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// typedTestModule exports functions of the signatures ExportFunc calls
+// without reflection.
+func typedTestModule() *testModule {
+	f64 := wasm.ValueTypeF64
+	m := &testModule{}
+	m.function("nop", nil, nil, nil)
+	m.function("seven", nil, []wasm.ValueType{i32}, nil, i32c(7))
+	m.function("drop", []wasm.ValueType{i32}, nil, nil)
+	m.function("inc", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), i32c(1), wasm.OpcodeI32Add)
+	m.function("sub", []wasm.ValueType{i32, i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), wasm.OpcodeI32Sub)
+	m.function("id64", []wasm.ValueType{i64}, []wasm.ValueType{i64}, nil, imm(wasm.OpcodeLocalGet, 0))
+	m.function("second64", []wasm.ValueType{i64, i64}, []wasm.ValueType{i64}, nil, imm(wasm.OpcodeLocalGet, 1))
+	m.function("idf64", []wasm.ValueType{f64}, []wasm.ValueType{f64}, nil, imm(wasm.OpcodeLocalGet, 0))
+	m.function("secondf64", []wasm.ValueType{f64, f64}, []wasm.ValueType{f64}, nil, imm(wasm.OpcodeLocalGet, 1))
+	return m
+}
+
+// typedCalls returns a call of each function of typedTestModule through
+// ExportFunc, checking its result.
+func typedCalls(t *testing.T, vm *VM) map[string]func() {
+	t.Helper()
+	ctx := context.Background()
+	check := func(name string, ok bool, err error) {
+		if !ok || err != nil {
+			t.Errorf("%s: wrong result, error %v", name, err)
+		}
+	}
+
+	nop := mustExportFunc[func() error](t, vm, "nop")
+	nopCtx := mustExportFunc[func(context.Context) error](t, vm, "nop")
+	seven := mustExportFunc[func() (int32, error)](t, vm, "seven")
+	drop := mustExportFunc[func(int32) error](t, vm, "drop")
+	inc := mustExportFunc[func(int32) (int32, error)](t, vm, "inc")
+	incCtx := mustExportFunc[func(context.Context, int32) (int32, error)](t, vm, "inc")
+	sub := mustExportFunc[func(int32, int32) (int32, error)](t, vm, "sub")
+	subCtx := mustExportFunc[func(context.Context, int32, int32) (int32, error)](t, vm, "sub")
+	id64 := mustExportFunc[func(int64) (int64, error)](t, vm, "id64")
+	second64 := mustExportFunc[func(int64, int64) (int64, error)](t, vm, "second64")
+	idf64 := mustExportFunc[func(float64) (float64, error)](t, vm, "idf64")
+	secondf64 := mustExportFunc[func(float64, float64) (float64, error)](t, vm, "secondf64")
+	return map[string]func(){
+		"nop":              func() { check("nop", true, nop()) },
+		"nop with context": func() { check("nop with context", true, nopCtx(ctx)) },
+		"seven":            func() { got, err := seven(); check("seven", got == 7, err) },
+		"drop":             func() { check("drop", true, drop(1)) },
+		"inc":              func() { got, err := inc(-2); check("inc", got == -1, err) },
+		"inc with context": func() { got, err := incCtx(ctx, 41); check("inc with context", got == 42, err) },
+		"sub":              func() { got, err := sub(-3, 1); check("sub", got == -4, err) },
+		"sub with context": func() { got, err := subCtx(ctx, 3, 1); check("sub with context", got == 2, err) },
+		"id64":             func() { got, err := id64(-1 << 40); check("id64", got == -1<<40, err) },
+		"second64":         func() { got, err := second64(1, 1<<40); check("second64", got == 1<<40, err) },
+		"idf64":            func() { got, err := idf64(-1.5); check("idf64", got == -1.5, err) },
+		"secondf64":        func() { got, err := secondf64(1, 2.5); check("secondf64", got == 2.5, err) },
+	}
+}
+
+func mustExportFunc[F any](t *testing.T, vm *VM, name string) F {
+	t.Helper()
+	fn, err := ExportFunc[F](vm, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestExportFunc(t *testing.T) {
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			vm := typedTestModule().instantiate(t, NewConfig().WithEngine(e.engine))
+			for _, call := range typedCalls(t, vm) {
+				call()
+			}
+
+			// Other signatures are called through reflection.
+			sub := mustExportFunc[func(uint32, uint32) (uint32, error)](t, vm, "sub")
+			if got, err := sub(1, 2); err != nil || got != 0xffffffff {
+				t.Errorf("sub(1, 2) = %d, %v, want 0xffffffff", got, err)
+			}
+		})
+	}
+}
+
+func TestExportFuncSignature(t *testing.T) {
+	vm := typedTestModule().instantiate(t, NewConfig())
+	tests := []struct {
+		name    string
+		export  func() error
+		wantErr string
+	}{
+		{"unknown", func() error { _, err := ExportFunc[func() error](vm, "unknown"); return err }, "unknown"},
+		{"not a func", func() error { _, err := ExportFunc[int](vm, "nop"); return err }, "int is not a func type"},
+		{"no error", func() error { _, err := ExportFunc[func() int32](vm, "seven"); return err }, "must return error as its last result"},
+		{"variadic", func() error { _, err := ExportFunc[func(...int32) error](vm, "drop"); return err }, "must not be variadic"},
+		{"param count", func() error { _, err := ExportFunc[func(int32) (int32, error)](vm, "sub"); return err }, "has 1 params"},
+		{"param type", func() error { _, err := ExportFunc[func(int64, int32) (int32, error)](vm, "sub"); return err }, "param[0] int64 does not match i32"},
+		{"result count", func() error { _, err := ExportFunc[func() error](vm, "seven"); return err }, "has 0 results"},
+		{"result type", func() error { _, err := ExportFunc[func(int64) (float64, error)](vm, "id64"); return err }, "result[0] float64 does not match i64"},
+	}
+	for _, tc := range tests {
+		if err := tc.export(); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error = %v, want %s", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// TestExportFuncAllocs checks that the signatures ExportFunc calls without
+// reflection don't allocate.
+func TestExportFuncAllocs(t *testing.T) {
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			vm := typedTestModule().instantiate(t, NewConfig().WithEngine(e.engine))
+			for name, call := range typedCalls(t, vm) {
+				if n := testing.AllocsPerRun(100, call); n != 0 {
+					t.Errorf("%s: %v allocations per call, want 0", name, n)
+				}
+			}
+		})
+	}
+}
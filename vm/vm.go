@@ -1,8 +1,10 @@
 package vm
 
 import (
-	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"math"
 
 	"github.com/kawabatas/toy-wasm-runtime/wasm"
 )
@@ -10,92 +12,165 @@ import (
 // Execution
 // See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#execution%E2%91%A1
 type (
+	// VM is an instance of a module: its memory, globals and tables, and the
+	// stacks executing its functions. A VM must not be used by multiple
+	// goroutines at once; instantiate one per goroutine from a shared
+	// CompiledModule instead.
 	VM struct {
 		Store *Store
 
-		stack       *Stack
-		activeFrame *Frame
+		stack        *Stack
+		activeFrame  *Frame
+		callDepth    int
+		maxCallDepth int
+		// frames are the frames of EngineStack calls by call depth, reused
+		// by the calls at the same depth.
+		frames []*Frame
+
+		// regs is the register file of EngineRegister frames and the locals
+		// of EngineStack frames, used up to regTop.
+		regs   []uint64
+		regTop int
+		jitCtx jitContext
+
+		// ctx is the context of the current invocation, checked every
+		// ctxCheckInterval instructions and on every call.
+		ctx   context.Context
+		done  <-chan struct{}
+		ticks uint64
+
+		fuelEnabled        bool
+		fuel, fuelConsumed uint64
+		fuelCosts          [256]uint64
+
+		wasi *wasiState
 	}
 
 	Store struct {
 		ModuleInstance *wasm.Module
 		Functions      []Function
-		Memory         []byte
+		Memory         *MemoryInstance
+		Globals        []*GlobalInstance
+		Tables         []*TableInstance
 	}
 )
 
 func InstantiateModule(module *wasm.Module) (*VM, error) {
+	return InstantiateModuleWithConfig(module, NewConfig())
+}
+
+func InstantiateModuleWithConfig(module *wasm.Module, config *Config) (*VM, error) {
+	compiled, err := CompileModule(module, config)
+	if err != nil {
+		return nil, err
+	}
+	return InstantiateCompiledModule(compiled, config)
+}
+
+// InstantiateCompiledModule instantiates a compiled module, which only
+// allocates the memory, globals, tables and stacks of the instance. The
+// compiled functions are shared with the other instances. The engine of
+// config is ignored in favor of the one the module was compiled for.
+func InstantiateCompiledModule(compiled *CompiledModule, config *Config) (*VM, error) {
+	wasi, err := newWASIState(config.wasi)
+	if err != nil {
+		return nil, err
+	}
+
 	vm := &VM{
 		Store: &Store{
-			ModuleInstance: module,
+			ModuleInstance: compiled.module,
 		},
-		stack: NewStack(),
+		stack:        NewStack(config.maxStackSize),
+		maxCallDepth: config.maxCallDepth,
+		wasi:         wasi,
 	}
 
-	if err := vm.initMemory(); err != nil {
-		panic(err)
-	}
-
-	if err := vm.initFunctions(); err != nil {
-		panic(err)
+	vm.initMemory(compiled)
+	vm.initGlobals(compiled)
+	vm.initTables()
+	if err := vm.initFunctions(compiled); err != nil {
+		return nil, err
 	}
 
 	return vm, nil
 }
 
-func (vm *VM) initMemory() error {
-	mem := make([]byte, wasm.MemoryPageSize)
+func (vm *VM) initMemory(compiled *CompiledModule) {
+	m := vm.Store.ModuleInstance
+	if m.MemorySection == nil {
+		return
+	}
+	mem := NewMemoryInstance(m.MemorySection)
+	for _, ds := range compiled.data {
+		copy(mem.Buffer[ds.offset:], ds.init)
+	}
+	vm.Store.Memory = mem
+}
 
-	for _, ds := range vm.Store.ModuleInstance.DataSection {
-		r := bytes.NewBuffer(ds.OffsetExpression.Data)
-		switch ds.OffsetExpression.Opcode {
-		case wasm.OpcodeI32Const:
-			offset, _, err := wasm.DecodeInt32(r)
-			if err != nil {
-				return fmt.Errorf("decode int32 error: %w", err)
-			}
+func (vm *VM) initGlobals(compiled *CompiledModule) {
+	m := vm.Store.ModuleInstance
+	globals := make([]*GlobalInstance, len(m.GlobalSection))
+	for i := range m.GlobalSection {
+		globals[i] = &GlobalInstance{Type: m.GlobalSection[i].Type, Val: compiled.globals[i]}
+	}
+	vm.Store.Globals = globals
+}
 
-			size := int(offset) + len(ds.Init)
-			if uint32(size) > wasm.MemoryPageSize {
-				return fmt.Errorf("memory size out of limit")
-			}
-			copy(mem[offset:], ds.Init)
+func (vm *VM) initTables() {
+	m := vm.Store.ModuleInstance
+	tables := make([]*TableInstance, len(m.TableSection))
+	for i := range m.TableSection {
+		tables[i] = NewTableInstance(&m.TableSection[i])
+	}
+	vm.Store.Tables = tables
+}
 
-		default:
-			return fmt.Errorf("invalid opcode: %#x", ds.OffsetExpression.Opcode)
+// evalConstantExpression returns the raw bits of the value of a constant expression.
+// See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#constant-expressions%E2%91%A0
+func evalConstantExpression(expr *wasm.ConstantExpression) (uint64, error) {
+	switch expr.Opcode {
+	case wasm.OpcodeI32Const:
+		v, _, err := wasm.LoadInt32(expr.Data)
+		if err != nil {
+			return 0, fmt.Errorf("decode int32 error: %w", err)
+		}
+		return uint64(uint32(v)), nil
+	case wasm.OpcodeI64Const:
+		v, _, err := wasm.LoadInt64(expr.Data)
+		if err != nil {
+			return 0, fmt.Errorf("decode int64 error: %w", err)
 		}
+		return uint64(v), nil
+	case wasm.OpcodeF32Const:
+		return uint64(binary.LittleEndian.Uint32(expr.Data)), nil
+	case wasm.OpcodeF64Const:
+		return binary.LittleEndian.Uint64(expr.Data), nil
+	default:
+		return 0, fmt.Errorf("invalid opcode: %#x", expr.Opcode)
 	}
-
-	vm.Store.Memory = mem
-	return nil
 }
 
-func (vm *VM) initFunctions() error {
+func (vm *VM) initFunctions(compiled *CompiledModule) error {
 	m := vm.Store.ModuleInstance
 
-	funcs := make([]Function, len(m.TypeSection))
+	funcs := make([]Function, int(m.ImportFunctionCount)+len(m.FunctionSection))
 	funcsIndex := 0
 
+	// The imports are functions, as checked by newCompiledModule.
 	for _, imp := range m.ImportSection {
-		if imp.Module == wasiPreview1 && imp.Type == wasm.ExternTypeFunc {
-			funcs[funcsIndex] = &HostFunction{
-				FdWrite: newWasiFdWrite(vm),
-			}
-			funcsIndex++
+		if imp.Module != wasiPreview1 {
+			return fmt.Errorf("unknown import: %s.%s", imp.Module, imp.Name)
 		}
-	}
-
-	for i, fidx := range m.FunctionSection {
-		f := &WasmFunction{
-			FunctionType:            &m.TypeSection[fidx],
-			Body:                    m.CodeSection[i].Body,
-			BodyOffsetInCodeSection: m.CodeSection[i].BodyOffsetInCodeSection,
-		}
-		blocks, err := vm.parseBlocks(f.Body)
+		f, err := newWASIFunction(imp.Name, &m.TypeSection[imp.DescFunc], vm.wasi.config.tracer)
 		if err != nil {
-			return fmt.Errorf("parse blocks: %w", err)
+			return err
 		}
-		f.Blocks = blocks
+		funcs[funcsIndex] = f
+		funcsIndex++
+	}
+
+	for _, f := range compiled.functions {
 		funcs[funcsIndex] = f
 		funcsIndex++
 	}
@@ -105,124 +180,99 @@ func (vm *VM) initFunctions() error {
 }
 
 func (vm *VM) InvokeFunction(name string, args ...uint64) (uint64, error) {
-	funcs := vm.Store.Functions
-	exp, ok := vm.Store.ModuleInstance.Exports[name]
-	if !ok {
-		return 0, fmt.Errorf("export func %s is not found", name)
+	return vm.InvokeFunctionContext(context.Background(), name, args...)
+}
+
+// InvokeFunctionContext is like InvokeFunction but stops the execution with an
+// error wrapping ctx.Err() once ctx is canceled or its deadline is exceeded.
+func (vm *VM) InvokeFunctionContext(ctx context.Context, name string, args ...uint64) (uint64, error) {
+	f, err := vm.exportedFunction(name)
+	if err != nil {
+		return 0, err
 	}
+	return vm.invoke(ctx, f, args...)
+}
 
-	if exp.Type != wasm.ExternTypeFunc {
-		return 0, fmt.Errorf("export func %s is not func type", name)
+func (vm *VM) exportedFunction(name string) (Function, error) {
+	funcs := vm.Store.Functions
+	exp, err := vm.export(name, wasm.ExternTypeFunc)
+	if err != nil {
+		return nil, err
 	}
 
 	if int(exp.Index) >= len(funcs) {
-		return 0, fmt.Errorf("export func index out of range")
+		return nil, fmt.Errorf("export func index out of range")
 	}
+	return funcs[exp.Index], nil
+}
 
-	for _, arg := range args {
-		vm.stack.Push(arg)
+func (vm *VM) invoke(ctx context.Context, f Function, args ...uint64) (ret uint64, err error) {
+	ft := f.Type()
+	if len(args) != len(ft.Params) {
+		return 0, fmt.Errorf("expected %d params, but passed %d", len(ft.Params), len(args))
+	}
+
+	// Leave the stack as it was before the call even when it traps,
+	// so that a failed invocation doesn't corrupt the next one.
+	base := vm.stack.sp
+	frame, depth, regTop := vm.activeFrame, vm.callDepth, vm.regTop
+	prevCtx, prevDone := vm.ctx, vm.done
+	vm.ctx, vm.done = ctx, ctx.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*ExitError); ok {
+				err = e
+			} else if e, ok := r.(error); ok {
+				err = fmt.Errorf("wasm error: %w", e)
+			} else {
+				err = fmt.Errorf("wasm error: %v", r)
+			}
+		}
+		vm.stack.sp = base
+		vm.activeFrame, vm.callDepth, vm.regTop = frame, depth, regTop
+		vm.ctx, vm.done = prevCtx, prevDone
+	}()
+
+	for i, arg := range args {
+		v, err := checkValue(ft.Params[i], arg)
+		if err != nil {
+			return 0, fmt.Errorf("param[%d]: %w", i, err)
+		}
+		vm.stack.Push(v)
 	}
 
-	f := funcs[exp.Index]
 	f.Call(vm)
 
-	var ret uint64
 	if f.HasResult() {
 		ret = vm.stack.Pop()
 	}
 	return ret, nil
 }
 
-func (vm *VM) FetchInt32() int32 {
-	r := bytes.NewBuffer(vm.activeFrame.Function.Body[vm.activeFrame.PC:])
-	ret, num, err := wasm.DecodeInt32(r)
-	if err != nil {
-		panic(err)
-	}
-	vm.activeFrame.PC += num - 1 // 1-1=0
-	return ret
-}
+// ctxCheckInterval is the mask of the instruction count at which the context is checked.
+const ctxCheckInterval = 1<<10 - 1
 
-func (vm *VM) FetchUint32() uint32 {
-	r := bytes.NewBuffer(vm.activeFrame.Function.Body[vm.activeFrame.PC:])
-	ret, num, err := wasm.DecodeUint32(r)
-	if err != nil {
-		panic(err)
+// checkContext traps if the context of the current invocation is done.
+func (vm *VM) checkContext() {
+	if vm.done == nil {
+		return
+	}
+	select {
+	case <-vm.done:
+		panic(vm.ctx.Err())
+	default:
 	}
-	vm.activeFrame.PC += num - 1 // 1-1=0
-	return ret
 }
 
-type BlockType = wasm.FunctionType
-
-func (vm *VM) parseBlocks(body []byte) (map[uint64]*WasmFunctionBlock, error) {
-	ret := map[uint64]*WasmFunctionBlock{}
-	stack := make([]*WasmFunctionBlock, 0)
-
-	for pc := uint64(0); pc < uint64(len(body)); pc++ {
-		rawOc := body[pc]
-
-		switch wasm.Opcode(rawOc) {
-		case wasm.OpcodeCall:
-			pc++
-			_, num, err := wasm.DecodeUint32(bytes.NewBuffer(body[pc:]))
-			if err != nil {
-				return nil, fmt.Errorf("read immediate: %w", err)
-			}
-			pc += num - 1
-			continue
-		case wasm.OpcodeI32Const:
-			pc++
-			_, num, err := wasm.DecodeInt32(bytes.NewBuffer(body[pc:]))
-			if err != nil {
-				return nil, fmt.Errorf("read immediate: %w", err)
-			}
-			pc += num - 1
-			continue
-		case wasm.OpcodeIf:
-			var bt BlockType
-			r := bytes.NewBuffer(body[pc+1:])
-			raw, num, err := wasm.DecodeInt33AsInt64(r)
-			if err != nil {
-				return nil, fmt.Errorf("decode int33: %w", err)
-			}
-			switch raw {
-			case -64: // 0x40 in original byte = nil
-				bt = BlockType{}
-			case -1: // 0x7f in original byte = i32
-				bt = BlockType{Results: []wasm.ValueType{wasm.ValueTypeI32}}
-			default:
-				m := vm.Store.ModuleInstance
-				if raw < 0 || (raw >= int64(len(m.TypeSection))) {
-					return nil, fmt.Errorf("invalid block type: %d", raw)
-				}
-				bt = m.TypeSection[raw]
-			}
-
-			stack = append(stack, &WasmFunctionBlock{
-				StartAt:        pc,
-				BlockType:      &bt,
-				BlockTypeBytes: num,
-			})
-			pc += num
-		case wasm.OpcodeElse:
-			stack[len(stack)-1].ElseAt = pc
-		case wasm.OpcodeEnd:
-			if int(pc) == len(body)-1 { // ignore last
-				continue
-			}
-			bl := stack[len(stack)-1]
-			stack = stack[:len(stack)-1]
-			bl.EndAt = pc
-			ret[bl.StartAt] = bl
-		default:
-			continue
+// checkValue returns v normalized for the value type. 32-bit values must fit
+// in the lower 32 bits, either zero or sign extended.
+func checkValue(vt wasm.ValueType, v uint64) (uint64, error) {
+	switch vt {
+	case wasm.ValueTypeI32, wasm.ValueTypeF32:
+		if v > math.MaxUint32 && int64(v) != int64(int32(v)) {
+			return 0, fmt.Errorf("%#x overflows %s", v, wasm.ValueTypeName(vt))
 		}
+		return uint64(uint32(v)), nil
 	}
-
-	if len(stack) > 0 {
-		return nil, fmt.Errorf("ill-nested block exists")
-	}
-
-	return ret, nil
+	return v, nil
 }
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func BenchmarkFib(b *testing.B) {
+	benchmarkInvoke(b, EngineStack, "../testdata/fib.wasm", "fib", 20)
+}
+
+func BenchmarkLoop(b *testing.B) {
+	benchmarkInvoke(b, EngineStack, "../testdata/loop.wasm", "loop", 10000)
+}
+
+func BenchmarkFibRegister(b *testing.B) {
+	benchmarkInvoke(b, EngineRegister, "../testdata/fib.wasm", "fib", 20)
+}
+
+func BenchmarkLoopRegister(b *testing.B) {
+	benchmarkInvoke(b, EngineRegister, "../testdata/loop.wasm", "loop", 10000)
+}
+
+func BenchmarkFibJIT(b *testing.B) {
+	benchmarkInvoke(b, EngineJIT, "../testdata/fib.wasm", "fib", 20)
+}
+
+func BenchmarkLoopJIT(b *testing.B) {
+	benchmarkInvoke(b, EngineJIT, "../testdata/loop.wasm", "loop", 10000)
+}
+
+func BenchmarkInstantiate(b *testing.B) {
+	data, err := os.ReadFile("../testdata/helloworld.wasm")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	config := NewConfig()
+	compiled, err := CompileBinary(data, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := InstantiateCompiledModule(compiled, config); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkInstancePool(b *testing.B) {
+	data, err := os.ReadFile("../testdata/helloworld.wasm")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	config := NewConfig()
+	compiled, err := CompileBinary(data, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pool := NewInstancePool(compiled, config)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			vm, err := pool.Get()
+			if err != nil {
+				b.Fatal(err)
+			}
+			pool.Put(vm)
+		}
+	})
+}
+
+func benchmarkInvoke(b *testing.B, engine Engine, path, name string, args ...uint64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	mod, err := wasm.DecodeModule(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	vm, err := InstantiateModuleWithConfig(mod, NewConfig().WithEngine(engine))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.InvokeFunction(name, args...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func TestInstantiateUnsupportedImport(t *testing.T) {
+	tests := []struct {
+		name string
+		imp  wasm.Import
+	}{
+		{name: "memory", imp: wasm.Import{Type: wasm.ExternTypeMemory, DescMem: &wasm.Memory{Min: 1, Max: 1}}},
+		{name: "global", imp: wasm.Import{Type: wasm.ExternTypeGlobal, DescGlobal: wasm.GlobalType{ValType: i32}}},
+		{name: "table", imp: wasm.Import{Type: wasm.ExternTypeTable, DescTable: wasm.Table{Min: 1}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &testModule{}
+			// Without the check, global.get 0 would read the global defined
+			// by the module instead of the imported one.
+			m.global("", i32, false, 7)
+			m.function("get", nil, []wasm.ValueType{i32}, nil, imm(wasm.OpcodeGlobalGet, 0))
+			// The decoder rejects these imports, but modules can be built
+			// without it.
+			mod := decodeTestModule(t, m)
+			tc.imp.Module, tc.imp.Name = "env", "x"
+			mod.ImportSection = []wasm.Import{tc.imp}
+
+			want := "unsupported import: " + tc.name + " env.x"
+			if _, err := InstantiateModule(mod); err == nil || err.Error() != want {
+				t.Errorf("InstantiateModule() error = %v, want %s", err, want)
+			}
+			if _, err := CompileModule(mod, NewConfig().WithEngine(EngineJIT)); err == nil || err.Error() != want {
+				t.Errorf("CompileModule() error = %v, want %s", err, want)
+			}
+		})
+	}
+}
+
+func TestInstantiateUnknownImport(t *testing.T) {
+	m := &testModule{}
+	m.importFunction("env", "f", nil, nil)
+	_, err := InstantiateModuleWithConfig(decodeTestModule(t, m), NewConfig())
+	if want := "unknown import: env.f"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %s", err, want)
+	}
+}
+
+func decodeTestModule(t testing.TB, m *testModule) *wasm.Module {
+	t.Helper()
+	mod, err := wasm.DecodeModule(m.binary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mod
+}
+
+func TestInvokeFunctionParams(t *testing.T) {
+	m := &testModule{}
+	m.function("add", []wasm.ValueType{i32, i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeLocalGet, 1), wasm.OpcodeI32Add)
+	m.function("add64", []wasm.ValueType{i64}, nil, nil)
+	m.function("trap", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), wasm.OpcodeUnreachable)
+
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			vm := m.instantiate(t, NewConfig().WithEngine(e.engine))
+			tests := []struct {
+				name    string
+				fn      string
+				args    []uint64
+				want    uint64
+				wantErr string
+			}{
+				{name: "too few", fn: "add", args: []uint64{1}, wantErr: "expected 2 params, but passed 1"},
+				{name: "too many", fn: "add", args: []uint64{1, 2, 3}, wantErr: "expected 2 params, but passed 3"},
+				{name: "overflow", fn: "add", args: []uint64{1 << 40, 2}, wantErr: "param[0]: 0x10000000000 overflows i32"},
+				{name: "sign extended", fn: "add", args: []uint64{0xffffffff_ffffffff, 2}, want: 1},
+				{name: "zero extended", fn: "add", args: []uint64{0xffffffff, 2}, want: 1},
+				{name: "i64", fn: "add64", args: []uint64{1 << 40}},
+				{name: "trap", fn: "trap", args: []uint64{1}, wantErr: "wasm error: unreachable"},
+				{name: "after errors", fn: "add", args: []uint64{40, 2}, want: 42},
+			}
+			for _, tc := range tests {
+				got, err := vm.InvokeFunction(tc.fn, tc.args...)
+				if tc.wantErr != "" {
+					if err == nil || err.Error() != tc.wantErr {
+						t.Errorf("%s: error = %v, want %s", tc.name, err, tc.wantErr)
+					}
+				} else if err != nil || got != tc.want {
+					t.Errorf("%s: got %d, %v, want %d", tc.name, got, err, tc.want)
+				}
+				// Failed invocations must leave nothing behind.
+				if vm.stack.sp != -1 || vm.callDepth != 0 || vm.regTop != 0 || vm.activeFrame != nil {
+					t.Errorf("%s: sp = %d, call depth = %d, register top = %d after the call", tc.name, vm.stack.sp, vm.callDepth, vm.regTop)
+				}
+			}
+		})
+	}
+}
+
+// sumModule exports sum(n), which adds n to sum(n-1) recursively.
+func sumModule() *testModule {
+	m := &testModule{}
+	m.function("sum", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), i32c(1), wasm.OpcodeI32Lts,
+		imm(wasm.OpcodeIf, uint32(i32)), i32c(0),
+		wasm.OpcodeElse,
+		imm(wasm.OpcodeLocalGet, 0),
+		imm(wasm.OpcodeLocalGet, 0), i32c(1), wasm.OpcodeI32Sub, imm(wasm.OpcodeCall, 0),
+		wasm.OpcodeI32Add,
+		wasm.OpcodeEnd)
+	return m
+}
+
+func TestInvokeFunctionContext(t *testing.T) {
+	m := sumModule()
+	// spin loops forever, and spinCall calls nop forever.
+	m.function("spin", nil, nil, nil, imm(wasm.OpcodeLoop, 0x40), imm(wasm.OpcodeBr, 0), wasm.OpcodeEnd)
+	nop := m.function("", nil, nil, nil)
+	m.function("spinCall", nil, nil, nil, imm(wasm.OpcodeLoop, 0x40), imm(wasm.OpcodeCall, nop), imm(wasm.OpcodeBr, 0), wasm.OpcodeEnd)
+
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			vm := m.instantiate(t, NewConfig().WithEngine(e.engine))
+			for _, fn := range []string{"spin", "spinCall"} {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				start := time.Now()
+				_, err := vm.InvokeFunctionContext(ctx, fn)
+				cancel()
+				if !errors.Is(err, context.DeadlineExceeded) || err.Error() != "wasm error: context deadline exceeded" {
+					t.Errorf("%s: error = %v, want wasm error: context deadline exceeded", fn, err)
+				}
+				if d := time.Since(start); d > 5*time.Second {
+					t.Errorf("%s: stopped after %v", fn, d)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := vm.InvokeFunctionContext(ctx, "sum", 10); !errors.Is(err, context.Canceled) || err.Error() != "wasm error: context canceled" {
+				t.Errorf("error = %v, want wasm error: context canceled", err)
+			}
+			sum, err := ExportFunc[func(context.Context, int32) (int32, error)](vm, "sum")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sum(ctx, 10); !errors.Is(err, context.Canceled) {
+				t.Errorf("sum() error = %v, want %v", err, context.Canceled)
+			}
+
+			if got, err := vm.InvokeFunction("sum", 10); err != nil || got != 55 {
+				t.Errorf("sum(10) = %d, %v after cancellation, want 55", got, err)
+			}
+		})
+	}
+}
@@ -1,102 +1,503 @@
 package vm
 
 import (
-	"encoding/binary"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
 	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
 )
 
 const wasiPreview1 = "wasi_snapshot_preview1"
 
-type wasiFdWrite struct {
-	vm *VM
+// Error numbers returned by the WASI functions.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#errno
+const (
+	errnoSuccess     uint64 = 0
+	errnoAcces       uint64 = 2
+	errnoAgain       uint64 = 6
+	errnoBadf        uint64 = 8
+	errnoBusy        uint64 = 10
+	errnoConnreset   uint64 = 15
+	errnoExist       uint64 = 20
+	errnoFault       uint64 = 21
+	errnoFbig        uint64 = 22
+	errnoInval       uint64 = 28
+	errnoIo          uint64 = 29
+	errnoIsdir       uint64 = 31
+	errnoLoop        uint64 = 32
+	errnoNametoolong uint64 = 37
+	errnoNoent       uint64 = 44
+	errnoNospc       uint64 = 51
+	errnoNosys       uint64 = 52
+	errnoNotconn     uint64 = 53
+	errnoNotdir      uint64 = 54
+	errnoNotempty    uint64 = 55
+	errnoNotsock     uint64 = 57
+	errnoNotsup      uint64 = 58
+	errnoPerm        uint64 = 63
+	errnoPipe        uint64 = 64
+	errnoRofs        uint64 = 69
+	errnoSpipe       uint64 = 70
+	errnoXdev        uint64 = 75
+	errnoNotcapable  uint64 = 76
+)
+
+// errnos are the WASI errnos of the host errnos.
+var errnos = map[syscall.Errno]uint64{
+	syscall.EACCES:       errnoAcces,
+	syscall.EAGAIN:       errnoAgain,
+	syscall.EBADF:        errnoBadf,
+	syscall.EBUSY:        errnoBusy,
+	syscall.ECONNRESET:   errnoConnreset,
+	syscall.EEXIST:       errnoExist,
+	syscall.EFBIG:        errnoFbig,
+	syscall.EINVAL:       errnoInval,
+	syscall.EISDIR:       errnoIsdir,
+	syscall.ELOOP:        errnoLoop,
+	syscall.ENAMETOOLONG: errnoNametoolong,
+	syscall.ENOENT:       errnoNoent,
+	syscall.ENOSPC:       errnoNospc,
+	syscall.ENOSYS:       errnoNosys,
+	syscall.ENOTCONN:     errnoNotconn,
+	syscall.ENOTDIR:      errnoNotdir,
+	syscall.ENOTEMPTY:    errnoNotempty,
+	syscall.EPERM:        errnoPerm,
+	syscall.EPIPE:        errnoPipe,
+	syscall.EROFS:        errnoRofs,
+	syscall.ESPIPE:       errnoSpipe,
+	syscall.EXDEV:        errnoXdev,
+}
+
+// WASIConfig configures the WASI functions a module imports from
+// wasi_snapshot_preview1. The With methods return a modified copy, so a
+// WASIConfig can be shared.
+type WASIConfig struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	args   []string
+	env    map[string]string
+	clock  Clock
+	rand   io.Reader
+	// preopens are the preopened directories, given the file descriptors
+	// from 3 on.
+	preopens []wasiPreopen
+	// listeners are the preopened sockets, given the file descriptors after
+	// the preopened directories.
+	listeners []*wasiListener
+	// tracer traces the WASI calls, or is nil.
+	tracer *wasiTracer
+}
+
+type wasiPreopen struct {
+	guestPath string
+	fsys      FileSystem
 }
 
-func newWasiFdWrite(vm *VM) *wasiFdWrite {
-	return &wasiFdWrite{
-		vm: vm,
+// NewWASIConfig returns a config connecting the file descriptors 0, 1 and 2
+// of the guest to the standard input, output and error of the process, with
+// the clocks of the host and crypto/rand as the entropy source.
+func NewWASIConfig() *WASIConfig {
+	return &WASIConfig{
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		clock:  systemClock{},
+		rand:   rand.Reader,
 	}
 }
 
-// fdWrite is the WASI function named FdWriteName which writes to a file
-// descriptor.
-//
-// # Parameters
-//
-//   - fd: an opened file descriptor to write data to
-//   - iovs: offset in api.Memory to read offset, size pairs representing the
-//     data to write to `fd`
-//   - Both offset and length are encoded as uint32le.
-//   - iovsCount: count of memory offset, size pairs to read sequentially
-//     starting at iovs
-//   - resultNwritten: offset in api.Memory to write the number of bytes
-//     written
-//
-// Result (Errno)
-//
-// The return value is 0 except the following error conditions:
-//   - sys.EBADF: `fd` is invalid
-//   - sys.EFAULT: `iovs` or `resultNwritten` point to an offset out of memory
-//   - sys.EIO: a file system error
-//
-// For example, this function needs to first read `iovs` to determine what to
-// write to `fd`. If parameters iovs=1 iovsCount=2, this function reads two
-// offset/length pairs from api.Memory:
-//
-//	                  iovs[0]                  iovs[1]
-//	          +---------------------+   +--------------------+
-//	          | uint32le    uint32le|   |uint32le    uint32le|
-//	          +---------+  +--------+   +--------+  +--------+
-//	          |         |  |        |   |        |  |        |
-//	[]byte{?, 18, 0, 0, 0, 4, 0, 0, 0, 23, 0, 0, 0, 2, 0, 0, 0, ?... }
-//	   iovs --^            ^            ^           ^
-//	          |            |            |           |
-//	 offset --+   length --+   offset --+  length --+
-//
-// This function reads those chunks api.Memory into the `fd` sequentially.
-//
-//	                    iovs[0].length        iovs[1].length
-//	                   +--------------+       +----+
-//	                   |              |       |    |
-//	[]byte{ 0..16, ?, 'w', 'a', 'z', 'e', ?, 'r', 'o', ? }
-//	  iovs[0].offset --^                      ^
-//	                         iovs[1].offset --+
-//
-// Since "wazero" was written, if parameter resultNwritten=26, this function
-// writes the below to api.Memory:
-//
-//	                   uint32le
-//	                  +--------+
-//	                  |        |
-//	[]byte{ 0..24, ?, 6, 0, 0, 0', ? }
-//	 resultNwritten --^
+// WithStdin makes the guest read its standard input, fd 0, from r.
+func (c *WASIConfig) WithStdin(r io.Reader) *WASIConfig {
+	ret := c.clone()
+	ret.stdin = r
+	return ret
+}
+
+// WithStdout makes the guest write its standard output, fd 1, to w.
+func (c *WASIConfig) WithStdout(w io.Writer) *WASIConfig {
+	ret := c.clone()
+	ret.stdout = w
+	return ret
+}
+
+// WithStderr makes the guest write its standard error, fd 2, to w.
+func (c *WASIConfig) WithStderr(w io.Writer) *WASIConfig {
+	ret := c.clone()
+	ret.stderr = w
+	return ret
+}
+
+// WithArgs sets the command-line arguments of the guest, starting with the
+// program name. The default is none.
+func (c *WASIConfig) WithArgs(args ...string) *WASIConfig {
+	ret := c.clone()
+	ret.args = append([]string(nil), args...)
+	return ret
+}
+
+// WithEnv sets the environment variable key to value. The guest sees the
+// variables sorted by key. The default is an empty environment.
+func (c *WASIConfig) WithEnv(key, value string) *WASIConfig {
+	ret := c.clone()
+	ret.env[key] = value
+	return ret
+}
+
+// WithClock sets the source of the clocks, such as a clock of NewFakeClock
+// to run deterministically.
+func (c *WASIConfig) WithClock(clock Clock) *WASIConfig {
+	ret := c.clone()
+	ret.clock = clock
+	return ret
+}
+
+// WithRandSource sets the entropy source of random_get, such as a seeded
+// math/rand.Rand to run deterministically. The reader is shared by the
+// instances, so it must be safe for concurrent use if they are used
+// concurrently.
+func (c *WASIConfig) WithRandSource(r io.Reader) *WASIConfig {
+	ret := c.clone()
+	ret.rand = r
+	return ret
+}
+
+// WithPreopen preopens the root of fsys as the directory guestPath of the
+// guest, such as "/" or "/data", so that it can open the files in it. fsys
+// is a host directory of DirFS, an fs.FS of ReadOnlyFS or a MemFS.
+func (c *WASIConfig) WithPreopen(guestPath string, fsys FileSystem) *WASIConfig {
+	ret := c.clone()
+	ret.preopens = append(slices.Clip(c.preopens), wasiPreopen{guestPath: guestPath, fsys: fsys})
+	return ret
+}
+
+// WithListener preopens l as a socket the guest accepts the connections of
+// with sock_accept, such as a TCP listener on localhost or a Unix socket.
+// Sockets get the file descriptors after the preopened directories, in the
+// order they are added. The instances of the config share l, which the
+// caller closes when they are done.
+func (c *WASIConfig) WithListener(l net.Listener) *WASIConfig {
+	ret := c.clone()
+	ret.listeners = append(slices.Clip(c.listeners), &wasiListener{l: l})
+	return ret
+}
+
+// WithTrace makes the instances write a line to w for every WASI call, with
+// its decoded arguments, errno and duration, like strace:
 //
-// Note: This is similar to `writev` in POSIX. https://linux.die.net/man/3/writev
+//	fd_write(fd=1, iovs=[6 7], nwritten=13) = ESUCCESS <4.2µs>
 //
-// See fdRead
-// https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#ciovec
-// and https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_write
-func (f *wasiFdWrite) Call(fd int32, iovsPtr int32, iovsLen int32, nwrittenPtr int32) (err int32) {
-	// fd          => file_descriptor - 1 for stdout
-	// iovsPtr     => *iovs - The pointer to the iov array, which is stored at memory location 0
-	// iovsLen     => iovs_len - We're printing 1 string stored in an iov - so one.
-	// nwrittenPtr => nwritten - A place in memory to store the number of bytes written
-	if fd != 1 {
-		panic(fmt.Errorf("invalid file descriptor: %d", fd))
-	}
-
-	mem := f.vm.Store.Memory
-	var nwritten uint32
-	for i := int32(0); i < iovsLen; i++ {
-		iovPtr := iovsPtr + i*8 // Size 8
-		offset := binary.LittleEndian.Uint32(mem[iovPtr:])
-		l := binary.LittleEndian.Uint32(mem[iovPtr+4:])
-		n, err := os.Stdout.Write(mem[offset : offset+l])
-		if err != nil {
-			panic(err)
+// The results written to memory are only shown for successful calls. w is
+// shared by the instances, so it must be safe for concurrent use if they are
+// used concurrently. A nil w disables tracing.
+func (c *WASIConfig) WithTrace(w io.Writer) *WASIConfig {
+	ret := c.clone()
+	ret.tracer = nil
+	if w != nil {
+		ret.tracer = &wasiTracer{w: w}
+	}
+	return ret
+}
+
+// WithTraceLogger is like WithTrace but logs every WASI call to l at
+// slog.LevelDebug, with the name of the function as the message, and the
+// arguments, "errno" and "duration" as attributes.
+func (c *WASIConfig) WithTraceLogger(l *slog.Logger) *WASIConfig {
+	ret := c.clone()
+	ret.tracer = nil
+	if l != nil {
+		ret.tracer = &wasiTracer{logger: l}
+	}
+	return ret
+}
+
+func (c *WASIConfig) clone() *WASIConfig {
+	ret := *c
+	ret.env = maps.Clone(c.env)
+	if ret.env == nil {
+		ret.env = map[string]string{}
+	}
+	return &ret
+}
+
+// environ returns the environment as key=value strings sorted by key.
+func (c *WASIConfig) environ() []string {
+	keys := make([]string, 0, len(c.env))
+	for k := range c.env {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	environ := make([]string, len(keys))
+	for i, k := range keys {
+		environ[i] = k + "=" + c.env[k]
+	}
+	return environ
+}
+
+func (c *WASIConfig) validate() error {
+	for _, arg := range c.args {
+		if strings.IndexByte(arg, 0) >= 0 {
+			return fmt.Errorf("wasi: argument contains NUL: %q", arg)
+		}
+	}
+	for k, v := range c.env {
+		if k == "" || strings.ContainsAny(k, "=\x00") || strings.IndexByte(v, 0) >= 0 {
+			return fmt.Errorf("wasi: invalid environment variable: %q", k)
+		}
+	}
+	for _, p := range c.preopens {
+		if p.guestPath == "" || strings.IndexByte(p.guestPath, 0) >= 0 {
+			return fmt.Errorf("wasi: invalid preopen path: %q", p.guestPath)
+		}
+	}
+	return nil
+}
+
+// wasiState is the WASI state of an instance.
+type wasiState struct {
+	config *WASIConfig
+	// args and environ are the strings of args_get and environ_get.
+	args, environ []string
+	// fds are the open file descriptors.
+	fds map[uint32]*wasiFD
+	// initial are the file descriptors from 0 open on instantiation, and
+	// preopened their copies in fds, reused on reset.
+	initial, preopened []wasiFD
+}
+
+// wasiFD is an open file descriptor. reader and writer are nil unless it
+// is open for reading and writing respectively.
+type wasiFD struct {
+	reader io.Reader
+	writer io.Writer
+
+	// fsys and path locate the files and directories opened by path_open or
+	// preopened. file is the open file, or nil for directories.
+	fsys FileSystem
+	path string
+	file fs.File
+	// preopen is the guest path of a preopened directory.
+	preopen string
+	// flags are the fdflags the file was opened with.
+	flags uint16
+	// dirents are the entries of a directory, read by fd_readdir at the cookie 0.
+	dirents []fs.DirEntry
+
+	// conn is the connection of a socket accepted by sock_accept, and
+	// accepter the listener of a preopened socket.
+	conn     net.Conn
+	accepter *accepter
+}
+
+func (f *wasiFD) isDir() bool {
+	return f.fsys != nil && f.file == nil
+}
+
+func (f *wasiFD) isSocket() bool {
+	return f.conn != nil || f.accepter != nil
+}
+
+// close closes the file or connection of f and stops reading it ahead. The
+// standard streams and the preopened sockets stay open.
+func (f *wasiFD) close() error {
+	if r, ok := f.reader.(*asyncReader); ok {
+		r.close()
+	}
+	switch {
+	case f.file != nil:
+		return f.file.Close()
+	case f.conn != nil:
+		return f.conn.Close()
+	case f.accepter != nil:
+		f.accepter.close()
+	}
+	return nil
+}
+
+func newWASIState(config *WASIConfig) (*wasiState, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	s := &wasiState{
+		config:  config,
+		args:    config.args,
+		environ: config.environ(),
+		initial: stdioFDs(config.stdin, config.stdout, config.stderr),
+	}
+	for _, p := range config.preopens {
+		s.initial = append(s.initial, wasiFD{fsys: p.fsys, path: ".", preopen: p.guestPath})
+	}
+	for _, l := range config.listeners {
+		s.initial = append(s.initial, wasiFD{accepter: &accepter{l: l}})
+	}
+	s.preopened = make([]wasiFD, len(s.initial))
+	s.fds = make(map[uint32]*wasiFD, len(s.initial))
+	s.reset()
+	return s, nil
+}
+
+func stdioFDs(stdin io.Reader, stdout, stderr io.Writer) []wasiFD {
+	return []wasiFD{
+		// Hide the io.ReaderAt of stdin, which is a stream.
+		{reader: struct{ io.Reader }{stdin}},
+		{writer: stdout},
+		{writer: stderr},
+	}
+}
+
+// setStdio connects the file descriptors 0, 1 and 2 to stdin, stdout and
+// stderr until the next reset. It must be called right after a reset.
+func (s *wasiState) setStdio(stdin io.Reader, stdout, stderr io.Writer) {
+	copy(s.preopened, stdioFDs(stdin, stdout, stderr))
+}
+
+// reset closes the files and sockets opened by the guest, and reopens the
+// standard streams, the preopened directories and the preopened sockets.
+func (s *wasiState) reset() {
+	for _, f := range s.fds {
+		f.close()
+	}
+	clear(s.fds)
+	for i := range s.initial {
+		s.preopened[i] = s.initial[i]
+		s.fds[uint32(i)] = &s.preopened[i]
+	}
+}
+
+// open adds f to the file descriptors and returns the lowest one free.
+func (s *wasiState) open(f *wasiFD) uint32 {
+	fd := uint32(3)
+	for s.fds[fd] != nil {
+		fd++
+	}
+	s.fds[fd] = f
+	return fd
+}
+
+// reader returns the reader of fd, or false if fd isn't open for reading.
+func (s *wasiState) reader(fd uint32) (io.Reader, bool) {
+	f, ok := s.fds[fd]
+	if !ok || f.reader == nil {
+		return nil, false
+	}
+	return f.reader, true
+}
+
+// writer returns the writer of fd, or false if fd isn't open for writing.
+func (s *wasiState) writer(fd uint32) (io.Writer, bool) {
+	f, ok := s.fds[fd]
+	if !ok || f.writer == nil {
+		return nil, false
+	}
+	return f.writer, true
+}
+
+// wasiErrno returns the errno for the error of an I/O operation.
+func wasiErrno(err error) uint64 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if ret, ok := errnos[errno]; ok {
+			return ret
 		}
-		nwritten += uint32(n)
 	}
-	binary.LittleEndian.PutUint32(mem[nwrittenPtr:], nwritten)
-	return 0
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errnoNoent
+	case errors.Is(err, fs.ErrExist):
+		return errnoExist
+	case errors.Is(err, fs.ErrPermission):
+		return errnoPerm
+	case errors.Is(err, fs.ErrInvalid):
+		return errnoInval
+	}
+	return errnoIo
+}
+
+// wasiFunction is a WASI function of the type sig, in the format of
+// wasm.FunctionType.String. fn is called with the parameters and returns the
+// result, an errno for most functions. params names the parameters for
+// tracing, in the format of parseTraceParams.
+type wasiFunction struct {
+	sig    string
+	fn     func(vm *VM, params []uint64) uint64
+	params string
+}
+
+// wasiFunctions are the WASI functions by import name.
+var wasiFunctions = map[string]wasiFunction{
+	"args_get":              {"i32i32_i32", wasiArgsGet, "argv argv_buf"},
+	"args_sizes_get":        {"i32i32_i32", wasiArgsSizesGet, "*argc *argv_buf_size"},
+	"clock_res_get":         {"i32i32_i32", wasiClockResGet, "id:clockid *resolution:u64"},
+	"clock_time_get":        {"i32i64i32_i32", wasiClockTimeGet, "id:clockid precision *timestamp:u64"},
+	"environ_get":           {"i32i32_i32", wasiEnvironGet, "environ environ_buf"},
+	"environ_sizes_get":     {"i32i32_i32", wasiEnvironSizesGet, "*environc *environ_buf_size"},
+	"fd_close":              {"i32_i32", wasiFdClose, "fd"},
+	"fd_datasync":           {"i32_i32", wasiFdSync, "fd"},
+	"fd_fdstat_get":         {"i32i32_i32", wasiFdFdstatGet, "fd stat"},
+	"fd_filestat_get":       {"i32i32_i32", wasiFdFilestatGet, "fd buf"},
+	"fd_pread":              {"i32i32i32i64i32_i32", wasiFdPread, "fd iovs:iovs offset *nread"},
+	"fd_prestat_dir_name":   {"i32i32i32_i32", wasiFdPrestatDirName, "fd path path_len"},
+	"fd_prestat_get":        {"i32i32_i32", wasiFdPrestatGet, "fd prestat"},
+	"fd_pwrite":             {"i32i32i32i64i32_i32", wasiFdPwrite, "fd iovs:iovs offset *nwritten"},
+	"fd_read":               {"i32i32i32i32_i32", wasiFdRead, "fd iovs:iovs *nread"},
+	"fd_readdir":            {"i32i32i32i64i32_i32", wasiFdReaddir, "fd buf buf_len cookie *bufused"},
+	"fd_seek":               {"i32i64i32i32_i32", wasiFdSeek, "fd offset:int whence:whence *newoffset:u64"},
+	"fd_sync":               {"i32_i32", wasiFdSync, "fd"},
+	"fd_tell":               {"i32i32_i32", wasiFdTell, "fd *offset:u64"},
+	"fd_write":              {"i32i32i32i32_i32", wasiFdWrite, "fd iovs:iovs *nwritten"},
+	"path_create_directory": {"i32i32i32_i32", wasiPathCreateDirectory, "fd path:path"},
+	"path_filestat_get":     {"i32i32i32i32i32_i32", wasiPathFilestatGet, "fd flags:lookupflags path:path buf"},
+	"path_open":             {"i32i32i32i32i32i64i64i32i32_i32", wasiPathOpen, "fd dirflags:lookupflags path:path oflags:oflags fs_rights_base:rights fs_rights_inheriting:rights fdflags:fdflags *opened_fd"},
+	"path_remove_directory": {"i32i32i32_i32", wasiPathRemoveDirectory, "fd path:path"},
+	"path_rename":           {"i32i32i32i32i32i32_i32", wasiPathRename, "fd old_path:path new_fd new_path:path"},
+	"path_unlink_file":      {"i32i32i32_i32", wasiPathUnlinkFile, "fd path:path"},
+	"poll_oneoff":           {"i32i32i32i32_i32", wasiPollOneoff, "in out nsubscriptions *nevents"},
+	"proc_exit":             {"i32_v", wasiProcExit, "rval"},
+	"random_get":            {"i32i32_i32", wasiRandomGet, "buf buf_len"},
+	"sched_yield":           {"v_i32", wasiSchedYield, ""},
+	"sock_accept":           {"i32i32i32_i32", wasiSockAccept, "fd flags:fdflags *new_fd"},
+	"sock_recv":             {"i32i32i32i32i32i32_i32", wasiSockRecv, "fd ri_data:iovs ri_flags:riflags *ro_datalen *ro_flags:u16"},
+	"sock_send":             {"i32i32i32i32i32_i32", wasiSockSend, "fd si_data:iovs si_flags *so_datalen"},
+	"sock_shutdown":         {"i32i32_i32", wasiSockShutdown, "fd how:sdflags"},
+}
+
+// newWASIFunction returns the host function implementing the WASI function
+// imported as name with type ft, traced by tracer unless it is nil.
+func newWASIFunction(name string, ft *wasm.FunctionType, tracer *wasiTracer) (*HostFunction, error) {
+	f, ok := wasiFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown import: %s.%s", wasiPreview1, name)
+	}
+	if ft.String() != f.sig {
+		return nil, fmt.Errorf("import %s.%s: type mismatch: %s", wasiPreview1, name, ft)
+	}
+	hf := &HostFunction{
+		FunctionType: ft,
+		Module:       wasiPreview1,
+		Name:         name,
+		fn:           f.fn,
+	}
+	if tracer != nil {
+		hf.trace = tracer.hook(name, parseTraceParams(f.params), hf.HasResult())
+	}
+	return hf, nil
+}
+
+// wasiMemory returns the memory WASI functions read their arguments from and
+// write their results to. Without a memory, every access is out of range.
+func (vm *VM) wasiMemory() *MemoryInstance {
+	if vm.Store.Memory == nil {
+		return &MemoryInstance{}
+	}
+	return vm.Store.Memory
 }
@@ -0,0 +1,74 @@
+package vm
+
+// wasiArgsGet is the WASI function args_get, which writes the command-line
+// arguments as null-terminated strings to argvBuf, and pointers to them to
+// argv. The sizes of both are returned by args_sizes_get.
+//
+// For example, with the arguments "a" and "bc", argv=7 and argvBuf=1, this
+// function writes:
+//
+//	               argvBuf                argv
+//	          +----------------+  +------------------+
+//	          |                |  |                  |
+//	[]byte{?, 'a', 0, 'b', 'c', 0, ?, 1, 0, 0, 0, 3, 0, 0, 0, ?}
+//
+// The return value is 0 except when argv or argvBuf point to an offset out
+// of memory, for which it is EFAULT.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#args_get
+func wasiArgsGet(vm *VM, params []uint64) uint64 {
+	return writeStrings(vm.wasiMemory(), vm.wasi.args, uint32(params[0]), uint32(params[1]))
+}
+
+// wasiArgsSizesGet is the WASI function args_sizes_get, which writes the
+// number of command-line arguments at resultArgc, and the size of the
+// buffer args_get needs for them at resultArgvBufSize.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#args_sizes_get
+func wasiArgsSizesGet(vm *VM, params []uint64) uint64 {
+	return writeStringSizes(vm.wasiMemory(), vm.wasi.args, uint32(params[0]), uint32(params[1]))
+}
+
+// wasiEnvironGet is the WASI function environ_get, which is like args_get
+// for the environment variables, as key=value strings.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#environ_get
+func wasiEnvironGet(vm *VM, params []uint64) uint64 {
+	return writeStrings(vm.wasiMemory(), vm.wasi.environ, uint32(params[0]), uint32(params[1]))
+}
+
+// wasiEnvironSizesGet is the WASI function environ_sizes_get, which is like
+// args_sizes_get for the environment variables.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#environ_sizes_get
+func wasiEnvironSizesGet(vm *VM, params []uint64) uint64 {
+	return writeStringSizes(vm.wasiMemory(), vm.wasi.environ, uint32(params[0]), uint32(params[1]))
+}
+
+// writeStrings writes strs as null-terminated strings to buf, and pointers
+// to them to ptrs.
+func writeStrings(mem *MemoryInstance, strs []string, ptrs, buf uint32) uint64 {
+	for i, s := range strs {
+		if !mem.WriteUint32Le(ptrs+uint32(i)*4, buf) {
+			return errnoFault
+		}
+		if !mem.Write(buf, append([]byte(s), 0)) {
+			return errnoFault
+		}
+		buf += uint32(len(s)) + 1
+	}
+	return errnoSuccess
+}
+
+// writeStringSizes writes the number of strs at resultCount, and their size
+// as null-terminated strings at resultSize.
+func writeStringSizes(mem *MemoryInstance, strs []string, resultCount, resultSize uint32) uint64 {
+	size := uint32(0)
+	for _, s := range strs {
+		size += uint32(len(s)) + 1
+	}
+	if !mem.WriteUint32Le(resultCount, uint32(len(strs))) || !mem.WriteUint32Le(resultSize, size) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWASIArgsAndEnviron(t *testing.T) {
+	config := NewWASIConfig().WithArgs("a", "bc").WithEnv("B", "2").WithEnv("A", "1")
+	w := newWASITest(t, config, "args_sizes_get", "args_get", "environ_sizes_get", "environ_get")
+
+	tests := []struct {
+		sizes, get string
+		want       []string
+	}{
+		{"args_sizes_get", "args_get", []string{"a", "bc"}},
+		// The environment is sorted by key.
+		{"environ_sizes_get", "environ_get", []string{"A=1", "B=2"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.get, func(t *testing.T) {
+			if errno := w.call(tc.sizes, 0, 4); errno != errnoSuccess {
+				t.Fatalf("%s = %d", tc.sizes, errno)
+			}
+			size := len(strings.Join(tc.want, "\x00")) + 1
+			if count, bufSize := w.readU32(0), w.readU32(4); count != uint32(len(tc.want)) || bufSize != uint32(size) {
+				t.Errorf("%s = %d, %d, want %d, %d", tc.sizes, count, bufSize, len(tc.want), size)
+			}
+
+			// The pointers at 100 point into the buffer at 200.
+			if errno := w.call(tc.get, 100, 200); errno != errnoSuccess {
+				t.Fatalf("%s = %d", tc.get, errno)
+			}
+			if got := w.read(200, uint32(size)); got != strings.Join(tc.want, "\x00")+"\x00" {
+				t.Errorf("buffer = %q", got)
+			}
+			ptr := uint32(200)
+			for i, s := range tc.want {
+				if got := w.readU32(100 + uint32(i)*4); got != ptr {
+					t.Errorf("pointer %d = %d, want %d", i, got, ptr)
+				}
+				ptr += uint32(len(s)) + 1
+			}
+
+			memSize := uint64(w.mem.Size())
+			for _, params := range [][]uint64{{memSize - 2, 4}, {0, memSize - 2}} {
+				if errno := w.call(tc.sizes, params...); errno != errnoFault {
+					t.Errorf("%s%v = %d, want EFAULT", tc.sizes, params, errno)
+				}
+			}
+			for _, params := range [][]uint64{{memSize - 2, 200}, {100, memSize - 2}} {
+				if errno := w.call(tc.get, params...); errno != errnoFault {
+					t.Errorf("%s%v = %d, want EFAULT", tc.get, params, errno)
+				}
+			}
+		})
+	}
+}
+
+func TestWASIConfigInvalid(t *testing.T) {
+	tests := []struct {
+		config *WASIConfig
+		err    string
+	}{
+		{NewWASIConfig().WithArgs("a\x00b"), "wasi: argument contains NUL"},
+		{NewWASIConfig().WithEnv("A=B", "1"), "wasi: invalid environment variable"},
+		{NewWASIConfig().WithEnv("", "1"), "wasi: invalid environment variable"},
+		{NewWASIConfig().WithEnv("A", "\x00"), "wasi: invalid environment variable"},
+	}
+	for _, tc := range tests {
+		compiled, err := CompileBinary(wasiTestModule("args_get").binary(), NewConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = InstantiateCompiledModule(compiled, NewConfig().WithWASI(tc.config))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("InstantiateCompiledModule() = %v, want %q", err, tc.err)
+		}
+	}
+}
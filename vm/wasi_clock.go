@@ -0,0 +1,140 @@
+package vm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the source of the WASI clocks. Implementations must be safe for
+// concurrent use, as instances share the Clock of their WASIConfig.
+type Clock interface {
+	// Walltime returns the current time, read by the realtime clock.
+	Walltime() time.Time
+	// Nanotime returns the nanoseconds elapsed since an arbitrary point, read
+	// by the monotonic clock. It must never decrease.
+	Nanotime() int64
+	// Timer returns a channel receiving a value once d has elapsed, or at
+	// least both clocks have advanced by d, when the guest waits with
+	// poll_oneoff, and a function stopping the timer if the wait ends first.
+	Timer(d time.Duration) (<-chan time.Time, func())
+}
+
+// Clock IDs of clock_time_get and clock_res_get.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#clockid
+const (
+	clockRealtime  = 0
+	clockMonotonic = 1
+)
+
+// Resolutions of the clocks, in nanoseconds.
+const (
+	realtimeResolution  = uint64(time.Microsecond)
+	monotonicResolution = uint64(time.Nanosecond)
+)
+
+// systemClock reads the clocks of the host.
+type systemClock struct{}
+
+// epoch is the point the monotonic clock of systemClock counts from.
+var epoch = time.Now()
+
+func (systemClock) Walltime() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Nanotime() int64 {
+	return int64(time.Since(epoch))
+}
+
+func (systemClock) Timer(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }
+}
+
+// fakeClock is a deterministic Clock for tests and replays.
+type fakeClock struct {
+	start time.Time
+	step  time.Duration
+	// readings is the number of readings of either clock.
+	readings atomic.Int64
+	// slept is the sum of the durations of the timers.
+	slept atomic.Int64
+}
+
+// NewFakeClock returns a deterministic Clock, whose realtime clock starts at
+// start and monotonic clock at 0. Both advance by step on every reading of
+// either, so a zero step makes a fixed clock, and by the duration of the
+// timers, which fire immediately.
+func NewFakeClock(start time.Time, step time.Duration) Clock {
+	return &fakeClock{start: start, step: step}
+}
+
+func (c *fakeClock) Walltime() time.Time {
+	return c.start.Add(c.elapsed())
+}
+
+func (c *fakeClock) Nanotime() int64 {
+	return int64(c.elapsed())
+}
+
+func (c *fakeClock) Timer(d time.Duration) (<-chan time.Time, func()) {
+	c.slept.Add(int64(d))
+	ch := make(chan time.Time, 1)
+	ch <- c.Walltime()
+	return ch, func() {}
+}
+
+func (c *fakeClock) elapsed() time.Duration {
+	return time.Duration(c.readings.Add(1)-1)*c.step + time.Duration(c.slept.Load())
+}
+
+// wasiClockResGet is the WASI function clock_res_get, which writes the
+// resolution of the clock id in nanoseconds at resultResolution.
+//
+// The return value is 0 except the following error conditions:
+//   - EINVAL: `id` isn't the realtime or monotonic clock
+//   - EFAULT: `resultResolution` points to an offset out of memory
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#clock_res_get
+func wasiClockResGet(vm *VM, params []uint64) uint64 {
+	id, resultResolution := uint32(params[0]), uint32(params[1])
+	var res uint64
+	switch id {
+	case clockRealtime:
+		res = realtimeResolution
+	case clockMonotonic:
+		res = monotonicResolution
+	default:
+		return errnoInval
+	}
+	if !vm.wasiMemory().WriteUint64Le(resultResolution, res) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiClockTimeGet is the WASI function clock_time_get, which writes the time
+// of the clock id in nanoseconds at resultTimestamp. The realtime clock
+// counts from the Unix epoch. The precision is ignored.
+//
+// The return value is 0 except the following error conditions:
+//   - EINVAL: `id` isn't the realtime or monotonic clock
+//   - EFAULT: `resultTimestamp` points to an offset out of memory
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#clock_time_get
+func wasiClockTimeGet(vm *VM, params []uint64) uint64 {
+	id, resultTimestamp := uint32(params[0]), uint32(params[2])
+	var t uint64
+	switch id {
+	case clockRealtime:
+		t = uint64(vm.wasi.config.clock.Walltime().UnixNano())
+	case clockMonotonic:
+		t = uint64(vm.wasi.config.clock.Nanotime())
+	default:
+		return errnoInval
+	}
+	if !vm.wasiMemory().WriteUint64Le(resultTimestamp, t) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWASIClocks(t *testing.T) {
+	start := time.Unix(1000, 0)
+	config := NewWASIConfig().WithClock(NewFakeClock(start, time.Millisecond))
+	w := newWASITest(t, config, "clock_time_get", "clock_res_get")
+
+	// Both clocks advance by a step on every reading of either.
+	tests := []struct {
+		id   uint64
+		want uint64
+	}{
+		{clockRealtime, uint64(start.UnixNano())},
+		{clockMonotonic, uint64(time.Millisecond)},
+		{clockRealtime, uint64(start.Add(2 * time.Millisecond).UnixNano())},
+		{clockMonotonic, uint64(3 * time.Millisecond)},
+	}
+	for _, tc := range tests {
+		if errno := w.call("clock_time_get", tc.id, 1, 8); errno != errnoSuccess {
+			t.Fatalf("clock_time_get(%d) = %d", tc.id, errno)
+		}
+		if got, _ := w.mem.ReadUint64Le(8); got != tc.want {
+			t.Errorf("clock_time_get(%d) = %d, want %d", tc.id, got, tc.want)
+		}
+	}
+	for id, want := range []uint64{realtimeResolution, monotonicResolution} {
+		if errno := w.call("clock_res_get", uint64(id), 8); errno != errnoSuccess {
+			t.Fatalf("clock_res_get(%d) = %d", id, errno)
+		}
+		if got, _ := w.mem.ReadUint64Le(8); got != want {
+			t.Errorf("clock_res_get(%d) = %d, want %d", id, got, want)
+		}
+	}
+
+	memSize := uint64(w.mem.Size())
+	errTests := []struct {
+		fn     string
+		params []uint64
+		want   uint64
+	}{
+		{"clock_time_get", []uint64{2, 1, 8}, errnoInval},
+		{"clock_time_get", []uint64{clockRealtime, 1, memSize - 4}, errnoFault},
+		{"clock_res_get", []uint64{3, 8}, errnoInval},
+		{"clock_res_get", []uint64{clockMonotonic, memSize - 4}, errnoFault},
+	}
+	for _, tc := range errTests {
+		if errno := w.call(tc.fn, tc.params...); errno != tc.want {
+			t.Errorf("%s%v = %d, want %d", tc.fn, tc.params, errno, tc.want)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package vm
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"time"
+)
+
+// wasiFdRead is the WASI function fd_read, which reads from a file
+// descriptor into the buffers of iovs, scattering the data like fd_write
+// gathers it. It stops at the end of the file or after a short read, and
+// writes the number of bytes read at resultNread. Connections are read like
+// sock_recv does without riflags.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid or not open for reading
+//   - EAGAIN: `fd` is a connection with the nonblock fdflag and no data is
+//     ready
+//   - EFAULT: `iovs` or `resultNread` point to an offset out of memory
+//   - EIO: the reader of `fd` failed
+//
+// Note: This is similar to `readv` in POSIX. https://linux.die.net/man/3/readv
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_read
+func wasiFdRead(vm *VM, params []uint64) uint64 {
+	fd, iovs, iovsCount, resultNread := uint32(params[0]), uint32(params[1]), uint32(params[2]), uint32(params[3])
+	r, ok := vm.wasi.reader(fd)
+	if !ok {
+		return errnoBadf
+	}
+	read := r.Read
+	if f := vm.wasi.fds[fd]; f.conn != nil {
+		read = vm.connRead(f)
+	}
+	return readIovs(vm.wasiMemory(), iovs, iovsCount, resultNread, read)
+}
+
+// wasiFdPread is the WASI function fd_pread, which is like fd_read but reads
+// from the given offset of the file, and doesn't update the position of fd.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid or not open for reading
+//   - EFAULT: `iovs` or `resultNread` point to an offset out of memory
+//   - ESPIPE: `fd` is a stream, like stdin
+//   - EINVAL: `offset` is negative
+//   - EIO: the reader of `fd` failed
+//
+// Note: This is similar to `preadv` in POSIX. https://linux.die.net/man/2/preadv
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_pread
+func wasiFdPread(vm *VM, params []uint64) uint64 {
+	fd, iovs, iovsCount, offset, resultNread := uint32(params[0]), uint32(params[1]), uint32(params[2]), int64(params[3]), uint32(params[4])
+	r, ok := vm.wasi.reader(fd)
+	if !ok {
+		return errnoBadf
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return errnoSpipe
+	}
+	if offset < 0 {
+		return errnoInval
+	}
+	return readIovs(vm.wasiMemory(), iovs, iovsCount, resultNread, func(buf []byte) (int, error) {
+		n, err := ra.ReadAt(buf, offset)
+		offset += int64(n)
+		if err == nil && n < len(buf) {
+			err = io.EOF
+		}
+		return n, err
+	})
+}
+
+// readIovs reads with read into the buffers of iovs until the end of the
+// file or a short read, and writes the number of bytes read at resultNread.
+func readIovs(mem *MemoryInstance, iovs, iovsCount, resultNread uint32, read func([]byte) (int, error)) uint64 {
+	if uint64(iovs)+uint64(iovsCount)*8 > math.MaxUint32 {
+		return errnoFault
+	}
+	var nread uint32
+	for i := uint32(0); i < iovsCount; i++ {
+		offset, ok1 := mem.ReadUint32Le(iovs + i*8)
+		l, ok2 := mem.ReadUint32Le(iovs + i*8 + 4)
+		if !ok1 || !ok2 {
+			return errnoFault
+		}
+		buf, ok := mem.Read(offset, l)
+		if !ok {
+			return errnoFault
+		}
+		n, err := read(buf)
+		mem.markDirty(uint64(offset), uint64(n))
+		nread += uint32(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return wasiErrno(err)
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	if !mem.WriteUint32Le(resultNread, nread) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiFdWrite is the WASI function fd_write, which writes to a file
+// descriptor.
+//
+// # Parameters
+//
+//   - fd: an opened file descriptor to write data to
+//   - iovs: offset in memory to read offset, size pairs representing the
+//     data to write to `fd`
+//   - Both offset and length are encoded as uint32le.
+//   - iovsCount: count of memory offset, size pairs to read sequentially
+//     starting at iovs
+//   - resultNwritten: offset in memory to write the number of bytes
+//     written
+//
+// Result (Errno)
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid or not open for writing
+//   - EFAULT: `iovs` or `resultNwritten` point to an offset out of memory
+//   - EIO: the writer of `fd` failed
+//
+// For example, this function needs to first read `iovs` to determine what to
+// write to `fd`. If parameters iovs=1 iovsCount=2, this function reads two
+// offset/length pairs from memory:
+//
+//	                  iovs[0]                  iovs[1]
+//	          +---------------------+   +--------------------+
+//	          | uint32le    uint32le|   |uint32le    uint32le|
+//	          +---------+  +--------+   +--------+  +--------+
+//	          |         |  |        |   |        |  |        |
+//	[]byte{?, 18, 0, 0, 0, 4, 0, 0, 0, 23, 0, 0, 0, 2, 0, 0, 0, ?... }
+//	   iovs --^            ^            ^           ^
+//	          |            |            |           |
+//	 offset --+   length --+   offset --+  length --+
+//
+// This function reads those chunks memory into the `fd` sequentially.
+//
+//	                    iovs[0].length        iovs[1].length
+//	                   +--------------+       +----+
+//	                   |              |       |    |
+//	[]byte{ 0..16, ?, 'w', 'a', 'z', 'e', ?, 'r', 'o', ? }
+//	  iovs[0].offset --^                      ^
+//	                         iovs[1].offset --+
+//
+// Since "wazero" was written, if parameter resultNwritten=26, this function
+// writes the below to memory:
+//
+//	                   uint32le
+//	                  +--------+
+//	                  |        |
+//	[]byte{ 0..24, ?, 6, 0, 0, 0', ? }
+//	 resultNwritten --^
+//
+// Note: This is similar to `writev` in POSIX. https://linux.die.net/man/3/writev
+//
+// See wasiFdRead
+// https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#ciovec
+// and https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_write
+func wasiFdWrite(vm *VM, params []uint64) uint64 {
+	fd, iovs, iovsCount, resultNwritten := uint32(params[0]), uint32(params[1]), uint32(params[2]), uint32(params[3])
+	w, ok := vm.wasi.writer(fd)
+	if !ok {
+		return errnoBadf
+	}
+	return writeIovs(vm.wasiMemory(), iovs, iovsCount, resultNwritten, w.Write)
+}
+
+// writeIovs writes the buffers of iovs with write, and writes the number of
+// bytes written at resultNwritten.
+func writeIovs(mem *MemoryInstance, iovs, iovsCount, resultNwritten uint32, write func([]byte) (int, error)) uint64 {
+	if uint64(iovs)+uint64(iovsCount)*8 > math.MaxUint32 {
+		return errnoFault
+	}
+	var nwritten uint32
+	for i := uint32(0); i < iovsCount; i++ {
+		offset, ok1 := mem.ReadUint32Le(iovs + i*8)
+		l, ok2 := mem.ReadUint32Le(iovs + i*8 + 4)
+		if !ok1 || !ok2 {
+			return errnoFault
+		}
+		buf, ok := mem.Read(offset, l)
+		if !ok {
+			return errnoFault
+		}
+		n, err := write(buf)
+		nwritten += uint32(n)
+		if err != nil {
+			return wasiErrno(err)
+		}
+	}
+	if !mem.WriteUint32Le(resultNwritten, nwritten) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiFdPwrite is the WASI function fd_pwrite, which is like fd_write but
+// writes at the given offset of the file, and doesn't update the position of
+// fd.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid or not open for writing
+//   - EFAULT: `iovs` or `resultNwritten` point to an offset out of memory
+//   - ESPIPE: `fd` is a stream, like stdout
+//   - EINVAL: `offset` is negative
+//   - EIO: the writer of `fd` failed
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_pwrite
+func wasiFdPwrite(vm *VM, params []uint64) uint64 {
+	fd, iovs, iovsCount, offset, resultNwritten := uint32(params[0]), uint32(params[1]), uint32(params[2]), int64(params[3]), uint32(params[4])
+	w, ok := vm.wasi.writer(fd)
+	if !ok {
+		return errnoBadf
+	}
+	wa, ok := w.(io.WriterAt)
+	if !ok {
+		return errnoSpipe
+	}
+	if offset < 0 {
+		return errnoInval
+	}
+	return writeIovs(vm.wasiMemory(), iovs, iovsCount, resultNwritten, func(buf []byte) (int, error) {
+		n, err := wa.WriteAt(buf, offset)
+		offset += int64(n)
+		return n, err
+	})
+}
+
+// wasiFdClose is the WASI function fd_close, which closes the file
+// descriptor fd, or returns EBADF if it is invalid.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_close
+func wasiFdClose(vm *VM, params []uint64) uint64 {
+	fd := uint32(params[0])
+	f, ok := vm.wasi.fds[fd]
+	if !ok {
+		return errnoBadf
+	}
+	delete(vm.wasi.fds, fd)
+	if err := f.close(); err != nil {
+		return wasiErrno(err)
+	}
+	return errnoSuccess
+}
+
+// Whences of fd_seek.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#whence
+const (
+	whenceSet = 0
+	whenceCur = 1
+	whenceEnd = 2
+)
+
+// wasiFdSeek is the WASI function fd_seek, which moves the position of fd by
+// offset relative to whence, and writes the new position at resultNewoffset.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - EISDIR: `fd` is a directory
+//   - ESPIPE: `fd` is a stream, like stdin
+//   - EINVAL: `whence` is invalid, or the new position negative
+//   - EFAULT: `resultNewoffset` points to an offset out of memory
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_seek
+func wasiFdSeek(vm *VM, params []uint64) uint64 {
+	fd, offset, whence, resultNewoffset := uint32(params[0]), int64(params[1]), uint32(params[2]), uint32(params[3])
+	var w int
+	switch whence {
+	case whenceSet:
+		w = io.SeekStart
+	case whenceCur:
+		w = io.SeekCurrent
+	case whenceEnd:
+		w = io.SeekEnd
+	default:
+		return errnoInval
+	}
+	return seek(vm, fd, offset, w, resultNewoffset)
+}
+
+// wasiFdTell is the WASI function fd_tell, which writes the position of fd at
+// resultOffset. It fails like fd_seek.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_tell
+func wasiFdTell(vm *VM, params []uint64) uint64 {
+	return seek(vm, uint32(params[0]), 0, io.SeekCurrent, uint32(params[1]))
+}
+
+func seek(vm *VM, fd uint32, offset int64, whence int, resultNewoffset uint32) uint64 {
+	f, ok := vm.wasi.fds[fd]
+	if !ok {
+		return errnoBadf
+	}
+	if f.isDir() {
+		return errnoIsdir
+	}
+	s, ok := f.file.(io.Seeker)
+	if !ok {
+		return errnoSpipe
+	}
+	pos, err := s.Seek(offset, whence)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	if !vm.wasiMemory().WriteUint64Le(resultNewoffset, uint64(pos)) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiFdSync is the WASI function fd_sync, which flushes the data and
+// metadata of the file fd to the storage device, when the file supports it.
+// fd_datasync is the same.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_sync
+func wasiFdSync(vm *VM, params []uint64) uint64 {
+	f, ok := vm.wasi.fds[uint32(params[0])]
+	if !ok {
+		return errnoBadf
+	}
+	if s, ok := f.file.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return wasiErrno(err)
+		}
+	}
+	return errnoSuccess
+}
+
+// File types of fdstat, filestat and dirent.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#filetype
+const (
+	filetypeUnknown         = 0
+	filetypeCharacterDevice = 2
+	filetypeDirectory       = 3
+	filetypeRegularFile     = 4
+	filetypeSocketStream    = 6
+	filetypeSymbolicLink    = 7
+)
+
+// fdflags of path_open and sock_accept.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fdflags
+const (
+	fdflagsAppend   = 1 << 0
+	fdflagsNonblock = 1 << 2
+)
+
+// Rights of file descriptors. Rights aren't enforced, so all of them are
+// granted but seeking streams.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#rights
+const (
+	rightFdRead  = 1 << 1
+	rightFdSeek  = 1 << 2
+	rightFdTell  = 1 << 5
+	rightFdWrite = 1 << 6
+	rightsAll    = 1<<29 - 1
+)
+
+// wasiFdFdstatGet is the WASI function fd_fdstat_get, which writes the
+// fdstat of fd, its file type, flags and rights, at resultStat.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - EFAULT: `resultStat` points to an offset out of memory
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fdstat
+func wasiFdFdstatGet(vm *VM, params []uint64) uint64 {
+	fd, resultStat := uint32(params[0]), uint32(params[1])
+	f, ok := vm.wasi.fds[fd]
+	if !ok {
+		return errnoBadf
+	}
+
+	filetype, rights := byte(filetypeCharacterDevice), uint64(rightsAll&^(rightFdSeek|rightFdTell))
+	switch {
+	case f.isDir():
+		filetype, rights = filetypeDirectory, rightsAll
+	case f.file != nil:
+		filetype, rights = filetypeRegularFile, rightsAll
+	case f.isSocket():
+		filetype = filetypeSocketStream
+	}
+
+	stat := make([]byte, 24)
+	stat[0] = filetype
+	binary.LittleEndian.PutUint16(stat[2:], f.flags)
+	binary.LittleEndian.PutUint64(stat[8:], rights)
+	binary.LittleEndian.PutUint64(stat[16:], rightsAll)
+	if !vm.wasiMemory().Write(resultStat, stat) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiFdFilestatGet is the WASI function fd_filestat_get, which writes the
+// filestat of fd at resultBuf, like path_filestat_get.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_filestat_get
+func wasiFdFilestatGet(vm *VM, params []uint64) uint64 {
+	fd, resultBuf := uint32(params[0]), uint32(params[1])
+	f, ok := vm.wasi.fds[fd]
+	if !ok {
+		return errnoBadf
+	}
+
+	var info fs.FileInfo
+	var err error
+	switch {
+	case f.isDir():
+		info, err = f.fsys.Stat(f.path)
+	case f.file != nil:
+		info, err = f.file.Stat()
+	case f.isSocket():
+		return writeFilestat(vm.wasiMemory(), resultBuf, filetypeSocketStream, 0, time.Time{})
+	default:
+		// The standard streams have no file.
+		return writeFilestat(vm.wasiMemory(), resultBuf, filetypeCharacterDevice, 0, time.Time{})
+	}
+	if err != nil {
+		return wasiErrno(err)
+	}
+	return writeFilestat(vm.wasiMemory(), resultBuf, filetype(info.Mode()), uint64(info.Size()), info.ModTime())
+}
+
+// filetype returns the WASI file type of mode.
+func filetype(mode fs.FileMode) byte {
+	switch {
+	case mode.IsRegular():
+		return filetypeRegularFile
+	case mode.IsDir():
+		return filetypeDirectory
+	case mode&fs.ModeSymlink != 0:
+		return filetypeSymbolicLink
+	case mode&fs.ModeCharDevice != 0:
+		return filetypeCharacterDevice
+	case mode&fs.ModeSocket != 0:
+		return filetypeSocketStream
+	}
+	return filetypeUnknown
+}
+
+// writeFilestat writes a filestat at buf. Device and inode numbers aren't
+// reported, and all times are the modification time.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#filestat
+func writeFilestat(mem *MemoryInstance, buf uint32, filetype byte, size uint64, mtime time.Time) uint64 {
+	var ts uint64
+	if !mtime.IsZero() {
+		ts = uint64(mtime.UnixNano())
+	}
+	stat := make([]byte, 64)
+	stat[16] = filetype
+	binary.LittleEndian.PutUint64(stat[24:], 1) // nlink
+	binary.LittleEndian.PutUint64(stat[32:], size)
+	binary.LittleEndian.PutUint64(stat[40:], ts)
+	binary.LittleEndian.PutUint64(stat[48:], ts)
+	binary.LittleEndian.PutUint64(stat[56:], ts)
+	if !mem.Write(buf, stat) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiFdReaddir is the WASI function fd_readdir, which writes the entries of
+// the directory fd from the cookie on to buf, as dirent headers followed by
+// names. The cookie of an entry is its index, and the cookie 0 rereads the
+// directory. The last entry is truncated when buf is full, in which case
+// the size written to resultBufused is bufLen.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - ENOTDIR: `fd` isn't a directory
+//   - EFAULT: `buf` or `resultBufused` point to an offset out of memory
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_readdir
+func wasiFdReaddir(vm *VM, params []uint64) uint64 {
+	fd, buf, bufLen, cookie, resultBufused := uint32(params[0]), uint32(params[1]), uint32(params[2]), params[3], uint32(params[4])
+	f, ok := vm.wasi.fds[fd]
+	if !ok {
+		return errnoBadf
+	}
+	if !f.isDir() {
+		return errnoNotdir
+	}
+	if cookie == 0 || f.dirents == nil {
+		entries, err := readDir(f.fsys, f.path)
+		if err != nil {
+			return wasiErrno(err)
+		}
+		f.dirents = entries
+	}
+
+	var out []byte
+	for i := cookie; i < uint64(len(f.dirents)) && len(out) < int(bufLen); i++ {
+		e := f.dirents[i]
+		dirent := make([]byte, 24, 24+len(e.Name()))
+		binary.LittleEndian.PutUint64(dirent[0:], i+1)
+		binary.LittleEndian.PutUint32(dirent[16:], uint32(len(e.Name())))
+		dirent[20] = filetype(e.Type())
+		out = append(out, append(dirent, e.Name()...)...)
+	}
+	if len(out) > int(bufLen) {
+		out = out[:bufLen]
+	}
+
+	mem := vm.wasiMemory()
+	if !mem.Write(buf, out) || !mem.WriteUint32Le(resultBufused, uint32(len(out))) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiFdPrestatGet is the WASI function fd_prestat_get, which writes the
+// prestat of the preopened directory fd at resultPrestat: the tag 0 of
+// directories and the length of its name. It returns EBADF if fd isn't
+// preopened, which ends the enumeration of the preopens by the guest.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#prestat
+func wasiFdPrestatGet(vm *VM, params []uint64) uint64 {
+	fd, resultPrestat := uint32(params[0]), uint32(params[1])
+	f, ok := vm.wasi.fds[fd]
+	if !ok || f.preopen == "" {
+		return errnoBadf
+	}
+	mem := vm.wasiMemory()
+	if !mem.WriteUint32Le(resultPrestat, 0) || !mem.WriteUint32Le(resultPrestat+4, uint32(len(f.preopen))) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiFdPrestatDirName is the WASI function fd_prestat_dir_name, which
+// writes the name of the preopened directory fd to path. pathLen must be at
+// least the length returned by fd_prestat_get, or ENAMETOOLONG is returned.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#fd_prestat_dir_name
+func wasiFdPrestatDirName(vm *VM, params []uint64) uint64 {
+	fd, path, pathLen := uint32(params[0]), uint32(params[1]), uint32(params[2])
+	f, ok := vm.wasi.fds[fd]
+	if !ok || f.preopen == "" {
+		return errnoBadf
+	}
+	if pathLen < uint32(len(f.preopen)) {
+		return errnoNametoolong
+	}
+	if !vm.wasiMemory().Write(path, []byte(f.preopen)) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// errWriter fails every write with err.
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestWASIFdWrite(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	w := newWASITest(t, NewWASIConfig().WithStdout(&stdout).WithStderr(&stderr), "fd_write")
+	w.write(100, []byte("hello, world\n"))
+	// "hello" and ", world\n" in two iovecs.
+	w.iovs(0, [2]uint32{100, 5}, [2]uint32{105, 8})
+
+	for _, fd := range []uint64{1, 2} {
+		if errno := w.call("fd_write", fd, 0, 2, 16); errno != errnoSuccess {
+			t.Fatalf("fd_write(%d) = %d", fd, errno)
+		}
+		if n := w.readU32(16); n != 13 {
+			t.Errorf("nwritten = %d, want 13", n)
+		}
+	}
+	if stdout.String() != "hello, world\n" || stderr.String() != "hello, world\n" {
+		t.Errorf("stdout = %q, stderr = %q", stdout.String(), stderr.String())
+	}
+
+	memSize := uint64(w.mem.Size())
+	w.iovs(32, [2]uint32{uint32(memSize) - 2, 5})
+	tests := []struct {
+		name   string
+		params []uint64
+		want   uint64
+	}{
+		{"stdin", []uint64{0, 0, 2, 16}, errnoBadf},
+		{"closed fd", []uint64{99, 0, 2, 16}, errnoBadf},
+		{"iovs out of memory", []uint64{1, memSize - 4, 1, 16}, errnoFault},
+		{"iovs overflow", []uint64{1, 0xfffffff8, 2, 16}, errnoFault},
+		{"buffer out of memory", []uint64{1, 32, 1, 16}, errnoFault},
+		{"nwritten out of memory", []uint64{1, 0, 2, memSize - 2}, errnoFault},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if errno := w.call("fd_write", tc.params...); errno != tc.want {
+				t.Errorf("fd_write = %d, want %d", errno, tc.want)
+			}
+		})
+	}
+
+	// The errors of the writer are mapped to their errno, or EIO.
+	for _, tc := range []struct {
+		err  error
+		want uint64
+	}{
+		{syscall.EPIPE, errnoPipe},
+		{errors.New("broken"), errnoIo},
+	} {
+		w := newWASITest(t, NewWASIConfig().WithStdout(errWriter{tc.err}), "fd_write")
+		w.iovs(0, [2]uint32{100, 5})
+		if errno := w.call("fd_write", 1, 0, 1, 16); errno != tc.want {
+			t.Errorf("fd_write with %v = %d, want %d", tc.err, errno, tc.want)
+		}
+	}
+}
+
+// errReader fails every read with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestWASIFdRead(t *testing.T) {
+	w := newWASITest(t, NewWASIConfig().WithStdin(strings.NewReader("hello, world\n")), "fd_read", "fd_pread")
+	// Scatter into "hello" at 100 and the rest at 200.
+	w.iovs(0, [2]uint32{100, 5}, [2]uint32{200, 20})
+	if errno := w.call("fd_read", 0, 0, 2, 16); errno != errnoSuccess {
+		t.Fatalf("fd_read = %d", errno)
+	}
+	if n, got := w.readU32(16), w.read(100, 5)+w.read(200, 8); n != 13 || got != "hello, world\n" {
+		t.Errorf("fd_read read %d bytes %q, want 13", n, got)
+	}
+	// At the end of stdin, nothing is read.
+	if errno := w.call("fd_read", 0, 0, 2, 16); errno != errnoSuccess || w.readU32(16) != 0 {
+		t.Errorf("fd_read at EOF = %d, nread %d, want 0 bytes read", errno, w.readU32(16))
+	}
+
+	memSize := uint64(w.mem.Size())
+	w.iovs(32, [2]uint32{uint32(memSize) - 2, 5})
+	tests := []struct {
+		name   string
+		fn     string
+		params []uint64
+		want   uint64
+	}{
+		{"stdout", "fd_read", []uint64{1, 0, 2, 16}, errnoBadf},
+		{"closed fd", "fd_read", []uint64{99, 0, 2, 16}, errnoBadf},
+		{"iovs out of memory", "fd_read", []uint64{0, memSize - 4, 1, 16}, errnoFault},
+		{"iovs overflow", "fd_read", []uint64{0, 0xfffffff8, 2, 16}, errnoFault},
+		{"buffer out of memory", "fd_read", []uint64{0, 32, 1, 16}, errnoFault},
+		{"nread out of memory", "fd_read", []uint64{0, 0, 2, memSize}, errnoFault},
+		{"pread on stdin", "fd_pread", []uint64{0, 0, 2, 0, 16}, errnoSpipe},
+		{"pread on stdout", "fd_pread", []uint64{1, 0, 2, 0, 16}, errnoBadf},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if errno := w.call(tc.fn, tc.params...); errno != tc.want {
+				t.Errorf("%s = %d, want %d", tc.fn, errno, tc.want)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		err  error
+		want uint64
+	}{
+		{syscall.ECONNRESET, errnoConnreset},
+		{errors.New("broken"), errnoIo},
+	} {
+		w := newWASITest(t, NewWASIConfig().WithStdin(errReader{tc.err}), "fd_read")
+		w.iovs(0, [2]uint32{100, 5})
+		if errno := w.call("fd_read", 0, 0, 1, 16); errno != tc.want {
+			t.Errorf("fd_read with %v = %d, want %d", tc.err, errno, tc.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package vm
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// FileSystem is a file system the guest accesses through a preopened
+// directory. Names are slash-separated paths relative to the root of the
+// file system, valid per fs.ValidPath.
+//
+// The files returned by OpenFile implement io.Writer when open for writing,
+// and optionally io.Seeker, io.ReaderAt, io.WriterAt and fs.ReadDirFile.
+type FileSystem interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes the file or empty directory name.
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+// dirFS is the FileSystem of a host directory.
+type dirFS struct {
+	dir string
+}
+
+// DirFS returns the file system of the host directory dir. Paths can't
+// escape dir, neither with ".." nor through symbolic links.
+func DirFS(dir string) FileSystem {
+	return &dirFS{dir: dir}
+}
+
+// resolve returns the host path of name, following symbolic links but the
+// last element unless followLast. It fails if the path escapes the directory.
+func (d *dirFS) resolve(op, name string, followLast bool) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := filepath.EvalSymlinks(d.dir)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	p := filepath.Join(root, filepath.FromSlash(name))
+	if name == "." {
+		return p, nil
+	}
+
+	real, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	real = filepath.Join(real, filepath.Base(p))
+	if followLast {
+		if real, err = followSymlinks(real); err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return real, nil
+}
+
+// followSymlinks returns the path p resolves to, whose directory exists.
+// Unlike filepath.EvalSymlinks, it also resolves symbolic links to missing
+// files, which O_CREATE would create wherever they point to.
+func followSymlinks(p string) (string, error) {
+	for range 255 {
+		fi, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			return p, nil
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		dir, err := filepath.EvalSymlinks(filepath.Dir(target))
+		if err != nil {
+			return "", err
+		}
+		p = filepath.Join(dir, filepath.Base(target))
+	}
+	return "", syscall.ELOOP
+}
+
+func (d *dirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	p, err := d.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	// The path is resolved, so a symbolic link replacing it since was
+	// created to escape the directory.
+	return os.OpenFile(p, flag|oNofollow, perm)
+}
+
+func (d *dirFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d *dirFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := d.resolve("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (d *dirFS) Remove(name string) error {
+	p, err := d.resolve("remove", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d *dirFS) Rename(oldname, newname string) error {
+	oldpath, err := d.resolve("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	newpath, err := d.resolve("rename", newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// readOnlyFS is the FileSystem of an fs.FS, on which writes fail with EROFS.
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+// ReadOnlyFS returns a read-only file system of fsys.
+func ReadOnlyFS(fsys fs.FS) FileSystem {
+	return &readOnlyFS{fsys: fsys}
+}
+
+func (r *readOnlyFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+	}
+	return r.fsys.Open(name)
+}
+
+func (r *readOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(r.fsys, name)
+}
+
+func (r *readOnlyFS) Mkdir(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.EROFS}
+}
+
+func (r *readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: syscall.EROFS}
+}
+
+func (r *readOnlyFS) Rename(oldname, newname string) error {
+	return &fs.PathError{Op: "rename", Path: oldname, Err: syscall.EROFS}
+}
+
+// readDir returns the entries of the directory name of fsys, sorted by name.
+func readDir(fsys FileSystem, name string) ([]fs.DirEntry, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package vm
+
+// oNofollow is 0 where opening a symbolic link can't be made to fail.
+const oNofollow = 0
@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+// symlink creates a symbolic link, or skips the test where it can't.
+func symlink(t *testing.T, oldname, newname string) {
+	t.Helper()
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+}
+
+func TestDirFSSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	sbx, outside := filepath.Join(tmp, "sbx"), filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(sbx, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sbx, "file"), []byte("inside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, filepath.Join(outside, "pwned"), filepath.Join(sbx, "evil"))
+	symlink(t, "../outside/pwned2", filepath.Join(sbx, "evilrel"))
+	symlink(t, filepath.Join(outside, "pwned3"), filepath.Join(sbx, "evil3"))
+	symlink(t, "evil3", filepath.Join(sbx, "evilchain"))
+	symlink(t, "../outside/secret", filepath.Join(sbx, "secret"))
+	symlink(t, "../outside", filepath.Join(sbx, "dirlink"))
+	symlink(t, "file", filepath.Join(sbx, "link"))
+	symlink(t, "sub/created", filepath.Join(sbx, "create"))
+	symlink(t, "loop2", filepath.Join(sbx, "loop1"))
+	symlink(t, "loop1", filepath.Join(sbx, "loop2"))
+
+	fsys := DirFS(sbx)
+	tests := []struct {
+		name string
+		flag int
+		err  error
+	}{
+		// Dangling links out of the directory must not create their target.
+		{"evil", os.O_CREATE | os.O_WRONLY, fs.ErrPermission},
+		{"evilrel", os.O_CREATE | os.O_WRONLY, fs.ErrPermission},
+		{"evilchain", os.O_CREATE | os.O_WRONLY, fs.ErrPermission},
+		{"secret", os.O_RDONLY, fs.ErrPermission},
+		{"dirlink/secret", os.O_RDONLY, fs.ErrPermission},
+		{"../outside/secret", os.O_RDONLY, fs.ErrInvalid},
+		{"loop1", os.O_RDONLY, syscall.ELOOP},
+		{"link", os.O_RDONLY, nil},
+		{"create", os.O_CREATE | os.O_WRONLY, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := fsys.OpenFile(tc.name, tc.flag, 0o644)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("OpenFile() = %v, want %v", err, tc.err)
+			}
+			if f != nil {
+				f.Close()
+			}
+		})
+	}
+
+	for _, name := range []string{"pwned", "pwned2", "pwned3"} {
+		if _, err := os.Lstat(filepath.Join(outside, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s was created outside of the directory: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sbx, "sub", "created")); err != nil {
+		t.Errorf("the target of a link in the directory wasn't created: %v", err)
+	}
+	f, err := fsys.OpenFile("link", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, err := io.ReadAll(f); err != nil || string(b) != "inside" {
+		t.Errorf("read %q, %v through the link, want inside", b, err)
+	}
+}
+
+func TestWASIPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, filepath.Join(t.TempDir(), "pwned"), filepath.Join(root, "evil"))
+
+	config := NewWASIConfig().
+		WithPreopen("/", DirFS(root)).
+		WithPreopen("/ro", ReadOnlyFS(fstest.MapFS{"a": {Data: []byte("a")}}))
+	w := newWASITest(t, config, "path_open", "path_create_directory", "path_remove_directory",
+		"path_unlink_file", "path_rename", "path_filestat_get")
+	memSize := uint64(w.mem.Size())
+
+	open := func(fd uint64, path string, oflags, rights uint64) uint64 {
+		ptr, n := w.str(path)
+		return w.call("path_open", fd, 0, ptr, n, oflags, rights, rights, 0, 16)
+	}
+	call := func(fn string, fd uint64, path string) uint64 {
+		ptr, n := w.str(path)
+		return w.call(fn, fd, ptr, n)
+	}
+	tests := []struct {
+		name  string
+		errno func() uint64
+		want  uint64
+	}{
+		{"open", func() uint64 { return open(3, "file", 0, rightFdRead) }, errnoSuccess},
+		{"open escaping symlink", func() uint64 { return open(3, "evil", oflagsCreat, rightFdWrite) }, errnoPerm},
+		{"open missing", func() uint64 { return open(3, "missing", 0, rightFdRead) }, errnoNoent},
+		{"open dotdot", func() uint64 { return open(3, "dir/../../x", 0, rightFdRead) }, errnoNotcapable},
+		{"open absolute", func() uint64 { return open(3, "/file", 0, rightFdRead) }, errnoNotcapable},
+		{"open empty", func() uint64 { return open(3, "", 0, rightFdRead) }, errnoNoent},
+		{"open NUL", func() uint64 { return open(3, "fi\x00le", 0, rightFdRead) }, errnoInval},
+		{"open excl", func() uint64 { return open(3, "file", oflagsCreat|oflagsExcl, rightFdWrite) }, errnoExist},
+		{"open file as directory", func() uint64 { return open(3, "file", oflagsDirectory, 0) }, errnoNotdir},
+		{"open closed fd", func() uint64 { return open(99, "file", 0, rightFdRead) }, errnoBadf},
+		{"open in stdout", func() uint64 { return open(1, "file", 0, rightFdRead) }, errnoNotdir},
+		{"open read only", func() uint64 { return open(4, "a", oflagsCreat, rightFdWrite) }, errnoRofs},
+		{"open path out of memory", func() uint64 {
+			return w.call("path_open", 3, 0, memSize-2, 4, 0, rightFdRead, rightFdRead, 0, 16)
+		}, errnoFault},
+		{"open result out of memory", func() uint64 {
+			ptr, n := w.str("file")
+			return w.call("path_open", 3, 0, ptr, n, 0, rightFdRead, rightFdRead, 0, memSize-2)
+		}, errnoFault},
+		{"mkdir existing", func() uint64 { return call("path_create_directory", 3, "dir") }, errnoExist},
+		{"mkdir read only", func() uint64 { return call("path_create_directory", 4, "d") }, errnoRofs},
+		{"rmdir not empty", func() uint64 { return call("path_remove_directory", 3, "dir") }, errnoNotempty},
+		{"rmdir file", func() uint64 { return call("path_remove_directory", 3, "file") }, errnoNotdir},
+		{"rmdir preopen", func() uint64 { return call("path_remove_directory", 3, ".") }, errnoBusy},
+		{"unlink directory", func() uint64 { return call("path_unlink_file", 3, "dir") }, errnoIsdir},
+		{"unlink missing", func() uint64 { return call("path_unlink_file", 3, "missing") }, errnoNoent},
+		{"rename across preopens", func() uint64 {
+			w.write(1100, []byte("a"))
+			ptr, n := w.str("file")
+			return w.call("path_rename", 3, ptr, n, 4, 1100, 1)
+		}, errnoXdev},
+		{"filestat missing", func() uint64 {
+			ptr, n := w.str("missing")
+			return w.call("path_filestat_get", 3, 0, ptr, n, 100)
+		}, errnoNoent},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if errno := tc.errno(); errno != tc.want {
+				t.Errorf("errno = %d, want %d", errno, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build unix
+
+package vm
+
+import "syscall"
+
+// oNofollow makes opening a symbolic link fail.
+const oNofollow = syscall.O_NOFOLLOW
@@ -0,0 +1,602 @@
+package vm
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is a writable FileSystem held in memory, for guests that must not
+// access the disk. It can be seeded from a tar or zip archive with LoadTar and
+// LoadZip, and its content read after the run as an fs.FS or written to an
+// archive with WriteTar and WriteZip.
+//
+// A MemFS is safe for concurrent use, so it can be shared by instances. It
+// holds directories and regular files only.
+type MemFS struct {
+	mu   sync.Mutex
+	root *memNode
+	// size is the total size of the files, limited to maxSize unless it is 0.
+	size, maxSize int64
+}
+
+// memNode is a file or a directory of a MemFS.
+type memNode struct {
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+	// children are the entries of a directory by name.
+	children map[string]*memNode
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{root: newMemDir(0o755, time.Now())}
+}
+
+// SetMaxSize limits the total size of the files to n bytes, beyond which
+// writes fail with ENOSPC, or removes the limit if n is 0. Data written to
+// files removed while still open keeps counting toward the limit.
+func (m *MemFS) SetMaxSize(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxSize = n
+}
+
+// grow accounts for delta more bytes of file data. m.mu must be held.
+func (m *MemFS) grow(delta int64) error {
+	if delta > 0 && m.maxSize > 0 && m.size+delta > m.maxSize {
+		return syscall.ENOSPC
+	}
+	m.size += delta
+	return nil
+}
+
+func newMemDir(perm fs.FileMode, modTime time.Time) *memNode {
+	return &memNode{mode: fs.ModeDir | perm, modTime: modTime, children: map[string]*memNode{}}
+}
+
+// lookup returns the parent directory of name and the node of name, nil if
+// it doesn't exist. m.mu must be held.
+func (m *MemFS) lookup(op, name string) (*memNode, *memNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil, m.root, nil
+	}
+	dir := m.root
+	elems := strings.Split(name, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		dir = dir.children[elem]
+		if dir == nil {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if !dir.mode.IsDir() {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return dir, dir.children[elems[len(elems)-1]], nil
+}
+
+// OpenFile opens the file name like os.OpenFile.
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, n, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case n == nil && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case n == nil:
+		n = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		dir.children[path.Base(name)] = n
+		dir.modTime = n.modTime
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case n.mode.IsDir() && (write || flag&os.O_TRUNC != 0):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case flag&os.O_TRUNC != 0:
+		m.grow(-int64(len(n.data)))
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &memFile{fsys: m, node: n, name: name, flag: flag}, nil
+}
+
+// Open opens the file name for reading, which makes a MemFS an fs.FS.
+func (m *MemFS) Open(name string) (fs.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Stat returns the information of the file name.
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return n.info(path.Base(name)), nil
+}
+
+// Mkdir creates the directory name.
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, n, err := m.lookup("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	n = newMemDir(perm.Perm(), time.Now())
+	dir.children[path.Base(name)] = n
+	dir.modTime = n.modTime
+	return nil
+}
+
+// Remove removes the file or empty directory name.
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, n, err := m.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case n == nil:
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	case dir == nil:
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	case len(n.children) != 0:
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	m.grow(-int64(len(n.data)))
+	delete(dir.children, path.Base(name))
+	dir.modTime = time.Now()
+	return nil
+}
+
+// Rename renames the file or directory oldname to newname, replacing the
+// file or empty directory newname like os.Rename.
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldDir, n, err := m.lookup("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newDir, target, err := m.lookup("rename", newname)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	switch {
+	case n == nil:
+		return fail(fs.ErrNotExist)
+	case oldDir == nil || newDir == nil:
+		return fail(syscall.EBUSY)
+	case n.mode.IsDir() && (newname == oldname || strings.HasPrefix(newname, oldname+"/")):
+		if newname == oldname {
+			return nil
+		}
+		return fail(syscall.EINVAL)
+	case target == nil || target == n:
+	case n.mode.IsDir() && !target.mode.IsDir():
+		return fail(syscall.ENOTDIR)
+	case !n.mode.IsDir() && target.mode.IsDir():
+		return fail(syscall.EISDIR)
+	case len(target.children) != 0:
+		return fail(syscall.ENOTEMPTY)
+	}
+	if target != nil && target != n {
+		m.grow(-int64(len(target.data)))
+	}
+	now := time.Now()
+	delete(oldDir.children, path.Base(oldname))
+	newDir.children[path.Base(newname)] = n
+	oldDir.modTime, newDir.modTime = now, now
+	return nil
+}
+
+// LoadTar adds the directories and regular files of the tar archive read
+// from r, replacing existing files. Other entries, such as symbolic links,
+// are skipped.
+func (m *MemFS) LoadTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = m.load(hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, nil)
+		case tar.TypeReg:
+			err = m.load(hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// LoadZip adds the directories and regular files of the zip archive of size
+// bytes read from r, replacing existing files. Other entries are skipped.
+func (m *MemFS) LoadZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if !mode.IsDir() && !mode.IsRegular() {
+			continue
+		}
+		var rc io.ReadCloser
+		if mode.IsRegular() {
+			if rc, err = f.Open(); err != nil {
+				return err
+			}
+		}
+		err = m.load(f.Name, mode, f.Modified, rc)
+		if rc != nil {
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load adds the archive entry name, a directory if r is nil and a file with
+// the content read from r otherwise. Missing parent directories are created.
+func (m *MemFS) load(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if !fs.ValidPath(name) {
+		return fmt.Errorf("invalid archive entry %q", name)
+	}
+	var data []byte
+	if r != nil {
+		var err error
+		if data, err = io.ReadAll(r); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == "." {
+		return nil
+	}
+	dir := m.root
+	elems := strings.Split(name, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		next := dir.children[elem]
+		if next == nil {
+			next = newMemDir(0o755, modTime)
+			dir.children[elem] = next
+		} else if !next.mode.IsDir() {
+			return fmt.Errorf("archive entry %q: %w", name, syscall.ENOTDIR)
+		}
+		dir = next
+	}
+
+	base := elems[len(elems)-1]
+	old := dir.children[base]
+	if r == nil {
+		if old != nil && old.mode.IsDir() {
+			old.mode, old.modTime = fs.ModeDir|mode.Perm(), modTime
+			return nil
+		}
+		if old != nil {
+			m.grow(-int64(len(old.data)))
+		}
+		dir.children[base] = newMemDir(mode.Perm(), modTime)
+		return nil
+	}
+	if old != nil && old.mode.IsDir() {
+		return fmt.Errorf("archive entry %q: %w", name, syscall.EISDIR)
+	}
+	delta := int64(len(data))
+	if old != nil {
+		delta -= int64(len(old.data))
+	}
+	if err := m.grow(delta); err != nil {
+		return fmt.Errorf("archive entry %q: %w", name, err)
+	}
+	dir.children[base] = &memNode{mode: mode.Perm(), modTime: modTime, data: data}
+	return nil
+}
+
+// WriteTar writes the directories and files to w as a tar archive, sorted by
+// path.
+func (m *MemFS) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := fs.WalkDir(m, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return m.copyFile(tw, name, d)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// WriteZip writes the directories and files to w as a zip archive, sorted by
+// path.
+func (m *MemFS) WriteZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := fs.WalkDir(m, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if d.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return m.copyFile(fw, name, d)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// copyFile writes the content of the file name to w, nothing for directories.
+func (m *MemFS) copyFile(w io.Writer, name string, d fs.DirEntry) error {
+	if d.IsDir() {
+		return nil
+	}
+	f, err := m.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// info returns the information of n named name. The MemFS must be locked.
+func (n *memNode) info(name string) fs.FileInfo {
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memFileInfo is the information of a memNode when it was taken.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
+
+// memFile is an open file or directory of a MemFS.
+type memFile struct {
+	fsys   *MemFS
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+	// dirents are the entries left to return by ReadDir, read on the first
+	// call.
+	dirents []fs.DirEntry
+}
+
+// check returns an error if the file is closed, is a directory, or isn't
+// open for reading or writing as needed by op.
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	case f.node.mode.IsDir():
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0, !write && f.flag&os.O_WRONLY != 0:
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.node.info(path.Base(f.name)), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	end := off + int64(len(p))
+	if end < off || end > math.MaxInt {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EFBIG}
+	}
+	if end > int64(len(f.node.data)) {
+		if err := f.fsys.grow(end - int64(len(f.node.data))); err != nil {
+			return 0, &fs.PathError{Op: "write", Path: f.name, Err: err}
+		}
+		f.node.data = slices.Grow(f.node.data, int(end)-len(f.node.data))[:end]
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir returns the entries of the directory sorted by name, like
+// fs.ReadDirFile.
+func (f *memFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if f.dirents == nil {
+		f.dirents = make([]fs.DirEntry, 0, len(f.node.children))
+		for name, n := range f.node.children {
+			f.dirents = append(f.dirents, fs.FileInfoToDirEntry(n.info(name)))
+		}
+		slices.SortFunc(f.dirents, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+	if count <= 0 {
+		ret := f.dirents
+		f.dirents = f.dirents[len(f.dirents):]
+		return ret, nil
+	}
+	if len(f.dirents) == 0 {
+		return nil, io.EOF
+	}
+	count = min(count, len(f.dirents))
+	ret := f.dirents[:count]
+	f.dirents = f.dirents[count:]
+	return ret, nil
+}
+
+func (f *memFile) Close() error {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
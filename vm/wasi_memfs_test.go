@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func writeMemFile(fsys *MemFS, name string, flag int, data string) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|flag, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.(io.Writer).Write([]byte(data))
+	return err
+}
+
+func TestMemFSMaxSize(t *testing.T) {
+	fsys := NewMemFS()
+	fsys.SetMaxSize(10)
+	steps := []struct {
+		name string
+		do   func() error
+		err  error
+	}{
+		{"write a", func() error { return writeMemFile(fsys, "a", 0, "123456") }, nil},
+		{"write b over the limit", func() error { return writeMemFile(fsys, "b", 0, "12345") }, syscall.ENOSPC},
+		{"write b up to the limit", func() error { return writeMemFile(fsys, "b", 0, "1234") }, nil},
+		{"overwrite a", func() error { return writeMemFile(fsys, "a", 0, "abcdef") }, nil},
+		{"append to a", func() error { return writeMemFile(fsys, "a", os.O_APPEND, "g") }, syscall.ENOSPC},
+		{"truncate a", func() error { return writeMemFile(fsys, "a", os.O_TRUNC, "ab") }, nil},
+		{"rename b over a", func() error { return fsys.Rename("b", "a") }, nil},
+		{"remove a", func() error { return fsys.Remove("a") }, nil},
+		{"write c", func() error { return writeMemFile(fsys, "c", 0, "0123456789") }, nil},
+		{"load over the limit", func() error { return fsys.LoadTar(tarOf(t, "d", "x")) }, syscall.ENOSPC},
+		{"load replacing c", func() error { return fsys.LoadTar(tarOf(t, "c", "x")) }, nil},
+		{"write e", func() error { return writeMemFile(fsys, "e", 0, "123456789") }, nil},
+	}
+	for _, s := range steps {
+		if err := s.do(); !errors.Is(err, s.err) {
+			t.Fatalf("%s: %v, want %v", s.name, err, s.err)
+		}
+	}
+	if fsys.size != 10 {
+		t.Errorf("size = %d, want 10", fsys.size)
+	}
+}
+
+func tarOf(t *testing.T, name, data string) io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte(data))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestMemFSWriteAtOverflow(t *testing.T) {
+	fsys := NewMemFS()
+	f, err := fsys.OpenFile("a", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.(io.WriterAt).WriteAt([]byte("data"), math.MaxInt64-1); !errors.Is(err, syscall.EFBIG) {
+		t.Errorf("WriteAt() = %v, want EFBIG", err)
+	}
+	if info, _ := f.Stat(); info.Size() != 0 {
+		t.Errorf("size = %d, want 0", info.Size())
+	}
+}
+
+func TestWASIMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	fsys.SetMaxSize(8)
+	w := newWASITest(t, NewWASIConfig().WithPreopen("/", fsys),
+		"path_open", "fd_write", "fd_pwrite", "fd_read", "fd_seek", "fd_close")
+	ptr, n := w.str("file")
+	if errno := w.call("path_open", 3, 0, ptr, n, oflagsCreat, rightFdRead|rightFdWrite, 0, 0, 16); errno != errnoSuccess {
+		t.Fatalf("path_open = %d", errno)
+	}
+	fd := uint64(w.readU32(16))
+
+	w.write(100, []byte("0123456789"))
+	w.iovs(0, [2]uint32{100, 6})
+	w.iovs(8, [2]uint32{100, 4})
+	tests := []struct {
+		name   string
+		fn     string
+		params []uint64
+		want   uint64
+	}{
+		{"write", "fd_write", []uint64{fd, 0, 1, 16}, errnoSuccess},
+		{"write over the limit", "fd_write", []uint64{fd, 0, 1, 16}, errnoNospc},
+		{"pwrite overflowing", "fd_pwrite", []uint64{fd, 8, 1, math.MaxInt64 - 1, 16}, errnoFbig},
+		{"pwrite negative", "fd_pwrite", []uint64{fd, 8, 1, 1 << 63, 16}, errnoInval},
+		{"seek negative", "fd_seek", []uint64{fd, 1 << 63, 0, 16}, errnoInval},
+		{"seek stdout", "fd_seek", []uint64{1, 0, 0, 16}, errnoSpipe},
+		{"seek root", "fd_seek", []uint64{3, 0, 0, 16}, errnoIsdir},
+		{"close", "fd_close", []uint64{fd}, errnoSuccess},
+		{"read closed", "fd_read", []uint64{fd, 0, 1, 16}, errnoBadf},
+		{"close closed", "fd_close", []uint64{fd}, errnoBadf},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if errno := w.call(tc.fn, tc.params...); errno != tc.want {
+				t.Errorf("%s = %d, want %d", tc.fn, errno, tc.want)
+			}
+		})
+	}
+	if data, err := fs.ReadFile(fsys, "file"); err != nil || string(data) != "012345" {
+		t.Errorf("file = %q, %v, want 012345", data, err)
+	}
+}
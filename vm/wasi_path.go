@@ -0,0 +1,246 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// oflags of path_open.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#oflags
+const (
+	oflagsCreat     = 1 << 0
+	oflagsDirectory = 1 << 1
+	oflagsExcl      = 1 << 2
+	oflagsTrunc     = 1 << 3
+)
+
+// wasiPath reads the path of pathLen bytes at ptr, relative to the directory
+// fd, and returns the directory and the name the path resolves to in its
+// file system. Paths escaping the file system are ENOTCAPABLE.
+func (vm *VM) wasiPath(fd, ptr, pathLen uint32) (*wasiFD, string, uint64) {
+	dir, ok := vm.wasi.fds[fd]
+	if !ok {
+		return nil, "", errnoBadf
+	}
+	if !dir.isDir() {
+		return nil, "", errnoNotdir
+	}
+	b, ok := vm.wasiMemory().Read(ptr, pathLen)
+	if !ok {
+		return nil, "", errnoFault
+	}
+
+	p := string(b)
+	switch {
+	case p == "":
+		return nil, "", errnoNoent
+	case strings.IndexByte(p, 0) >= 0:
+		return nil, "", errnoInval
+	case path.IsAbs(p):
+		return nil, "", errnoNotcapable
+	}
+	name := path.Join(dir.path, p)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return nil, "", errnoNotcapable
+	}
+	return dir, name, errnoSuccess
+}
+
+// wasiPathOpen is the WASI function path_open, which opens the file or
+// directory at path relative to the directory fd, and writes the new file
+// descriptor at resultOpenedFd.
+//
+// The file is opened for reading and writing per the fd_read and fd_write
+// rights of fsRightsBase, and created or truncated per oflags. Other rights
+// and lookup flags are ignored; symbolic links are followed within the file
+// system.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - ENOTDIR: `fd` isn't a directory, or the path isn't a directory while
+//     oflags has directory
+//   - ENOTCAPABLE: the path escapes the preopened directory
+//   - EPERM: a symbolic link escapes the directory of DirFS
+//   - EFAULT: `path` or `resultOpenedFd` point to an offset out of memory
+//   - ENOENT, EEXIST, EISDIR, EROFS...: opening the file failed
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#path_open
+func wasiPathOpen(vm *VM, params []uint64) uint64 {
+	fd, ptr, pathLen, oflags, rightsBase, fdflags, resultOpenedFd := uint32(params[0]), uint32(params[2]), uint32(params[3]), uint32(params[4]), params[5], uint32(params[7]), uint32(params[8])
+	dir, name, errno := vm.wasiPath(fd, ptr, pathLen)
+	if errno != errnoSuccess {
+		return errno
+	}
+
+	f := &wasiFD{fsys: dir.fsys, path: name, flags: uint16(fdflags)}
+	if oflags&oflagsDirectory != 0 {
+		info, err := dir.fsys.Stat(name)
+		if err != nil {
+			return wasiErrno(err)
+		}
+		if !info.IsDir() {
+			return errnoNotdir
+		}
+	} else {
+		read, write := rightsBase&rightFdRead != 0, rightsBase&rightFdWrite != 0
+		flag := os.O_RDONLY
+		switch {
+		case read && write:
+			flag = os.O_RDWR
+		case write:
+			flag = os.O_WRONLY
+		}
+		if oflags&oflagsCreat != 0 {
+			flag |= os.O_CREATE
+		}
+		if oflags&oflagsExcl != 0 {
+			flag |= os.O_EXCL
+		}
+		if oflags&oflagsTrunc != 0 {
+			flag |= os.O_TRUNC
+		}
+		if fdflags&fdflagsAppend != 0 {
+			flag |= os.O_APPEND
+		}
+
+		file, err := dir.fsys.OpenFile(name, flag, 0o644)
+		if err != nil {
+			return wasiErrno(err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return wasiErrno(err)
+		}
+		if info.IsDir() {
+			// Directories are read through their path.
+			file.Close()
+		} else {
+			f.file = file
+			if read || !write {
+				f.reader = file
+			}
+			if w, ok := file.(io.Writer); ok && write {
+				f.writer = w
+			}
+		}
+	}
+
+	newFd := vm.wasi.open(f)
+	if !vm.wasiMemory().WriteUint32Le(resultOpenedFd, newFd) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiPathFilestatGet is the WASI function path_filestat_get, which writes
+// the filestat of the file at path relative to the directory fd at
+// resultBuf. It fails like path_open.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#path_filestat_get
+func wasiPathFilestatGet(vm *VM, params []uint64) uint64 {
+	fd, ptr, pathLen, resultBuf := uint32(params[0]), uint32(params[2]), uint32(params[3]), uint32(params[4])
+	dir, name, errno := vm.wasiPath(fd, ptr, pathLen)
+	if errno != errnoSuccess {
+		return errno
+	}
+	info, err := dir.fsys.Stat(name)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	return writeFilestat(vm.wasiMemory(), resultBuf, filetype(info.Mode()), uint64(info.Size()), info.ModTime())
+}
+
+// wasiPathCreateDirectory is the WASI function path_create_directory, which
+// creates the directory at path relative to the directory fd. It fails like
+// path_open.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#path_create_directory
+func wasiPathCreateDirectory(vm *VM, params []uint64) uint64 {
+	dir, name, errno := vm.wasiPath(uint32(params[0]), uint32(params[1]), uint32(params[2]))
+	if errno != errnoSuccess {
+		return errno
+	}
+	if err := dir.fsys.Mkdir(name, 0o755); err != nil {
+		return wasiErrno(err)
+	}
+	return errnoSuccess
+}
+
+// wasiPathUnlinkFile is the WASI function path_unlink_file, which removes
+// the file at path relative to the directory fd, or returns EISDIR for
+// directories. It fails like path_open otherwise.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#path_unlink_file
+func wasiPathUnlinkFile(vm *VM, params []uint64) uint64 {
+	dir, name, errno := vm.wasiPath(uint32(params[0]), uint32(params[1]), uint32(params[2]))
+	if errno != errnoSuccess {
+		return errno
+	}
+	if info, err := dir.fsys.Stat(name); err == nil && info.IsDir() {
+		return errnoIsdir
+	}
+	if err := dir.fsys.Remove(name); err != nil {
+		return wasiErrno(err)
+	}
+	return errnoSuccess
+}
+
+// wasiPathRemoveDirectory is the WASI function path_remove_directory, which
+// removes the empty directory at path relative to the directory fd. It
+// returns ENOTDIR for files and ENOTEMPTY for directories with entries, and
+// fails like path_open otherwise.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#path_remove_directory
+func wasiPathRemoveDirectory(vm *VM, params []uint64) uint64 {
+	dir, name, errno := vm.wasiPath(uint32(params[0]), uint32(params[1]), uint32(params[2]))
+	if errno != errnoSuccess {
+		return errno
+	}
+	info, err := dir.fsys.Stat(name)
+	if err != nil {
+		return wasiErrno(err)
+	}
+	if !info.IsDir() {
+		return errnoNotdir
+	}
+	if name == "." {
+		return errnoBusy
+	}
+	if err := dir.fsys.Remove(name); err != nil {
+		// Removing a directory with entries may fail with EEXIST.
+		if errors.Is(err, syscall.EEXIST) {
+			return errnoNotempty
+		}
+		return wasiErrno(err)
+	}
+	return errnoSuccess
+}
+
+// wasiPathRename is the WASI function path_rename, which renames the file or
+// directory at oldPath relative to the directory fd to newPath relative to
+// the directory newFd. It returns EXDEV across file systems, and fails like
+// path_open otherwise.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#path_rename
+func wasiPathRename(vm *VM, params []uint64) uint64 {
+	dir, oldname, errno := vm.wasiPath(uint32(params[0]), uint32(params[1]), uint32(params[2]))
+	if errno != errnoSuccess {
+		return errno
+	}
+	newDir, newname, errno := vm.wasiPath(uint32(params[3]), uint32(params[4]), uint32(params[5]))
+	if errno != errnoSuccess {
+		return errno
+	}
+	if dir.fsys != newDir.fsys {
+		return errnoXdev
+	}
+	if err := dir.fsys.Rename(oldname, newname); err != nil {
+		return wasiErrno(err)
+	}
+	return errnoSuccess
+}
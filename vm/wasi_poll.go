@@ -0,0 +1,389 @@
+package vm
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"reflect"
+	"runtime"
+	"time"
+)
+
+// Event types of subscriptions and events.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#eventtype
+const (
+	eventtypeClock   = 0
+	eventtypeFdRead  = 1
+	eventtypeFdWrite = 2
+)
+
+const (
+	// subclockflagsAbstime makes the timeout of a clock subscription an
+	// absolute time of the clock.
+	subclockflagsAbstime = 1 << 0
+	// eventrwflagsHangup reports the end of the stream of an fd_read event.
+	eventrwflagsHangup = 1 << 0
+)
+
+// Sizes of subscription and event in memory.
+const (
+	subscriptionSize = 48
+	eventSize        = 32
+)
+
+// subscription is a subscription of poll_oneoff decoded from memory.
+type subscription struct {
+	userdata uint64
+	tag      byte
+	// fd is the file descriptor of fd_read and fd_write subscriptions.
+	fd uint32
+	// clockID, timeout and flags are those of clock subscriptions.
+	clockID uint32
+	timeout uint64
+	flags   uint16
+}
+
+// event is the event of a subscription, written to memory by poll_oneoff.
+type event struct {
+	userdata uint64
+	errno    uint64
+	tag      byte
+	nbytes   uint64
+	flags    uint16
+}
+
+// wasiPollOneoff is the WASI function poll_oneoff, which waits until one of
+// the nsubscriptions subscriptions at in occurs, and writes their events at
+// out and the number of events at resultNevents.
+//
+// Clock subscriptions occur when their timeout has elapsed on the realtime
+// or monotonic clock, waiting with Clock.Timer. fd_write subscriptions and
+// fd_read subscriptions of files occur immediately. fd_read subscriptions of
+// streams such as stdin and sockets occur when data or the end of the stream
+// is available, with the byte count of the data in the event, and those of
+// preopened sockets when a connection can be accepted.
+//
+// The wait traps when the context of the invocation is done.
+//
+// Errors of subscriptions, such as EBADF for fds that aren't open and EINVAL
+// for unknown clocks, are reported in their events. The return value is 0
+// except the following error conditions:
+//   - EINVAL: `nsubscriptions` is 0
+//   - EFAULT: `in`, `out` or `resultNevents` point to an offset out of memory
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#poll_oneoff
+func wasiPollOneoff(vm *VM, params []uint64) uint64 {
+	in, out, nsubscriptions, resultNevents := uint32(params[0]), uint32(params[1]), uint32(params[2]), uint32(params[3])
+	if nsubscriptions == 0 {
+		return errnoInval
+	}
+	mem := vm.wasiMemory()
+	if uint64(in)+uint64(nsubscriptions)*subscriptionSize > uint64(len(mem.Buffer)) ||
+		uint64(out)+uint64(nsubscriptions)*eventSize > uint64(len(mem.Buffer)) {
+		return errnoFault
+	}
+	buf, _ := mem.Read(in, nsubscriptions*subscriptionSize)
+	subs := make([]subscription, nsubscriptions)
+	for i := range subs {
+		subs[i] = decodeSubscription(buf[i*subscriptionSize:])
+	}
+
+	events := vm.poll(subs)
+
+	buf = make([]byte, len(events)*eventSize)
+	for i, e := range events {
+		b := buf[i*eventSize:]
+		binary.LittleEndian.PutUint64(b[0:], e.userdata)
+		binary.LittleEndian.PutUint16(b[8:], uint16(e.errno))
+		b[10] = e.tag
+		binary.LittleEndian.PutUint64(b[16:], e.nbytes)
+		binary.LittleEndian.PutUint16(b[24:], e.flags)
+	}
+	if !mem.Write(out, buf) || !mem.WriteUint32Le(resultNevents, uint32(len(events))) {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// decodeSubscription decodes the subscription at the start of b.
+func decodeSubscription(b []byte) subscription {
+	s := subscription{userdata: binary.LittleEndian.Uint64(b[0:]), tag: b[8]}
+	switch s.tag {
+	case eventtypeClock:
+		s.clockID = binary.LittleEndian.Uint32(b[16:])
+		s.timeout = binary.LittleEndian.Uint64(b[24:])
+		s.flags = binary.LittleEndian.Uint16(b[40:])
+	case eventtypeFdRead, eventtypeFdWrite:
+		s.fd = binary.LittleEndian.Uint32(b[16:])
+	}
+	return s
+}
+
+// poll returns the events of the subscriptions that occur first, waiting for
+// them if none occurs immediately.
+func (vm *VM) poll(subs []subscription) []event {
+	var events []event
+	// streams are the fd_read subscriptions of streams without data yet, and
+	// waiters their streams.
+	var streams []subscription
+	var waiters []waiter
+	// timeouts are the remaining times of the clock subscriptions by index.
+	timeouts := map[int]time.Duration{}
+	wait := time.Duration(math.MaxInt64)
+
+	clock := vm.wasi.config.clock
+	for i, s := range subs {
+		e := event{userdata: s.userdata, tag: s.tag}
+		switch s.tag {
+		case eventtypeClock:
+			var now int64
+			switch s.clockID {
+			case clockRealtime:
+				now = clock.Walltime().UnixNano()
+			case clockMonotonic:
+				now = clock.Nanotime()
+			default:
+				e.errno = errnoInval
+				events = append(events, e)
+				continue
+			}
+			d := time.Duration(min(s.timeout, math.MaxInt64))
+			if s.flags&subclockflagsAbstime != 0 {
+				d = time.Duration(int64(s.timeout) - now)
+				if s.timeout > math.MaxInt64 {
+					d = math.MaxInt64
+				}
+			}
+			if d <= 0 {
+				events = append(events, e)
+				continue
+			}
+			timeouts[i] = d
+			wait = min(wait, d)
+
+		case eventtypeFdRead:
+			f, ok := vm.wasi.fds[s.fd]
+			var w waiter
+			switch {
+			case ok && f.accepter != nil:
+				w = f.accepter
+			case !ok || f.reader == nil:
+				e.errno = errnoBadf
+			case f.file != nil:
+				e.nbytes = remaining(f.file)
+			default:
+				w = f.asyncReader()
+			}
+			if w != nil && !w.ready() {
+				streams = append(streams, s)
+				waiters = append(waiters, w)
+				continue
+			}
+			if w != nil {
+				e.nbytes, e.flags = w.buffered()
+			}
+			events = append(events, e)
+
+		case eventtypeFdWrite:
+			if _, ok := vm.wasi.writer(s.fd); !ok {
+				e.errno = errnoBadf
+			}
+			events = append(events, e)
+
+		default:
+			e.errno = errnoInval
+			events = append(events, e)
+		}
+	}
+	if len(events) != 0 {
+		return events
+	}
+
+	if len(timeouts) == 0 {
+		wait = -1
+	}
+	if vm.waitAny(waiters, wait) >= 0 {
+		for i, w := range waiters {
+			if w.ready() {
+				nbytes, flags := w.buffered()
+				events = append(events, event{userdata: streams[i].userdata, tag: eventtypeFdRead, nbytes: nbytes, flags: flags})
+			}
+		}
+		return events
+	}
+	for i, s := range subs {
+		if d, ok := timeouts[i]; ok && d <= wait {
+			events = append(events, event{userdata: s.userdata, tag: eventtypeClock})
+		}
+	}
+	return events
+}
+
+// remaining returns the number of bytes of f after its offset, or 0 if it
+// can't be told.
+func remaining(f fs.File) uint64 {
+	s, ok := f.(io.Seeker)
+	if !ok {
+		return 0
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	pos, err := s.Seek(0, io.SeekCurrent)
+	if err != nil || pos >= info.Size() {
+		return 0
+	}
+	return uint64(info.Size() - pos)
+}
+
+// wasiSchedYield is the WASI function sched_yield, which yields the processor
+// to other goroutines. It always returns 0.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#sched_yield
+func wasiSchedYield(vm *VM, params []uint64) uint64 {
+	runtime.Gosched()
+	return errnoSuccess
+}
+
+// waiter is a stream poll_oneoff waits for, an asyncReader or an accepter.
+type waiter interface {
+	// ready reports whether reading the stream doesn't block.
+	ready() bool
+	// buffered returns the byte count and the flags of the fd_read event of
+	// the stream, which must be ready.
+	buffered() (uint64, uint16)
+	// channel returns the channel whose next value, passed to receive, makes
+	// the stream ready.
+	channel() reflect.Value
+	receive(v reflect.Value)
+}
+
+// asyncReader reads a stream ahead in a goroutine, so that poll_oneoff can
+// wait for its data without blocking in Read. Streams are wrapped by it when
+// first polled; the data read ahead is lost when the file descriptor is
+// closed or the instance is reset.
+type asyncReader struct {
+	chunks chan readResult
+	// pending is the chunk being read, nil when it must be received first.
+	pending *readResult
+	// done stops the goroutine.
+	done chan struct{}
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+func newAsyncReader(r io.Reader) *asyncReader {
+	a := &asyncReader{chunks: make(chan readResult), done: make(chan struct{})}
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, err := r.Read(buf)
+			if n == 0 && err == nil {
+				continue
+			}
+			select {
+			case a.chunks <- readResult{data: buf[:n], err: err}:
+			case <-a.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return a
+}
+
+// asyncReader returns the reader of the stream f, wrapping it first.
+func (f *wasiFD) asyncReader() *asyncReader {
+	r, ok := f.reader.(*asyncReader)
+	if !ok {
+		r = newAsyncReader(f.reader)
+		f.reader = r
+	}
+	return r
+}
+
+// close stops reading ahead once the pending read of the stream returns.
+func (a *asyncReader) close() {
+	close(a.done)
+}
+
+// ready reports whether Read returns without blocking.
+func (a *asyncReader) ready() bool {
+	if a.pending != nil {
+		return true
+	}
+	select {
+	case c := <-a.chunks:
+		a.pending = &c
+		return true
+	default:
+		return false
+	}
+}
+
+// buffered returns the number of bytes Read returns without blocking, and
+// eventrwflagsHangup at the end of the stream.
+func (a *asyncReader) buffered() (uint64, uint16) {
+	if len(a.pending.data) == 0 && a.pending.err != nil {
+		return 0, eventrwflagsHangup
+	}
+	return uint64(len(a.pending.data)), 0
+}
+
+func (a *asyncReader) channel() reflect.Value {
+	return reflect.ValueOf(a.chunks)
+}
+
+func (a *asyncReader) receive(v reflect.Value) {
+	c := v.Interface().(readResult)
+	a.pending = &c
+}
+
+func (a *asyncReader) Read(p []byte) (int, error) {
+	if a.pending == nil {
+		c := <-a.chunks
+		a.pending = &c
+	}
+	n := copy(p, a.pending.data)
+	a.pending.data = a.pending.data[n:]
+	if len(a.pending.data) != 0 {
+		return n, nil
+	}
+	err := a.pending.err
+	if err == nil {
+		a.pending = nil
+	}
+	return n, err
+}
+
+// waitAny waits until one of waiters is ready or d has elapsed on the clock,
+// without a timeout if d is negative, and returns the index of the waiter or
+// -1. It traps when the context of the invocation is done.
+func (vm *VM) waitAny(waiters []waiter, d time.Duration) int {
+	cases := make([]reflect.SelectCase, len(waiters), len(waiters)+2)
+	for i, w := range waiters {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: w.channel()}
+	}
+	if d >= 0 {
+		c, stop := vm.wasi.config.clock.Timer(d)
+		defer stop()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)})
+	}
+	if vm.done != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(vm.done)})
+	}
+	i, v, _ := reflect.Select(cases)
+	if i >= len(waiters) {
+		vm.checkContext()
+		return -1
+	}
+	waiters[i].receive(v)
+	return i
+}
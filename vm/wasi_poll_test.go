@@ -0,0 +1,183 @@
+package vm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// pollSubs writes the subscriptions of poll_oneoff at 0.
+func (w *wasiTest) pollSubs(subs ...subscription) {
+	for i, s := range subs {
+		b := make([]byte, subscriptionSize)
+		binary.LittleEndian.PutUint64(b[0:], s.userdata)
+		b[8] = s.tag
+		if s.tag == eventtypeClock {
+			binary.LittleEndian.PutUint32(b[16:], s.clockID)
+			binary.LittleEndian.PutUint64(b[24:], s.timeout)
+			binary.LittleEndian.PutUint16(b[40:], s.flags)
+		} else {
+			binary.LittleEndian.PutUint32(b[16:], s.fd)
+		}
+		w.write(uint32(i*subscriptionSize), b)
+	}
+}
+
+// pollEvents returns the events poll_oneoff wrote at out.
+func (w *wasiTest) pollEvents(out uint32) []event {
+	w.t.Helper()
+	events := make([]event, w.readU32(8))
+	for i := range events {
+		b := []byte(w.read(out+uint32(i*eventSize), eventSize))
+		events[i] = event{
+			userdata: binary.LittleEndian.Uint64(b[0:]),
+			errno:    uint64(binary.LittleEndian.Uint16(b[8:])),
+			tag:      b[10],
+			nbytes:   binary.LittleEndian.Uint64(b[16:]),
+			flags:    binary.LittleEndian.Uint16(b[24:]),
+		}
+	}
+	return events
+}
+
+func TestWASIPollOneoff(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0), 0)
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	w := newWASITest(t, NewWASIConfig().WithClock(clock).WithStdin(stdin), "poll_oneoff")
+	const out = 1024
+
+	tests := []struct {
+		name string
+		subs []subscription
+		want []event
+	}{
+		{
+			name: "timeout",
+			subs: []subscription{
+				{userdata: 1, tag: eventtypeClock, clockID: clockMonotonic, timeout: uint64(2 * time.Second)},
+				{userdata: 2, tag: eventtypeClock, clockID: clockMonotonic, timeout: uint64(time.Second)},
+			},
+			want: []event{{userdata: 2, tag: eventtypeClock}},
+		},
+		{
+			name: "absolute time elapsed",
+			subs: []subscription{
+				{userdata: 1, tag: eventtypeClock, clockID: clockRealtime, timeout: uint64(time.Unix(1000, 0).UnixNano()), flags: subclockflagsAbstime},
+			},
+			want: []event{{userdata: 1, tag: eventtypeClock}},
+		},
+		{
+			name: "stdin without data",
+			subs: []subscription{
+				{userdata: 1, tag: eventtypeFdRead, fd: 0},
+				{userdata: 2, tag: eventtypeClock, clockID: clockMonotonic, timeout: uint64(time.Second)},
+			},
+			want: []event{{userdata: 2, tag: eventtypeClock}},
+		},
+		{
+			name: "fd_write",
+			subs: []subscription{
+				{userdata: 1, tag: eventtypeFdWrite, fd: 1},
+				{userdata: 2, tag: eventtypeClock, clockID: clockMonotonic, timeout: uint64(time.Second)},
+			},
+			want: []event{{userdata: 1, tag: eventtypeFdWrite}},
+		},
+		{
+			name: "errors",
+			subs: []subscription{
+				{userdata: 1, tag: eventtypeClock, clockID: 2, timeout: 1},
+				{userdata: 2, tag: eventtypeFdRead, fd: 100},
+				{userdata: 3, tag: eventtypeFdWrite, fd: 0},
+				{userdata: 4, tag: 3},
+			},
+			want: []event{
+				{userdata: 1, tag: eventtypeClock, errno: errnoInval},
+				{userdata: 2, tag: eventtypeFdRead, errno: errnoBadf},
+				{userdata: 3, tag: eventtypeFdWrite, errno: errnoBadf},
+				{userdata: 4, tag: 3, errno: errnoInval},
+			},
+		},
+	}
+	for _, tc := range tests {
+		w.pollSubs(tc.subs...)
+		if errno := w.call("poll_oneoff", 0, out, uint64(len(tc.subs)), 8); errno != errnoSuccess {
+			t.Fatalf("%s: poll_oneoff = %d", tc.name, errno)
+		}
+		events := w.pollEvents(out)
+		if len(events) != len(tc.want) {
+			t.Errorf("%s: events = %+v, want %+v", tc.name, events, tc.want)
+			continue
+		}
+		for i := range events {
+			if events[i] != tc.want[i] {
+				t.Errorf("%s: events = %+v, want %+v", tc.name, events, tc.want)
+				break
+			}
+		}
+	}
+	// The fake clock advanced by the timeouts instead of waiting.
+	if got, want := clock.Nanotime(), int64(2*time.Second); got != want {
+		t.Errorf("monotonic clock = %v after polling, want %v", time.Duration(got), time.Duration(want))
+	}
+
+	// Data of stdin arriving while waiting.
+	go stdinWriter.Write([]byte("hello"))
+	w.pollSubs(subscription{userdata: 1, tag: eventtypeFdRead, fd: 0})
+	if errno := w.call("poll_oneoff", 0, out, 1, 8); errno != errnoSuccess {
+		t.Fatalf("poll_oneoff = %d", errno)
+	}
+	if events, want := w.pollEvents(out), (event{userdata: 1, tag: eventtypeFdRead, nbytes: 5}); len(events) != 1 || events[0] != want {
+		t.Errorf("events = %+v, want %+v", events, want)
+	}
+
+	memSize := uint64(w.mem.Size())
+	errTests := []struct {
+		name   string
+		params []uint64
+		want   uint64
+	}{
+		{"no subscriptions", []uint64{0, out, 0, 8}, errnoInval},
+		{"in out of memory", []uint64{memSize - subscriptionSize/2, out, 1, 8}, errnoFault},
+		{"out out of memory", []uint64{0, memSize - eventSize/2, 1, 8}, errnoFault},
+		{"nevents out of memory", []uint64{0, out, 1, memSize - 2}, errnoFault},
+	}
+	w.pollSubs(subscription{tag: eventtypeFdWrite, fd: 1})
+	for _, tc := range errTests {
+		if errno := w.call("poll_oneoff", tc.params...); errno != tc.want {
+			t.Errorf("%s: poll_oneoff = %d, want %d", tc.name, errno, tc.want)
+		}
+	}
+}
+
+// TestWASIPollOneoffContext checks that waits of poll_oneoff end when the
+// context of the invocation is done.
+func TestWASIPollOneoffContext(t *testing.T) {
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	w := newWASITest(t, NewWASIConfig().WithStdin(stdin), "poll_oneoff")
+
+	tests := []struct {
+		name string
+		sub  subscription
+	}{
+		{"clock", subscription{tag: eventtypeClock, clockID: clockMonotonic, timeout: uint64(time.Hour)}},
+		{"stdin", subscription{tag: eventtypeFdRead, fd: 0}},
+	}
+	for _, tc := range tests {
+		w.pollSubs(tc.sub)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		start := time.Now()
+		_, err := w.vm.InvokeFunctionContext(ctx, "poll_oneoff", 0, 1024, 1, 8)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || err.Error() != "wasm error: context deadline exceeded" {
+			t.Errorf("%s: error = %v, want wasm error: context deadline exceeded", tc.name, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: stopped after %v", tc.name, d)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package vm
+
+import "fmt"
+
+// ExitError is returned by the invocation of a function when the guest
+// exits with proc_exit, even with the code 0.
+type ExitError struct {
+	Code uint32
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// wasiProcExit is the WASI function proc_exit, which terminates the guest
+// with the exit code rval. It unwinds the whole call stack, and the
+// invocation returns an *ExitError with the code.
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#proc_exit
+func wasiProcExit(vm *VM, params []uint64) uint64 {
+	panic(&ExitError{Code: uint32(params[0])})
+}
@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+func TestWASIProcExit(t *testing.T) {
+	m := &testModule{}
+	procExit := m.importFunction(wasiPreview1, "proc_exit", []wasm.ValueType{i32}, nil)
+	exit := m.function("exit", []wasm.ValueType{i32}, nil, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeCall, procExit))
+	// start exits from a nested call, and would return 1 otherwise.
+	m.function("start", []wasm.ValueType{i32}, []wasm.ValueType{i32}, nil,
+		imm(wasm.OpcodeLocalGet, 0), imm(wasm.OpcodeCall, exit), i32c(1))
+
+	for _, e := range testEngines {
+		t.Run(e.name, func(t *testing.T) {
+			vm := m.instantiate(t, NewConfig().WithEngine(e.engine))
+			for _, code := range []uint64{0, 42} {
+				ret, err := vm.InvokeFunction("start", code)
+				var exitErr *ExitError
+				if !errors.As(err, &exitErr) || exitErr.Code != uint32(code) || ret != 0 {
+					t.Fatalf("start(%d) = %d, %v, want exit status %d", code, ret, err, code)
+				}
+				// The error is returned as is, not as a trap.
+				if err != exitErr {
+					t.Errorf("start(%d) error = %q, want the *ExitError", code, err)
+				}
+				if vm.stack.sp != -1 || vm.callDepth != 0 || vm.regTop != 0 {
+					t.Errorf("sp = %d, callDepth = %d, regTop = %d after exit", vm.stack.sp, vm.callDepth, vm.regTop)
+				}
+			}
+
+			start, err := ExportFunc[func(int32) (int32, error)](vm, "start")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := start(3); err == nil || err.Error() != "exit status 3" {
+				t.Errorf("typed start(3) = %v, want exit status 3", err)
+			}
+		})
+	}
+}
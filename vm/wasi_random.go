@@ -0,0 +1,26 @@
+package vm
+
+import "io"
+
+// wasiRandomGet is the WASI function random_get, which fills bufLen bytes at
+// buf with random data read from the entropy source of the WASIConfig.
+//
+// The return value is 0 except the following error conditions:
+//   - EFAULT: `buf` or `bufLen` point to an offset out of memory
+//   - EIO: reading the entropy source failed
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#random_get
+func wasiRandomGet(vm *VM, params []uint64) uint64 {
+	buf, bufLen := uint32(params[0]), uint32(params[1])
+	mem := vm.wasiMemory()
+	b, ok := mem.Read(buf, bufLen)
+	if !ok {
+		return errnoFault
+	}
+	n, err := io.ReadFull(vm.wasi.config.rand, b)
+	mem.markDirty(uint64(buf), uint64(n))
+	if err != nil {
+		return errnoIo
+	}
+	return errnoSuccess
+}
@@ -0,0 +1,32 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWASIRandomGet(t *testing.T) {
+	w := newWASITest(t, NewWASIConfig().WithRandSource(strings.NewReader("0123456789")), "random_get")
+	if errno := w.call("random_get", 100, 8); errno != errnoSuccess {
+		t.Fatalf("random_get = %d", errno)
+	}
+	if got := w.read(100, 8); got != "01234567" {
+		t.Errorf("random_get wrote %q, want 01234567", got)
+	}
+	// The source has 2 bytes left.
+	if errno := w.call("random_get", 100, 8); errno != errnoIo {
+		t.Errorf("random_get = %d, want EIO", errno)
+	}
+
+	w = newWASITest(t, NewWASIConfig().WithRandSource(bytes.NewReader(nil)), "random_get")
+	memSize := uint64(w.mem.Size())
+	for _, params := range [][]uint64{{memSize - 4, 8}, {0, memSize + 1}} {
+		if errno := w.call("random_get", params...); errno != errnoFault {
+			t.Errorf("random_get%v = %d, want EFAULT", params, errno)
+		}
+	}
+	if errno := w.call("random_get", 0, 0); errno != errnoSuccess {
+		t.Errorf("random_get of 0 bytes = %d, want 0", errno)
+	}
+}
@@ -0,0 +1,355 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// riflags of sock_recv.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#riflags
+const (
+	riflagsRecvPeek    = 1 << 0
+	riflagsRecvWaitall = 1 << 1
+)
+
+// sdflags of sock_shutdown.
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#sdflags
+const (
+	sdflagsRd = 1 << 0
+	sdflagsWr = 1 << 1
+)
+
+// wasiListener is a listener of WASIConfig, shared by the instances of the
+// config. Its connections are accepted in a goroutine started on first use,
+// so that instances can wait for them in poll_oneoff.
+type wasiListener struct {
+	l     net.Listener
+	once  sync.Once
+	conns chan acceptResult
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// maxPendingConns is the number of accepted connections a listener holds
+// until the guest takes them, beyond which they are closed.
+const maxPendingConns = 64
+
+// start starts accepting the connections, which are sent to conns in order
+// until the listener is closed. The connections not taken by then are closed.
+// Accepting goes on while the connections wait to be taken, so that the
+// close is noticed.
+func (l *wasiListener) start() {
+	l.once.Do(func() {
+		l.conns = make(chan acceptResult)
+		accepted := make(chan acceptResult)
+		go func() {
+			for {
+				conn, err := l.l.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					close(accepted)
+					return
+				}
+				accepted <- acceptResult{conn: conn, err: err}
+			}
+		}()
+		go func() {
+			var pending []acceptResult
+			for {
+				var out chan acceptResult
+				var next acceptResult
+				if len(pending) > 0 {
+					out, next = l.conns, pending[0]
+				}
+				select {
+				case c, ok := <-accepted:
+					switch {
+					case !ok:
+						for _, c := range pending {
+							c.close()
+						}
+						close(l.conns)
+						return
+					case len(pending) < maxPendingConns:
+						pending = append(pending, c)
+					default:
+						c.close()
+					}
+				case out <- next:
+					pending = pending[1:]
+				}
+			}
+		}()
+	})
+}
+
+func (c acceptResult) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// accepter is the state of the file descriptor of a preopened socket.
+type accepter struct {
+	l *wasiListener
+	// pending is the connection received by poll_oneoff, accepted next.
+	pending *acceptResult
+}
+
+// accept returns the connection received by ready or poll_oneoff, or EAGAIN
+// if none is.
+func (a *accepter) accept() (net.Conn, error) {
+	if !a.ready() {
+		return nil, syscall.EAGAIN
+	}
+	c := *a.pending
+	a.pending = nil
+	return c.conn, c.err
+}
+
+func (a *accepter) set(c acceptResult) {
+	if c.conn == nil && c.err == nil {
+		// The channel was closed with the listener.
+		c.err = net.ErrClosed
+	}
+	a.pending = &c
+}
+
+func (a *accepter) ready() bool {
+	if a.pending != nil {
+		return true
+	}
+	a.l.start()
+	select {
+	case c := <-a.l.conns:
+		a.set(c)
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *accepter) buffered() (uint64, uint16) {
+	if errors.Is(a.pending.err, net.ErrClosed) {
+		return 0, eventrwflagsHangup
+	}
+	return 0, 0
+}
+
+func (a *accepter) channel() reflect.Value {
+	a.l.start()
+	return reflect.ValueOf(a.l.conns)
+}
+
+func (a *accepter) receive(v reflect.Value) {
+	a.set(v.Interface().(acceptResult))
+}
+
+// close closes the connection received by poll_oneoff but not accepted.
+func (a *accepter) close() {
+	if a.pending != nil {
+		a.pending.close()
+	}
+	a.pending = nil
+}
+
+// wasiSocket returns the connected socket fd, or ENOTCONN for preopened
+// sockets and ENOTSOCK for other file descriptors.
+func (vm *VM) wasiSocket(fd uint32) (*wasiFD, uint64) {
+	f, ok := vm.wasi.fds[fd]
+	switch {
+	case !ok:
+		return nil, errnoBadf
+	case f.accepter != nil:
+		return nil, errnoNotconn
+	case f.conn == nil:
+		return nil, errnoNotsock
+	}
+	return f, errnoSuccess
+}
+
+// connRead returns the read function of the connection f for fd_read and
+// sock_recv. The data is read ahead by an asyncReader, so that waiting for it
+// traps when the context of the invocation is done. With the nonblock fdflag
+// of f, the first read returns EAGAIN and the next ones 0 bytes instead of
+// waiting.
+func (vm *VM) connRead(f *wasiFD) func([]byte) (int, error) {
+	r := f.asyncReader()
+	first := true
+	return func(buf []byte) (int, error) {
+		if !r.ready() {
+			switch {
+			case f.flags&fdflagsNonblock == 0:
+				vm.waitAny([]waiter{r}, -1)
+			case first:
+				return 0, syscall.EAGAIN
+			default:
+				return 0, nil
+			}
+		}
+		first = false
+		return r.Read(buf)
+	}
+}
+
+// readerFunc is a read function as an io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (r readerFunc) Read(p []byte) (int, error) {
+	return r(p)
+}
+
+// wasiSockAccept is the WASI function sock_accept, which accepts a connection
+// of the preopened socket fd, and writes the file descriptor of the
+// connection at resultFd. flags are the fdflags of the connection; with
+// nonblock, it returns EAGAIN instead of waiting for a connection. The wait
+// traps when the context of the invocation is done.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - ENOTSOCK: `fd` isn't a preopened socket
+//   - EAGAIN: no connection is ready and `flags` has nonblock
+//   - EFAULT: `resultFd` points to an offset out of memory
+//   - EIO: the listener failed or was closed
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#sock_accept
+func wasiSockAccept(vm *VM, params []uint64) uint64 {
+	fd, flags, resultFd := uint32(params[0]), uint16(params[1]), uint32(params[2])
+	f, ok := vm.wasi.fds[fd]
+	if !ok {
+		return errnoBadf
+	}
+	if f.accepter == nil {
+		return errnoNotsock
+	}
+	if flags&fdflagsNonblock == 0 && !f.accepter.ready() {
+		vm.waitAny([]waiter{f.accepter}, -1)
+	}
+	conn, err := f.accepter.accept()
+	if err != nil {
+		return wasiErrno(err)
+	}
+
+	newFd := vm.wasi.open(&wasiFD{reader: conn, writer: conn, conn: conn, flags: flags})
+	if !vm.wasiMemory().WriteUint32Le(resultFd, newFd) {
+		delete(vm.wasi.fds, newFd)
+		conn.Close()
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+// wasiSockRecv is the WASI function sock_recv, which is like fd_read on the
+// connected socket fd, writing the number of bytes read at resultRoDatalen
+// and 0 as the roflags at resultRoFlags. With the waitall riflag, it waits
+// until the buffers are full or the connection is closed. The wait traps
+// when the context of the invocation is done; with the nonblock fdflag of the
+// connection, it returns EAGAIN instead when no data is ready, and waitall
+// is ignored.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - ENOTSOCK: `fd` isn't a socket
+//   - ENOTCONN: `fd` is a preopened socket
+//   - ENOTSUP: `riFlags` has recv_peek
+//   - EAGAIN: no data is ready and the connection has the nonblock fdflag
+//   - EFAULT: `riData`, `resultRoDatalen` or `resultRoFlags` point to an
+//     offset out of memory
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#sock_recv
+func wasiSockRecv(vm *VM, params []uint64) uint64 {
+	fd, riData, riDataLen, riFlags, resultRoDatalen, resultRoFlags := uint32(params[0]), uint32(params[1]), uint32(params[2]), uint32(params[3]), uint32(params[4]), uint32(params[5])
+	f, errno := vm.wasiSocket(fd)
+	if errno != errnoSuccess {
+		return errno
+	}
+	if riFlags&riflagsRecvPeek != 0 {
+		return errnoNotsup
+	}
+	mem := vm.wasiMemory()
+	if !mem.Write(resultRoFlags, []byte{0, 0}) {
+		return errnoFault
+	}
+
+	read := vm.connRead(f)
+	if riFlags&riflagsRecvWaitall != 0 && f.flags&fdflagsNonblock == 0 {
+		conn := readerFunc(read)
+		read = func(buf []byte) (int, error) {
+			n, err := io.ReadFull(conn, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return n, err
+		}
+	}
+	return readIovs(mem, riData, riDataLen, resultRoDatalen, read)
+}
+
+// wasiSockSend is the WASI function sock_send, which is like fd_write on the
+// connected socket fd, writing the number of bytes written at
+// resultSoDatalen. siFlags are ignored.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - ENOTSOCK: `fd` isn't a socket
+//   - ENOTCONN: `fd` is a preopened socket
+//   - EFAULT: `siData` or `resultSoDatalen` point to an offset out of memory
+//   - EPIPE, ECONNRESET...: writing to the connection failed
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#sock_send
+func wasiSockSend(vm *VM, params []uint64) uint64 {
+	fd, siData, siDataLen, resultSoDatalen := uint32(params[0]), uint32(params[1]), uint32(params[2]), uint32(params[4])
+	f, errno := vm.wasiSocket(fd)
+	if errno != errnoSuccess {
+		return errno
+	}
+	return writeIovs(vm.wasiMemory(), siData, siDataLen, resultSoDatalen, f.writer.Write)
+}
+
+// wasiSockShutdown is the WASI function sock_shutdown, which shuts down the
+// receiving, sending or both sides of the connected socket fd per the
+// sdflags how.
+//
+// The return value is 0 except the following error conditions:
+//   - EBADF: `fd` is invalid
+//   - ENOTSOCK: `fd` isn't a socket
+//   - ENOTCONN: `fd` is a preopened socket
+//   - EINVAL: `how` is 0 or has unknown flags
+//   - ENOTSUP: the connection can't be half closed, like TCP and Unix
+//     connections can
+//
+// See https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#sock_shutdown
+func wasiSockShutdown(vm *VM, params []uint64) uint64 {
+	fd, how := uint32(params[0]), uint32(params[1])
+	f, errno := vm.wasiSocket(fd)
+	if errno != errnoSuccess {
+		return errno
+	}
+	if how == 0 || how&^(sdflagsRd|sdflagsWr) != 0 {
+		return errnoInval
+	}
+	c, ok := f.conn.(interface {
+		CloseRead() error
+		CloseWrite() error
+	})
+	if !ok {
+		return errnoNotsup
+	}
+	if how&sdflagsRd != 0 {
+		if err := c.CloseRead(); err != nil {
+			return wasiErrno(err)
+		}
+	}
+	if how&sdflagsWr != 0 {
+		if err := c.CloseWrite(); err != nil {
+			return wasiErrno(err)
+		}
+	}
+	return errnoSuccess
+}
@@ -0,0 +1,240 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenTCP returns a TCP listener on localhost, closed at the end of the test.
+func listenTCP(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestWASISock(t *testing.T) {
+	l := listenTCP(t)
+	w := newWASITest(t, NewWASIConfig().WithListener(l), "sock_accept", "sock_recv", "sock_send", "sock_shutdown")
+	// The socket is preopened after stdio.
+	const sock = 3
+
+	if errno := w.call("sock_accept", sock, fdflagsNonblock, 16); errno != errnoAgain {
+		t.Errorf("nonblocking sock_accept without connections = %d, want EAGAIN", errno)
+	}
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if errno := w.call("sock_accept", sock, 0, 16); errno != errnoSuccess {
+		t.Fatalf("sock_accept = %d", errno)
+	}
+	conn := uint64(w.readU32(16))
+
+	w.write(100, []byte("hello"))
+	w.iovs(0, [2]uint32{100, 5})
+	if errno := w.call("sock_send", conn, 0, 1, 0, 20); errno != errnoSuccess || w.readU32(20) != 5 {
+		t.Fatalf("sock_send = %d, sent %d bytes", errno, w.readU32(20))
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("client read %q, %v, want hello", buf, err)
+	}
+
+	// waitall waits for the 6 bytes written separately.
+	go func() {
+		client.Write([]byte("wor"))
+		client.Write([]byte("ld!"))
+	}()
+	w.iovs(0, [2]uint32{200, 6})
+	if errno := w.call("sock_recv", conn, 0, 1, riflagsRecvWaitall, 20, 24); errno != errnoSuccess {
+		t.Fatalf("sock_recv = %d", errno)
+	}
+	if n := w.readU32(20); n != 6 || w.read(200, 6) != "world!" {
+		t.Errorf("sock_recv read %q", w.read(200, n))
+	}
+
+	if errno := w.call("sock_shutdown", conn, sdflagsWr); errno != errnoSuccess {
+		t.Fatalf("sock_shutdown = %d", errno)
+	}
+	if n, err := client.Read(buf); err != io.EOF {
+		t.Errorf("client read %d bytes, %v after shutdown, want EOF", n, err)
+	}
+
+	// A connection accepted with resultFd out of memory is closed.
+	other, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if errno := w.call("sock_accept", sock, 0, uint64(w.mem.Size())-2); errno != errnoFault {
+		t.Errorf("sock_accept out of memory = %d, want EFAULT", errno)
+	}
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Read(buf); err != io.EOF {
+		t.Errorf("read of the connection not accepted = %v, want EOF", err)
+	}
+
+	memSize := uint64(w.mem.Size())
+	tests := []struct {
+		fn     string
+		params []uint64
+		want   uint64
+	}{
+		{"sock_accept", []uint64{100, 0, 16}, errnoBadf},
+		{"sock_accept", []uint64{1, 0, 16}, errnoNotsock},
+		{"sock_recv", []uint64{sock, 0, 1, 0, 20, 24}, errnoNotconn},
+		{"sock_recv", []uint64{1, 0, 1, 0, 20, 24}, errnoNotsock},
+		{"sock_recv", []uint64{100, 0, 1, 0, 20, 24}, errnoBadf},
+		{"sock_recv", []uint64{conn, 0, 1, riflagsRecvPeek, 20, 24}, errnoNotsup},
+		{"sock_recv", []uint64{conn, 0, 1, 0, 20, memSize - 1}, errnoFault},
+		{"sock_send", []uint64{sock, 0, 1, 0, 20}, errnoNotconn},
+		{"sock_send", []uint64{2, 0, 1, 0, 20}, errnoNotsock},
+		{"sock_send", []uint64{conn, memSize - 4, 1, 0, 20}, errnoFault},
+		{"sock_shutdown", []uint64{conn, 0}, errnoInval},
+		{"sock_shutdown", []uint64{conn, 4}, errnoInval},
+		{"sock_shutdown", []uint64{sock, sdflagsRd}, errnoNotconn},
+	}
+	for _, tc := range tests {
+		if errno := w.call(tc.fn, tc.params...); errno != tc.want {
+			t.Errorf("%s%v = %d, want %d", tc.fn, tc.params, errno, tc.want)
+		}
+	}
+}
+
+// TestWASISockAcceptContext checks that a blocking sock_accept ends when the
+// context of the invocation is done.
+func TestWASISockAcceptContext(t *testing.T) {
+	l := listenTCP(t)
+	w := newWASITest(t, NewWASIConfig().WithListener(l), "sock_accept")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := w.vm.InvokeFunctionContext(ctx, "sock_accept", 3, 0, 16)
+	if !errors.Is(err, context.DeadlineExceeded) || err.Error() != "wasm error: context deadline exceeded" {
+		t.Errorf("error = %v, want wasm error: context deadline exceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stopped after %v", d)
+	}
+
+	// The instance accepts connections after the trap.
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if errno := w.call("sock_accept", 3, 0, 16); errno != errnoSuccess {
+		t.Errorf("sock_accept = %d", errno)
+	}
+}
+
+// TestWASISockRecvNonblock reads two connections, of which one is idle and
+// the other nonblocking.
+func TestWASISockRecvNonblock(t *testing.T) {
+	l := listenTCP(t)
+	w := newWASITest(t, NewWASIConfig().WithListener(l), "sock_accept", "sock_recv", "fd_read", "poll_oneoff")
+	dial := func(flags uint64) (net.Conn, uint64) {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		// Wait for the connection, which a nonblocking sock_accept doesn't.
+		w.pollSubs(subscription{tag: eventtypeFdRead, fd: 3})
+		if errno := w.call("poll_oneoff", 0, 1024, 1, 8); errno != errnoSuccess {
+			t.Fatalf("poll_oneoff = %d", errno)
+		}
+		if errno := w.call("sock_accept", 3, flags, 16); errno != errnoSuccess {
+			t.Fatalf("sock_accept = %d", errno)
+		}
+		return client, uint64(w.readU32(16))
+	}
+	idleClient, idle := dial(0)
+	client, conn := dial(fdflagsNonblock)
+	w.iovs(0, [2]uint32{200, 16})
+
+	if errno := w.call("sock_recv", conn, 0, 1, 0, 20, 24); errno != errnoAgain {
+		t.Errorf("nonblocking sock_recv without data = %d, want EAGAIN", errno)
+	}
+	if errno := w.call("sock_recv", conn, 0, 1, riflagsRecvWaitall, 20, 24); errno != errnoAgain {
+		t.Errorf("nonblocking sock_recv with waitall without data = %d, want EAGAIN", errno)
+	}
+	if errno := w.call("fd_read", conn, 0, 1, 20); errno != errnoAgain {
+		t.Errorf("nonblocking fd_read without data = %d, want EAGAIN", errno)
+	}
+
+	// Once poll_oneoff reports the data, it is read without waiting.
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	w.pollSubs(subscription{userdata: 1, tag: eventtypeFdRead, fd: uint32(conn)})
+	if errno := w.call("poll_oneoff", 0, 1024, 1, 8); errno != errnoSuccess {
+		t.Fatalf("poll_oneoff = %d", errno)
+	}
+	w.iovs(0, [2]uint32{200, 16})
+	if errno := w.call("sock_recv", conn, 0, 1, 0, 20, 24); errno != errnoSuccess || w.read(200, w.readU32(20)) != "ping" {
+		t.Errorf("sock_recv = %d, read %q, want ping", errno, w.read(200, w.readU32(20)))
+	}
+
+	// Blocking reads of the idle connection end with the context.
+	for _, fn := range []string{"sock_recv", "fd_read"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		params := []uint64{idle, 0, 1, 0, 20, 24}
+		if fn == "fd_read" {
+			params = []uint64{idle, 0, 1, 20}
+		}
+		_, err := w.vm.InvokeFunctionContext(ctx, fn, params...)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || err.Error() != "wasm error: context deadline exceeded" {
+			t.Errorf("%s of the idle connection: error = %v, want wasm error: context deadline exceeded", fn, err)
+		}
+	}
+
+	// The idle connection is read after the traps.
+	if _, err := idleClient.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if errno := w.call("fd_read", idle, 0, 1, 20); errno != errnoSuccess || w.read(200, w.readU32(20)) != "pong" {
+		t.Errorf("fd_read = %d, read %q, want pong", errno, w.read(200, w.readU32(20)))
+	}
+}
+
+// TestWASIListenerClose checks that the connections not accepted are closed
+// with the listener.
+func TestWASIListenerClose(t *testing.T) {
+	l := listenTCP(t)
+	w := newWASITest(t, NewWASIConfig().WithListener(l), "sock_accept")
+	// Start accepting.
+	if errno := w.call("sock_accept", 3, fdflagsNonblock, 16); errno != errnoAgain {
+		t.Fatalf("nonblocking sock_accept without connections = %d, want EAGAIN", errno)
+	}
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Wait for the connection to be accepted by the runtime.
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ne net.Error
+	if _, err := client.Read(make([]byte, 1)); err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Errorf("read of the connection not accepted = %v, want it closed", err)
+	}
+	if errno := w.call("sock_accept", 3, 0, 16); errno != errnoIo {
+		t.Errorf("sock_accept after close = %d, want EIO", errno)
+	}
+}
@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// wasiTestModule imports the WASI functions names, and exports each under
+// its name as a function calling it with its params, so that the tests call
+// them as a guest would. The memory has 1 page, up to 16.
+func wasiTestModule(names ...string) *testModule {
+	m := &testModule{}
+	types := make([][2][]wasm.ValueType, len(names))
+	for i, name := range names {
+		params, results, _ := strings.Cut(wasiFunctions[name].sig, "_")
+		types[i] = [2][]wasm.ValueType{wasiTestTypes(params), wasiTestTypes(results)}
+		m.importFunction(wasiPreview1, name, types[i][0], types[i][1])
+	}
+	m.withMemory(1, 16)
+	for i, name := range names {
+		var body []any
+		for j := range types[i][0] {
+			body = append(body, imm(wasm.OpcodeLocalGet, uint32(j)))
+		}
+		body = append(body, imm(wasm.OpcodeCall, uint32(i)))
+		m.function(name, types[i][0], types[i][1], nil, body...)
+	}
+	return m
+}
+
+// wasiTestTypes parses the value types of a signature of wasiFunctions.
+func wasiTestTypes(s string) []wasm.ValueType {
+	var types []wasm.ValueType
+	for ; strings.HasPrefix(s, "i"); s = s[3:] {
+		if s[:3] == "i64" {
+			types = append(types, i64)
+		} else {
+			types = append(types, i32)
+		}
+	}
+	return types
+}
+
+// wasiTest is an instance of wasiTestModule.
+type wasiTest struct {
+	t   testing.TB
+	vm  *VM
+	mem *MemoryInstance
+}
+
+func newWASITest(t testing.TB, config *WASIConfig, names ...string) *wasiTest {
+	t.Helper()
+	vm := wasiTestModule(names...).instantiate(t, NewConfig().WithWASI(config))
+	return &wasiTest{t: t, vm: vm, mem: vm.Store.Memory}
+}
+
+// call calls the WASI function name and returns its errno.
+func (w *wasiTest) call(name string, params ...uint64) uint64 {
+	w.t.Helper()
+	ret, err := w.vm.InvokeFunction(name, params...)
+	if err != nil {
+		w.t.Fatalf("%s: %v", name, err)
+	}
+	return ret
+}
+
+// write writes data at offset of the memory.
+func (w *wasiTest) write(offset uint32, data []byte) {
+	w.t.Helper()
+	if !w.mem.Write(offset, data) {
+		w.t.Fatalf("write at %d out of memory", offset)
+	}
+}
+
+// iovs writes the iovec array of bufs at offset, each buf being the offset
+// and length of a buffer.
+func (w *wasiTest) iovs(offset uint32, bufs ...[2]uint32) {
+	for i, buf := range bufs {
+		w.u32(offset+uint32(i)*8, buf[0])
+		w.u32(offset+uint32(i)*8+4, buf[1])
+	}
+}
+
+// u32 writes v at offset of the memory.
+func (w *wasiTest) u32(offset, v uint32) {
+	w.t.Helper()
+	if !w.mem.WriteUint32Le(offset, v) {
+		w.t.Fatalf("write at %d out of memory", offset)
+	}
+}
+
+// read returns n bytes at offset of the memory.
+func (w *wasiTest) read(offset, n uint32) string {
+	w.t.Helper()
+	b, ok := w.mem.Read(offset, n)
+	if !ok {
+		w.t.Fatalf("read at %d out of memory", offset)
+	}
+	return string(b)
+}
+
+// readU32 returns the uint32 at offset of the memory.
+func (w *wasiTest) readU32(offset uint32) uint32 {
+	w.t.Helper()
+	v, ok := w.mem.ReadUint32Le(offset)
+	if !ok {
+		w.t.Fatalf("read at %d out of memory", offset)
+	}
+	return v
+}
+
+// str writes s at 1024 of the memory, and returns its offset and length as
+// the params of a path.
+func (w *wasiTest) str(s string) (uint64, uint64) {
+	w.write(1024, []byte(s))
+	return 1024, uint64(len(s))
+}
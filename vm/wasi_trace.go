@@ -0,0 +1,261 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wasiTracer traces the WASI calls to a writer of WithTrace or a logger of
+// WithTraceLogger.
+type wasiTracer struct {
+	w      io.Writer
+	logger *slog.Logger
+}
+
+// traceParam is a parameter of a WASI function for tracing.
+type traceParam struct {
+	name string
+	// kind is how the parameter is decoded, see parseTraceParams.
+	kind string
+	// result tells that the parameter points to a result written to memory.
+	result bool
+}
+
+// parseTraceParams parses the parameter names of a WASI function, separated
+// by spaces. A name can be followed by a colon and a kind:
+//   - path: a string in memory, given by two parameters, its offset and length
+//   - iovs: iovecs in memory, given by their offset and count, shown as the
+//     lengths of their buffers, up to traceMaxIovs of those in memory, with
+//     the count in the attribute "<name>_count" if there are more
+//   - int: a signed integer
+//   - rights: rights, in hexadecimal
+//   - clockid, whence: the name of the value
+//   - fdflags, lookupflags, oflags, riflags, sdflags: the names of the flags
+//
+// Parameters without kind are unsigned integers. Names starting with "*"
+// point to results, a uint32 or a value of the kind u16 or u64.
+func parseTraceParams(spec string) []traceParam {
+	fields := strings.Fields(spec)
+	params := make([]traceParam, len(fields))
+	for i, f := range fields {
+		name, kind, _ := strings.Cut(f, ":")
+		params[i] = traceParam{name: strings.TrimPrefix(name, "*"), kind: kind, result: name[0] == '*'}
+	}
+	return params
+}
+
+// traceMaxIovs is the maximum number of iovecs shown by the trace.
+const traceMaxIovs = 64
+
+// traceFlags are the names of the bits of the flag kinds.
+var traceFlags = map[string][]string{
+	"fdflags":     {"append", "dsync", "nonblock", "rsync", "sync"},
+	"lookupflags": {"symlink_follow"},
+	"oflags":      {"creat", "directory", "excl", "trunc"},
+	"riflags":     {"recv_peek", "recv_waitall"},
+	"sdflags":     {"rd", "wr"},
+}
+
+// traceEnums are the names of the values of the enum kinds.
+var traceEnums = map[string][]string{
+	"clockid": {"realtime", "monotonic", "process_cputime_id", "thread_cputime_id"},
+	"whence":  {"set", "cur", "end"},
+}
+
+// errnoNames are the names of the errnos.
+var errnoNames = map[uint64]string{
+	errnoSuccess:     "ESUCCESS",
+	errnoAcces:       "EACCES",
+	errnoAgain:       "EAGAIN",
+	errnoBadf:        "EBADF",
+	errnoBusy:        "EBUSY",
+	errnoConnreset:   "ECONNRESET",
+	errnoExist:       "EEXIST",
+	errnoFault:       "EFAULT",
+	errnoFbig:        "EFBIG",
+	errnoInval:       "EINVAL",
+	errnoIo:          "EIO",
+	errnoIsdir:       "EISDIR",
+	errnoLoop:        "ELOOP",
+	errnoNametoolong: "ENAMETOOLONG",
+	errnoNoent:       "ENOENT",
+	errnoNospc:       "ENOSPC",
+	errnoNosys:       "ENOSYS",
+	errnoNotconn:     "ENOTCONN",
+	errnoNotdir:      "ENOTDIR",
+	errnoNotempty:    "ENOTEMPTY",
+	errnoNotsock:     "ENOTSOCK",
+	errnoNotsup:      "ENOTSUP",
+	errnoPerm:        "EPERM",
+	errnoPipe:        "EPIPE",
+	errnoRofs:        "EROFS",
+	errnoSpipe:       "ESPIPE",
+	errnoXdev:        "EXDEV",
+	errnoNotcapable:  "ENOTCAPABLE",
+}
+
+func errnoName(errno uint64) string {
+	if name, ok := errnoNames[errno]; ok {
+		return name
+	}
+	return "errno(" + strconv.FormatUint(errno, 10) + ")"
+}
+
+// hook returns the trace function of HostFunction for the WASI function
+// name with params, returning an errno if hasResult.
+func (t *wasiTracer) hook(name string, params []traceParam, hasResult bool) func(vm *VM, args []uint64, result uint64, d time.Duration) {
+	return func(vm *VM, args []uint64, result uint64, d time.Duration) {
+		ctx := context.Background()
+		if t.logger != nil && !t.logger.Enabled(ctx, slog.LevelDebug) {
+			return
+		}
+		attrs := traceArgs(vm.wasiMemory(), params, args, !hasResult || result == errnoSuccess)
+
+		if t.logger != nil {
+			if hasResult {
+				attrs = append(attrs, slog.String("errno", errnoName(result)))
+			}
+			attrs = append(attrs, slog.Duration("duration", d))
+			t.logger.LogAttrs(ctx, slog.LevelDebug, name, attrs...)
+			return
+		}
+
+		var b strings.Builder
+		b.WriteString(name)
+		b.WriteByte('(')
+		for i, a := range attrs {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(a.Key)
+			b.WriteByte('=')
+			if path, ok := a.Value.Any().(tracePath); ok {
+				b.WriteString(strconv.Quote(string(path)))
+			} else {
+				b.WriteString(a.Value.String())
+			}
+		}
+		b.WriteByte(')')
+		if hasResult {
+			b.WriteString(" = ")
+			b.WriteString(errnoName(result))
+		}
+		fmt.Fprintf(&b, " <%s>\n", d)
+		io.WriteString(t.w, b.String())
+	}
+}
+
+// traceArgs decodes args, the arguments of a call of a function with params,
+// reading the memory they point to. Results are only decoded if ok.
+func traceArgs(mem *MemoryInstance, params []traceParam, args []uint64, ok bool) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(params))
+	i := 0
+	for _, p := range params {
+		if i == len(args) {
+			break
+		}
+		v := args[i]
+		i++
+
+		if p.result {
+			if !ok {
+				continue
+			}
+			switch p.kind {
+			case "u16":
+				if b, ok := mem.Read(uint32(v), 2); ok {
+					v = uint64(b[0]) | uint64(b[1])<<8
+				}
+			case "u64":
+				v, _ = mem.ReadUint64Le(uint32(v))
+			default:
+				x, _ := mem.ReadUint32Le(uint32(v))
+				v = uint64(x)
+			}
+			attrs = append(attrs, slog.Uint64(p.name, v))
+			continue
+		}
+
+		switch p.kind {
+		case "path":
+			if i == len(args) {
+				break
+			}
+			b, ok := mem.Read(uint32(v), uint32(args[i]))
+			i++
+			if !ok {
+				attrs = append(attrs, slog.String(p.name, fmt.Sprintf("<fault %#x>", v)))
+				break
+			}
+			attrs = append(attrs, slog.Any(p.name, tracePath(b)))
+		case "iovs":
+			if i == len(args) {
+				break
+			}
+			// The count is given by the guest, so only the iovecs in memory
+			// are read.
+			count := uint64(uint32(args[i]))
+			i++
+			n := min(count, traceMaxIovs)
+			if size := uint64(mem.Size()); uint64(uint32(v)) <= size {
+				n = min(n, (size-uint64(uint32(v)))/8)
+			} else {
+				n = 0
+			}
+			lens := make([]uint32, n)
+			for j := range lens {
+				lens[j], _ = mem.ReadUint32Le(uint32(v) + uint32(j)*8 + 4)
+			}
+			attrs = append(attrs, slog.Any(p.name, lens))
+			if n < count {
+				attrs = append(attrs, slog.Uint64(p.name+"_count", count))
+			}
+		case "int":
+			attrs = append(attrs, slog.Int64(p.name, int64(v)))
+		case "rights":
+			attrs = append(attrs, slog.String(p.name, fmt.Sprintf("%#x", v)))
+		case "clockid", "whence":
+			if names := traceEnums[p.kind]; v < uint64(len(names)) {
+				attrs = append(attrs, slog.String(p.name, names[v]))
+			} else {
+				attrs = append(attrs, slog.Uint64(p.name, v))
+			}
+		case "fdflags", "lookupflags", "oflags", "riflags", "sdflags":
+			attrs = append(attrs, slog.String(p.name, flagsString(traceFlags[p.kind], v)))
+		default:
+			attrs = append(attrs, slog.Uint64(p.name, v))
+		}
+	}
+	return attrs
+}
+
+// tracePath is a path read from memory, quoted by WithTrace.
+type tracePath string
+
+func (p tracePath) LogValue() slog.Value {
+	return slog.StringValue(string(p))
+}
+
+// flagsString returns the names of the bits set in v joined by "|", the
+// bits without names in hexadecimal, or "0".
+func flagsString(names []string, v uint64) string {
+	if v == 0 {
+		return "0"
+	}
+	var s []string
+	for i, name := range names {
+		if v&(1<<i) != 0 {
+			s = append(s, name)
+			v &^= 1 << i
+		}
+	}
+	if v != 0 {
+		s = append(s, fmt.Sprintf("%#x", v))
+	}
+	return strings.Join(s, "|")
+}
@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWASITrace(t *testing.T) {
+	var trace bytes.Buffer
+	config := NewWASIConfig().WithStdout(io.Discard).WithClock(NewFakeClock(time.Unix(0, 0), 0)).WithTrace(&trace)
+	w := newWASITest(t, config, "fd_write", "clock_time_get")
+	w.write(1024, []byte("hello, world\n"))
+	w.iovs(0, [2]uint32{1024, 5}, [2]uint32{1029, 8})
+	memSize := uint64(w.mem.Size())
+
+	// The lengths of the iovecs in memory, up to traceMaxIovs.
+	lens := make([]string, traceMaxIovs)
+	for i := range lens {
+		lens[i] = "0"
+	}
+	lens[0], lens[1] = "5", "8"
+
+	tests := []struct {
+		fn     string
+		params []uint64
+		want   string
+	}{
+		{"fd_write", []uint64{1, 0, 2, 16}, "fd_write(fd=1, iovs=[5 8], nwritten=13) = ESUCCESS"},
+		{"fd_write", []uint64{9, 0, 2, 16}, "fd_write(fd=9, iovs=[5 8]) = EBADF"},
+		// The count of the iovecs doesn't make the trace allocate them.
+		{"fd_write", []uint64{1, 0, 0xffffffff, 16}, "fd_write(fd=1, iovs=[" + strings.Join(lens, " ") + "], iovs_count=4294967295) = EFAULT"},
+		{"fd_write", []uint64{1, memSize + 8, 1, 16}, "fd_write(fd=1, iovs=[], iovs_count=1) = EFAULT"},
+		{"clock_time_get", []uint64{clockMonotonic, 1, 16}, "clock_time_get(id=monotonic, precision=1, timestamp=0) = ESUCCESS"},
+	}
+	for _, tc := range tests {
+		trace.Reset()
+		w.call(tc.fn, tc.params...)
+		got, d, ok := strings.Cut(trace.String(), " <")
+		if !ok || got != tc.want || !strings.HasSuffix(d, ">\n") {
+			t.Errorf("%s%v traced %q, want %q", tc.fn, tc.params, trace.String(), tc.want+" <duration>")
+		}
+	}
+}
+
+func TestWASITraceLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	w := newWASITest(t, NewWASIConfig().WithTraceLogger(logger), "fd_write")
+	w.iovs(0, [2]uint32{100, 5})
+
+	w.call("fd_write", 1, 0, 0xffffffff, 16)
+	var got struct {
+		Msg       string
+		Level     string
+		Fd        uint32
+		Iovs      []uint32
+		IovsCount uint32 `json:"iovs_count"`
+		Errno     string
+		Duration  *int64
+	}
+	if err := json.Unmarshal(logs.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, logs.Bytes())
+	}
+	if got.Msg != "fd_write" || got.Level != "DEBUG" || got.Fd != 1 || len(got.Iovs) != traceMaxIovs || got.Iovs[0] != 5 ||
+		got.IovsCount != 0xffffffff || got.Errno != "EFAULT" || got.Duration == nil {
+		t.Errorf("logged %s", logs.Bytes())
+	}
+
+	// Nothing is logged above the debug level.
+	logs.Reset()
+	logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	w = newWASITest(t, NewWASIConfig().WithStdout(io.Discard).WithTraceLogger(logger), "fd_write")
+	w.call("fd_write", 1, 0, 1, 16)
+	if logs.Len() != 0 {
+		t.Errorf("logged %s at the info level", logs.Bytes())
+	}
+}
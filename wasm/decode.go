@@ -60,11 +60,11 @@ func DecodeModule(
 		case SectionIDFunction:
 			m.FunctionSection, err = decodeFunctionSection(r)
 		case SectionIDTable:
-			err = errors.New("not implemented table section")
+			m.TableSection, err = decodeTableSection(r)
 		case SectionIDMemory:
 			m.MemorySection, err = decodeMemorySection(r, memoryLimitPages)
 		case SectionIDGlobal:
-			err = errors.New("not implemented global section")
+			m.GlobalSection, err = decodeGlobalSection(r)
 		case SectionIDExport:
 			m.ExportSection, m.Exports, err = decodeExportSection(r)
 		case SectionIDStart:
@@ -160,6 +160,21 @@ func decodeFunctionSection(r *bytes.Reader) ([]uint32, error) {
 	return result, err
 }
 
+func decodeTableSection(r *bytes.Reader) ([]Table, error) {
+	vs, _, err := DecodeUint32(r)
+	if err != nil {
+		return nil, fmt.Errorf("get size of vector: %w", err)
+	}
+
+	result := make([]Table, vs)
+	for i := uint32(0); i < vs; i++ {
+		if err = decodeTable(r, &result[i]); err != nil {
+			return nil, fmt.Errorf("read %d-th table: %w", i, err)
+		}
+	}
+	return result, nil
+}
+
 func decodeMemorySection(
 	r *bytes.Reader,
 	memoryLimitPages uint32,
@@ -178,6 +193,21 @@ func decodeMemorySection(
 	return decodeMemory(r, memoryLimitPages)
 }
 
+func decodeGlobalSection(r *bytes.Reader) ([]Global, error) {
+	vs, _, err := DecodeUint32(r)
+	if err != nil {
+		return nil, fmt.Errorf("get size of vector: %w", err)
+	}
+
+	result := make([]Global, vs)
+	for i := uint32(0); i < vs; i++ {
+		if err = decodeGlobal(r, &result[i]); err != nil {
+			return nil, fmt.Errorf("read %d-th global: %w", i, err)
+		}
+	}
+	return result, nil
+}
+
 func decodeExportSection(r *bytes.Reader) ([]Export, map[string]*Export, error) {
 	vs, _, sizeErr := DecodeUint32(r)
 	if sizeErr != nil {
@@ -294,11 +324,61 @@ func decodeMemory(
 	}
 
 	capacity, max := memoryLimitPages, memoryLimitPages
+	if maxP != nil {
+		max = *maxP
+	}
 	mem := &Memory{Min: min, Cap: capacity, Max: max, IsMaxEncoded: maxP != nil, IsShared: shared}
 
 	return mem, mem.Validate(memoryLimitPages)
 }
 
+// decodeTable returns the Table decoded with the WebAssembly 1.0 (20191205) Binary Format.
+// See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#binary-table
+func decodeTable(r *bytes.Reader, ret *Table) (err error) {
+	if ret.Type, err = r.ReadByte(); err != nil {
+		return fmt.Errorf("read leading byte: %v", err)
+	}
+
+	switch ret.Type {
+	case RefTypeFuncref, RefTypeExternref:
+	default:
+		return fmt.Errorf("%w: invalid table type: %#x", ErrInvalidByte, ret.Type)
+	}
+
+	if ret.Min, ret.Max, _, err = decodeLimitsType(r); err != nil {
+		return fmt.Errorf("read limits: %w", err)
+	}
+
+	if ret.Max != nil && *ret.Max < ret.Min {
+		return fmt.Errorf("table size minimum must not be greater than maximum")
+	}
+	return nil
+}
+
+// decodeGlobal returns the Global decoded with the WebAssembly 1.0 (20191205) Binary Format.
+// See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#binary-global
+func decodeGlobal(r *bytes.Reader, ret *Global) (err error) {
+	vt, err := decodeValueTypes(r, 1)
+	if err != nil {
+		return fmt.Errorf("read value type: %w", err)
+	}
+	ret.Type.ValType = vt[0]
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read mutability: %w", err)
+	}
+	switch b {
+	case 0x00:
+	case 0x01:
+		ret.Type.Mutable = true
+	default:
+		return fmt.Errorf("%w for mutability: %#x != 0x00 or 0x01", ErrInvalidByte, b)
+	}
+
+	return decodeConstantExpression(r, &ret.Init)
+}
+
 func decodeExport(r *bytes.Reader, ret *Export) (err error) {
 	if ret.Name, _, err = decodeUTF8(r, "export name"); err != nil {
 		return
@@ -519,6 +599,35 @@ func decodeFunctionType(r *bytes.Reader, ret *FunctionType) (err error) {
 	return nil
 }
 
+// LoadBlockType decodes the block type at the start of buf, which is either
+// empty, a value type or an index of the type section of m, and returns it
+// along with the number of bytes read.
+// See https://webassembly.github.io/spec/core/binary/instructions.html#control-instructions
+func (m *Module) LoadBlockType(buf []byte) (*FunctionType, uint64, error) {
+	raw, num, err := DecodeInt33AsInt64(bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, fmt.Errorf("decode int33: %w", err)
+	}
+
+	switch raw {
+	case -64: // 0x40 in original byte = nil
+		return &FunctionType{}, num, nil
+	case -1: // 0x7f in original byte = i32
+		return &FunctionType{Results: []ValueType{ValueTypeI32}}, num, nil
+	case -2: // 0x7e in original byte = i64
+		return &FunctionType{Results: []ValueType{ValueTypeI64}}, num, nil
+	case -3: // 0x7d in original byte = f32
+		return &FunctionType{Results: []ValueType{ValueTypeF32}}, num, nil
+	case -4: // 0x7c in original byte = f64
+		return &FunctionType{Results: []ValueType{ValueTypeF64}}, num, nil
+	}
+
+	if raw < 0 || (raw >= int64(len(m.TypeSection))) {
+		return nil, 0, fmt.Errorf("invalid block type: %d", raw)
+	}
+	return &m.TypeSection[raw], num, nil
+}
+
 // decodeLimitsType returns the `limitsType` (min, max) decoded with the WebAssembly 1.0 (20191205) Binary Format.
 // See https://www.w3.org/TR/2019/REC-wasm-core-1-20191205/#limits%E2%91%A6
 func decodeLimitsType(r *bytes.Reader) (min uint32, max *uint32, shared bool, err error) {
@@ -569,6 +678,12 @@ func decodeConstantExpression(r *bytes.Reader, ret *ConstantExpression) error {
 	case OpcodeI32Const:
 		// Treat constants as signed as their interpretation is not yet known per /RATIONALE.md
 		_, _, err = DecodeInt32(r)
+	case OpcodeI64Const:
+		_, _, err = DecodeInt64(r)
+	case OpcodeF32Const:
+		_, err = r.Seek(4, io.SeekCurrent)
+	case OpcodeF64Const:
+		_, err = r.Seek(8, io.SeekCurrent)
 	default:
 		return fmt.Errorf("%v for const expression opt code: %#x", ErrInvalidByte, b)
 	}
@@ -9,16 +9,30 @@ type Opcode = byte
 const (
 	OpcodeUnreachable Opcode = 0x00
 	OpcodeNop         Opcode = 0x01
+	OpcodeBlock       Opcode = 0x02
+	OpcodeLoop        Opcode = 0x03
 	OpcodeIf          Opcode = 0x04
 	OpcodeElse        Opcode = 0x05
 	OpcodeEnd         Opcode = 0x0b
+	OpcodeBr          Opcode = 0x0c
+	OpcodeBrIf        Opcode = 0x0d
 	OpcodeReturn      Opcode = 0x0f
 	OpcodeCall        Opcode = 0x10
 	OpcodeDrop        Opcode = 0x1a
 	OpcodeLocalGet    Opcode = 0x20
+	OpcodeLocalSet    Opcode = 0x21
+	OpcodeLocalTee    Opcode = 0x22
+	OpcodeGlobalGet   Opcode = 0x23
+	OpcodeGlobalSet   Opcode = 0x24
 	OpcodeI32Load     Opcode = 0x28
 	OpcodeI32Store    Opcode = 0x36
 	OpcodeI32Const    Opcode = 0x41
+	OpcodeI64Const    Opcode = 0x42
+	OpcodeF32Const    Opcode = 0x43
+	OpcodeF64Const    Opcode = 0x44
+	OpcodeI32Eqz      Opcode = 0x45
+	OpcodeI32Eq       Opcode = 0x46
+	OpcodeI32Ne       Opcode = 0x47
 	OpcodeI32Lts      Opcode = 0x48
 	OpcodeI32Add      Opcode = 0x6a
 	OpcodeI32Sub      Opcode = 0x6b
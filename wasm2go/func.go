@@ -0,0 +1,569 @@
+package wasm2go
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// operand is a value on the wasm stack: a Go variable, or a constant.
+type operand struct {
+	name  string
+	typ   wasm.ValueType
+	val   uint64
+	param bool
+}
+
+// genFrame is a block, loop, if or the function body being generated.
+type genFrame struct {
+	blockType *wasm.FunctionType
+	// height is the stack height below the block params.
+	height int
+	isLoop bool
+	// label is the target of branches: the start of a loop, the end of
+	// other blocks, or empty for the function body, where branches return.
+	label string
+	// elseLabel is where the condition of an if jumps to when false,
+	// until it is placed at the else or the end.
+	elseLabel string
+}
+
+// funcGen translates a function body into Go. Control flow becomes flat code
+// with gotos, and the wasm stack Go variables declared at the top of the
+// function: s<height> for each stack slot and l<index> for each local.
+//
+// Like the register engine of the vm, it keeps the operand of each stack slot
+// instead of copying local.get and i32.const into variables, and only moves
+// the values to the variables of their slots where control flow joins.
+type funcGen struct {
+	g          *generator
+	localTypes []wasm.ValueType
+	numParams  int
+	body       []byte
+	pc         int
+
+	lines []string
+	// labelLines are the indexes of the label lines, which are removed unless used.
+	labelLines map[int]string
+	usedLabels map[string]bool
+	numLabels  int
+	// vars are the types of the variables to declare, and reads those read.
+	vars     map[string]wasm.ValueType
+	varOrder []string
+	reads    map[string]bool
+
+	operands []operand
+	frames   []*genFrame
+	// dead is true in unreachable code after br, return and unreachable
+	// until the end of the block. deadDepth counts the blocks nested in it.
+	dead      bool
+	deadDepth int
+}
+
+func (g *generator) genFunc(i int) error {
+	m := g.m
+	ft := g.funcTypes[int(m.ImportFunctionCount)+i]
+	code := &m.CodeSection[i]
+	fg := &funcGen{
+		g:          g,
+		localTypes: append(append([]wasm.ValueType{}, ft.Params...), code.LocalTypes...),
+		numParams:  len(ft.Params),
+		body:       code.Body,
+		labelLines: map[int]string{},
+		usedLabels: map[string]bool{},
+		vars:       map[string]wasm.ValueType{},
+		reads:      map[string]bool{},
+		frames:     []*genFrame{{blockType: ft}},
+	}
+
+	for fg.pc < len(fg.body) {
+		if len(fg.frames) == 0 {
+			return errors.New("instructions after the end of the function")
+		}
+		op := fg.body[fg.pc]
+		fg.pc++
+		if err := fg.genInstruction(op); err != nil {
+			return fmt.Errorf("generate %#x at %d: %w", op, fg.pc-1, err)
+		}
+	}
+	if len(fg.frames) > 0 {
+		return errors.New("ill-nested block exists")
+	}
+
+	g.printf("func (m *Module) f%d(%s)%s {\n", i, params(ft, ""), results(ft))
+	fg.genVars()
+	for n, line := range fg.lines {
+		if label, ok := fg.labelLines[n]; ok && !fg.usedLabels[label] {
+			continue
+		}
+		g.printf("%s\n", line)
+	}
+	g.printf("}\n\n")
+	return nil
+}
+
+// genVars declares the variables, grouped by type.
+func (fg *funcGen) genVars() {
+	byType := map[wasm.ValueType][]string{}
+	var types []wasm.ValueType
+	var unread []string
+	for _, name := range fg.varOrder {
+		t := fg.vars[name]
+		if len(byType[t]) == 0 {
+			types = append(types, t)
+		}
+		byType[t] = append(byType[t], name)
+		if !fg.reads[name] {
+			unread = append(unread, name)
+		}
+	}
+	for _, t := range types {
+		fg.g.printf("var %s %s\n", strings.Join(byType[t], ", "), goType(t))
+	}
+	for _, name := range unread {
+		fg.g.printf("_ = %s\n", name)
+	}
+}
+
+func (fg *funcGen) genInstruction(op wasm.Opcode) error {
+	// Decode immediates first, even in dead code, to find the next instruction.
+	var u1 uint64
+	var bt *wasm.FunctionType
+	var err error
+	switch op {
+	case wasm.OpcodeBlock, wasm.OpcodeLoop, wasm.OpcodeIf:
+		bt, err = fg.readBlockType()
+	case wasm.OpcodeBr, wasm.OpcodeBrIf, wasm.OpcodeCall,
+		wasm.OpcodeLocalGet, wasm.OpcodeLocalSet, wasm.OpcodeLocalTee,
+		wasm.OpcodeGlobalGet, wasm.OpcodeGlobalSet:
+		u1, err = fg.readUint32()
+	case wasm.OpcodeI32Load, wasm.OpcodeI32Store:
+		if _, err = fg.readUint32(); err != nil { // ignore memory align
+			return err
+		}
+		u1, err = fg.readUint32()
+	case wasm.OpcodeI32Const:
+		var v int32
+		var num uint64
+		v, num, err = wasm.LoadInt32(fg.body[fg.pc:])
+		fg.pc += int(num)
+		u1 = uint64(uint32(v))
+	}
+	if err != nil {
+		return fmt.Errorf("read immediate: %w", err)
+	}
+
+	if fg.dead {
+		switch op {
+		case wasm.OpcodeBlock, wasm.OpcodeLoop, wasm.OpcodeIf:
+			fg.deadDepth++
+			return nil
+		case wasm.OpcodeElse, wasm.OpcodeEnd:
+			if fg.deadDepth > 0 {
+				if op == wasm.OpcodeEnd {
+					fg.deadDepth--
+				}
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+
+	switch op {
+	case wasm.OpcodeUnreachable:
+		fg.emit("panic(ErrUnreachable)")
+		fg.dead = true
+	case wasm.OpcodeNop:
+	case wasm.OpcodeBlock, wasm.OpcodeLoop:
+		if len(fg.operands) < len(bt.Params) {
+			return errors.New("stack underflow")
+		}
+		fg.materialize()
+		fr := fg.pushFrame(bt)
+		fr.isLoop = op == wasm.OpcodeLoop
+		if fr.isLoop {
+			fg.emitLabel(fr.label)
+		}
+	case wasm.OpcodeIf:
+		cond, err := fg.pop()
+		if err != nil {
+			return err
+		}
+		if len(fg.operands) < len(bt.Params) {
+			return errors.New("stack underflow")
+		}
+		fg.materialize()
+		fr := fg.pushFrame(bt)
+		fr.elseLabel = fg.newLabel()
+		fg.emit("if %s == 0 {", fg.use(cond))
+		fg.emitGoto(fr.elseLabel)
+		fg.emit("}")
+	case wasm.OpcodeElse:
+		fr := fg.frames[len(fg.frames)-1]
+		if fr.elseLabel == "" {
+			return errors.New("else without if")
+		}
+		if !fg.dead {
+			fg.materialize()
+			fg.emitGoto(fr.label)
+		}
+		fg.emitLabel(fr.elseLabel)
+		fr.elseLabel = ""
+		fg.reset(fr.height, fr.blockType.Params)
+		fg.dead = false
+	case wasm.OpcodeEnd:
+		fr := fg.frames[len(fg.frames)-1]
+		fg.frames = fg.frames[:len(fg.frames)-1]
+		if len(fg.frames) == 0 {
+			if !fg.dead {
+				if err := fg.emitReturn(fr); err != nil {
+					return err
+				}
+			}
+			fg.dead = false
+			return nil
+		}
+
+		live := !fg.dead
+		if live {
+			fg.materialize()
+		}
+		if fr.elseLabel != "" {
+			fg.emitLabel(fr.elseLabel)
+			live = true
+		}
+		if !fr.isLoop {
+			fg.emitLabel(fr.label)
+			live = live || fg.usedLabels[fr.label]
+		}
+		fg.reset(fr.height, fr.blockType.Results)
+		// The code after a block nobody reaches the end of is dead as well.
+		fg.dead = !live
+	case wasm.OpcodeBr, wasm.OpcodeBrIf:
+		var cond operand
+		if op == wasm.OpcodeBrIf {
+			if cond, err = fg.pop(); err != nil {
+				return err
+			}
+		}
+		if u1 >= uint64(len(fg.frames)) {
+			return fmt.Errorf("invalid label: %d", u1)
+		}
+		fr := fg.frames[len(fg.frames)-1-int(u1)]
+		if op == wasm.OpcodeBr {
+			return fg.emitBranch(fr)
+		}
+		fg.materialize()
+		fg.emit("if %s != 0 {", fg.use(cond))
+		if err := fg.emitBranch(fr); err != nil {
+			return err
+		}
+		fg.emit("}")
+		fg.dead = false
+	case wasm.OpcodeReturn:
+		return fg.emitBranch(fg.frames[0])
+	case wasm.OpcodeCall:
+		if u1 >= uint64(len(fg.g.funcTypes)) {
+			return fmt.Errorf("invalid function index: %d", u1)
+		}
+		ft := fg.g.funcTypes[u1]
+		n := len(ft.Params)
+		if len(fg.operands) < n {
+			return errors.New("stack underflow")
+		}
+		args := make([]string, n)
+		for i, o := range fg.operands[len(fg.operands)-n:] {
+			args[i] = fg.use(o)
+		}
+		fg.operands = fg.operands[:len(fg.operands)-n]
+		call := fg.g.callExpr(wasm.Index(u1), args)
+		if len(ft.Results) == 0 {
+			fg.emit("%s", call)
+			break
+		}
+		dst := fg.slot(len(fg.operands), ft.Results[0])
+		fg.assign(dst, call)
+		fg.push(dst)
+	case wasm.OpcodeDrop:
+		if _, err := fg.pop(); err != nil {
+			return err
+		}
+	case wasm.OpcodeLocalGet, wasm.OpcodeLocalSet, wasm.OpcodeLocalTee:
+		if u1 >= uint64(len(fg.localTypes)) {
+			return fmt.Errorf("invalid local index: %d", u1)
+		}
+		local := fg.local(int(u1))
+		if op == wasm.OpcodeLocalGet {
+			fg.push(local)
+			break
+		}
+		v, err := fg.pop()
+		if err != nil {
+			return err
+		}
+		fg.setLocal(local, v)
+		if op == wasm.OpcodeLocalTee {
+			fg.push(local)
+		}
+	case wasm.OpcodeGlobalGet, wasm.OpcodeGlobalSet:
+		if u1 >= uint64(len(fg.g.m.GlobalSection)) {
+			return fmt.Errorf("invalid global index: %d", u1)
+		}
+		gt := fg.g.m.GlobalSection[u1].Type
+		if op == wasm.OpcodeGlobalGet {
+			dst := fg.slot(len(fg.operands), gt.ValType)
+			fg.assign(dst, fmt.Sprintf("m.g%d", u1))
+			fg.push(dst)
+			break
+		}
+		if !gt.Mutable {
+			return fmt.Errorf("global %d is immutable", u1)
+		}
+		v, err := fg.pop()
+		if err != nil {
+			return err
+		}
+		fg.emit("m.g%d = %s", u1, fg.use(v))
+	case wasm.OpcodeI32Load:
+		if fg.g.m.MemorySection == nil {
+			return errors.New("memory instruction requires a memory")
+		}
+		addr, err := fg.pop()
+		if err != nil {
+			return err
+		}
+		dst := fg.slot(len(fg.operands), wasm.ValueTypeI32)
+		fg.assign(dst, fmt.Sprintf("m.load32(%s, %d)", fg.use(addr), u1))
+		fg.push(dst)
+	case wasm.OpcodeI32Store:
+		if fg.g.m.MemorySection == nil {
+			return errors.New("memory instruction requires a memory")
+		}
+		ops, err := fg.popN(2)
+		if err != nil {
+			return err
+		}
+		fg.emit("m.store32(%s, %d, %s)", fg.use(ops[0]), u1, fg.use(ops[1]))
+	case wasm.OpcodeI32Const:
+		fg.push(operand{typ: wasm.ValueTypeI32, val: u1})
+	case wasm.OpcodeI32Eqz:
+		a, err := fg.pop()
+		if err != nil {
+			return err
+		}
+		dst := fg.slot(len(fg.operands), wasm.ValueTypeI32)
+		fg.assign(dst, fmt.Sprintf("b2u(%s == 0)", fg.use(a)))
+		fg.push(dst)
+	case wasm.OpcodeI32Eq, wasm.OpcodeI32Ne, wasm.OpcodeI32Lts, wasm.OpcodeI32Add, wasm.OpcodeI32Sub:
+		ops, err := fg.popN(2)
+		if err != nil {
+			return err
+		}
+		var expr string
+		switch op {
+		case wasm.OpcodeI32Eq:
+			expr = fmt.Sprintf("b2u(%s == %s)", fg.use(ops[0]), fg.use(ops[1]))
+		case wasm.OpcodeI32Ne:
+			expr = fmt.Sprintf("b2u(%s != %s)", fg.use(ops[0]), fg.use(ops[1]))
+		case wasm.OpcodeI32Lts:
+			expr = fmt.Sprintf("b2u(%s < %s)", fg.useSigned(ops[0]), fg.useSigned(ops[1]))
+		case wasm.OpcodeI32Add:
+			expr = fmt.Sprintf("%s + %s", fg.use(ops[0]), fg.use(ops[1]))
+		case wasm.OpcodeI32Sub:
+			expr = fmt.Sprintf("%s - %s", fg.use(ops[0]), fg.use(ops[1]))
+		}
+		dst := fg.slot(len(fg.operands), wasm.ValueTypeI32)
+		fg.assign(dst, expr)
+		fg.push(dst)
+	default:
+		return errors.New("instruction not supported")
+	}
+	return nil
+}
+
+func (fg *funcGen) emit(format string, args ...any) {
+	fg.lines = append(fg.lines, fmt.Sprintf(format, args...))
+}
+
+func (fg *funcGen) newLabel() string {
+	fg.numLabels++
+	return fmt.Sprintf("L%d", fg.numLabels)
+}
+
+func (fg *funcGen) emitLabel(label string) {
+	fg.labelLines[len(fg.lines)] = label
+	fg.emit("%s:", label)
+}
+
+func (fg *funcGen) emitGoto(label string) {
+	fg.usedLabels[label] = true
+	fg.emit("goto %s", label)
+}
+
+// emitBranch moves the values kept by a branch to fr into the slots of its
+// results, or params for a loop, and jumps there.
+func (fg *funcGen) emitBranch(fr *genFrame) error {
+	if fr == fg.frames[0] {
+		fg.dead = true
+		return fg.emitReturn(fr)
+	}
+
+	keep := fr.blockType.Results
+	if fr.isLoop {
+		keep = fr.blockType.Params
+	}
+	h := len(fg.operands) - len(keep)
+	if h < fr.height {
+		return errors.New("stack underflow")
+	}
+	for i, t := range keep {
+		// The operands above only use their own slots, so the earlier moves never overwrite them.
+		if dst, src := fg.slot(fr.height+i, t), fg.operands[h+i]; dst.name != src.name {
+			fg.assign(dst, fg.use(src))
+		}
+	}
+	fg.emitGoto(fr.label)
+	fg.dead = true
+	return nil
+}
+
+func (fg *funcGen) emitReturn(fr *genFrame) error {
+	ops, err := fg.popN(len(fr.blockType.Results))
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		fg.emit("return")
+		return nil
+	}
+	fg.emit("return %s", fg.use(ops[0]))
+	return nil
+}
+
+func (fg *funcGen) pushFrame(bt *wasm.FunctionType) *genFrame {
+	fr := &genFrame{
+		blockType: bt,
+		height:    len(fg.operands) - len(bt.Params),
+		label:     fg.newLabel(),
+	}
+	fg.frames = append(fg.frames, fr)
+	return fr
+}
+
+// reset sets the stack to the values of types in their slots above height,
+// as at the start of else and after end.
+func (fg *funcGen) reset(height int, types []wasm.ValueType) {
+	fg.operands = fg.operands[:height]
+	for i, t := range types {
+		fg.push(fg.slot(height+i, t))
+	}
+}
+
+func (fg *funcGen) push(o operand) {
+	fg.operands = append(fg.operands, o)
+}
+
+func (fg *funcGen) pop() (operand, error) {
+	ops, err := fg.popN(1)
+	if err != nil {
+		return operand{}, err
+	}
+	return ops[0], nil
+}
+
+func (fg *funcGen) popN(n int) ([]operand, error) {
+	h := len(fg.operands) - n
+	if h < 0 || (len(fg.frames) > 0 && h < fg.frames[len(fg.frames)-1].height) {
+		return nil, errors.New("stack underflow")
+	}
+	ret := append([]operand{}, fg.operands[h:]...)
+	fg.operands = fg.operands[:h]
+	return ret, nil
+}
+
+// slot returns the variable of the k-th stack slot for values of type t.
+func (fg *funcGen) slot(k int, t wasm.ValueType) operand {
+	name := fmt.Sprintf("s%d", k)
+	if t != wasm.ValueTypeI32 {
+		name += "_" + wasm.ValueTypeName(t)
+	}
+	return operand{name: name, typ: t}
+}
+
+func (fg *funcGen) local(i int) operand {
+	return operand{name: fmt.Sprintf("l%d", i), typ: fg.localTypes[i], param: i < fg.numParams}
+}
+
+func (fg *funcGen) declare(o operand) {
+	if _, ok := fg.vars[o.name]; !ok && !o.param {
+		fg.vars[o.name] = o.typ
+		fg.varOrder = append(fg.varOrder, o.name)
+	}
+}
+
+// assign emits the assignment of expr to the variable dst.
+func (fg *funcGen) assign(dst operand, expr string) {
+	fg.declare(dst)
+	fg.emit("%s = %s", dst.name, expr)
+}
+
+// use returns the Go expression of o.
+func (fg *funcGen) use(o operand) string {
+	if o.name != "" {
+		fg.declare(o)
+		fg.reads[o.name] = true
+		return o.name
+	}
+	return fmt.Sprint(o.val)
+}
+
+// useSigned returns the Go expression of o as int32.
+func (fg *funcGen) useSigned(o operand) string {
+	if o.name != "" {
+		return fmt.Sprintf("int32(%s)", fg.use(o))
+	}
+	return fmt.Sprint(int32(uint32(o.val)))
+}
+
+// materialize moves all values to the variables of their slots.
+func (fg *funcGen) materialize() {
+	for k := range fg.operands {
+		fg.materializeSlot(k)
+	}
+}
+
+func (fg *funcGen) materializeSlot(k int) {
+	o := fg.operands[k]
+	if s := fg.slot(k, o.typ); o.name != s.name {
+		fg.assign(s, fg.use(o))
+		fg.operands[k] = s
+	}
+}
+
+func (fg *funcGen) setLocal(local, v operand) {
+	// Values still read from the local must be saved before it is overwritten.
+	for k, o := range fg.operands {
+		if o.name == local.name {
+			fg.materializeSlot(k)
+		}
+	}
+	if v.name != local.name {
+		fg.assign(local, fg.use(v))
+	}
+}
+
+func (fg *funcGen) readUint32() (uint64, error) {
+	v, num, err := wasm.LoadUint32(fg.body[fg.pc:])
+	fg.pc += int(num)
+	return uint64(v), err
+}
+
+// readBlockType reads the block type, see wasm.Module.LoadBlockType.
+func (fg *funcGen) readBlockType() (*wasm.FunctionType, error) {
+	bt, num, err := fg.g.m.LoadBlockType(fg.body[fg.pc:])
+	fg.pc += int(num)
+	return bt, err
+}
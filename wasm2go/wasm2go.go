@@ -0,0 +1,360 @@
+// Package wasm2go translates a decoded module into the source of a Go
+// package, so that guests run as statically linked native code without
+// generating code at runtime.
+//
+// The generated package has a Module type holding the linear memory and the
+// globals of an instance, created by New. Exported functions become methods
+// of Module, and imported functions methods of an Imports interface which the
+// embedder implements. Traps panic with ErrUnreachable or
+// ErrOutOfBoundsMemoryAccess of the generated package.
+package wasm2go
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+type generator struct {
+	m         *wasm.Module
+	funcTypes []*wasm.FunctionType
+	// importNames are the Imports methods of the imported functions.
+	importNames []string
+	// pkgs are the packages imported by the generated source.
+	pkgs map[string]bool
+	buf  bytes.Buffer
+}
+
+// Generate returns the gofmt-ed source of a Go package named pkg implementing m.
+func Generate(m *wasm.Module, pkg string) ([]byte, error) {
+	g := &generator{m: m, pkgs: map[string]bool{"errors": true}}
+	if err := g.init(); err != nil {
+		return nil, err
+	}
+
+	g.genTypes()
+	if err := g.genNew(); err != nil {
+		return nil, err
+	}
+	if err := g.genExports(); err != nil {
+		return nil, err
+	}
+	for i := range m.FunctionSection {
+		if err := g.genFunc(i); err != nil {
+			return nil, fmt.Errorf("func[%d]: %w", i, err)
+		}
+	}
+	g.genHelpers()
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by wasm2go. DO NOT EDIT.\n\npackage %s\n\nimport (\n", pkg)
+	pkgs := make([]string, 0, len(g.pkgs))
+	for p := range g.pkgs {
+		pkgs = append(pkgs, p)
+	}
+	slices.Sort(pkgs)
+	for _, p := range pkgs {
+		fmt.Fprintf(&src, "%q\n", p)
+	}
+	src.WriteString(")\n")
+	src.Write(g.buf.Bytes())
+
+	ret, err := format.Source(src.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format: %w", err)
+	}
+	return ret, nil
+}
+
+func (g *generator) init() error {
+	m := g.m
+	g.funcTypes = make([]*wasm.FunctionType, int(m.ImportFunctionCount)+len(m.FunctionSection))
+	for _, imp := range m.ImportSection {
+		if imp.Type != wasm.ExternTypeFunc {
+			return fmt.Errorf("import %s.%s: only functions can be imported", imp.Module, imp.Name)
+		}
+		g.funcTypes[imp.IndexPerType] = &m.TypeSection[imp.DescFunc]
+		g.importNames = append(g.importNames, goName(imp.Module)+goName(imp.Name))
+	}
+	if dup := duplicate(g.importNames); dup != "" {
+		return fmt.Errorf("duplicate import method: %s", dup)
+	}
+	for i, fidx := range m.FunctionSection {
+		g.funcTypes[int(m.ImportFunctionCount)+i] = &m.TypeSection[fidx]
+	}
+	if len(m.FunctionSection) != len(m.CodeSection) {
+		return fmt.Errorf("function and code section have inconsistent lengths")
+	}
+	return nil
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) genTypes() {
+	m := g.m
+	g.printf(`
+// ErrUnreachable is the trap raised by the unreachable instruction.
+var ErrUnreachable = errors.New("unreachable")
+
+// ErrOutOfBoundsMemoryAccess is the trap raised when a load or store exceeds the memory size.
+var ErrOutOfBoundsMemoryAccess = errors.New("out of bounds memory access")
+
+// Imports are the functions imported by the module.
+type Imports interface {
+`)
+	for i, imp := range m.ImportSection {
+		ft := g.funcTypes[imp.IndexPerType]
+		g.printf("// %s implements %s.%s.\n", g.importNames[i], imp.Module, imp.Name)
+		g.printf("%s(m *Module%s)%s\n", g.importNames[i], params(ft, ", "), results(ft))
+	}
+	g.printf("}\n\n")
+
+	g.printf("// Module is an instance of the module.\ntype Module struct {\n")
+	if m.MemorySection != nil {
+		g.printf("// Memory is the linear memory.\nMemory []byte\n\n")
+	}
+	g.printf("imports Imports\n")
+	for i, gl := range m.GlobalSection {
+		g.printf("g%d %s\n", i, goType(gl.Type.ValType))
+	}
+	g.printf("}\n\n")
+}
+
+func (g *generator) genNew() error {
+	m := g.m
+	g.printf("// New instantiates the module with the imports.\nfunc New(imports Imports) *Module {\n")
+	g.printf("m := &Module{imports: imports}\n")
+	if m.MemorySection != nil {
+		g.printf("m.Memory = make([]byte, %d)\n", uint64(m.MemorySection.Min)*65536)
+	} else if len(m.DataSection) > 0 {
+		return fmt.Errorf("data segments require a memory")
+	}
+
+	for i, ds := range m.DataSection {
+		if ds.OffsetExpression.Opcode != wasm.OpcodeI32Const {
+			return fmt.Errorf("data[%d]: invalid opcode: %#x", i, ds.OffsetExpression.Opcode)
+		}
+		offset, _, err := wasm.LoadInt32(ds.OffsetExpression.Data)
+		if err != nil {
+			return fmt.Errorf("data[%d]: decode int32 error: %w", i, err)
+		}
+		if offset < 0 || uint64(offset)+uint64(len(ds.Init)) > uint64(m.MemorySection.Min)*65536 {
+			return fmt.Errorf("data[%d]: memory size out of limit", i)
+		}
+		g.printf("copy(m.Memory[%d:], %q)\n", offset, ds.Init)
+	}
+
+	for i, gl := range m.GlobalSection {
+		v, err := g.constant(&gl.Init, gl.Type.ValType)
+		if err != nil {
+			return fmt.Errorf("global[%d]: %w", i, err)
+		}
+		g.printf("m.g%d = %s\n", i, v)
+	}
+
+	if m.StartSection != nil {
+		g.printf("%s\n", g.callExpr(*m.StartSection, nil))
+	}
+	g.printf("return m\n}\n\n")
+	return nil
+}
+
+// constant returns a Go expression for the value of a constant expression.
+func (g *generator) constant(expr *wasm.ConstantExpression, t wasm.ValueType) (string, error) {
+	var v string
+	switch expr.Opcode {
+	case wasm.OpcodeI32Const:
+		n, _, err := wasm.LoadInt32(expr.Data)
+		if err != nil {
+			return "", fmt.Errorf("decode int32 error: %w", err)
+		}
+		if t != wasm.ValueTypeI32 {
+			return "", fmt.Errorf("type mismatch")
+		}
+		v = fmt.Sprint(uint32(n))
+	case wasm.OpcodeI64Const:
+		n, _, err := wasm.LoadInt64(expr.Data)
+		if err != nil {
+			return "", fmt.Errorf("decode int64 error: %w", err)
+		}
+		if t != wasm.ValueTypeI64 {
+			return "", fmt.Errorf("type mismatch")
+		}
+		v = fmt.Sprint(uint64(n))
+	case wasm.OpcodeF32Const:
+		if t != wasm.ValueTypeF32 || len(expr.Data) < 4 {
+			return "", fmt.Errorf("type mismatch")
+		}
+		g.pkgs["math"] = true
+		v = fmt.Sprintf("math.Float32frombits(%#x)", le(expr.Data[:4]))
+	case wasm.OpcodeF64Const:
+		if t != wasm.ValueTypeF64 || len(expr.Data) < 8 {
+			return "", fmt.Errorf("type mismatch")
+		}
+		g.pkgs["math"] = true
+		v = fmt.Sprintf("math.Float64frombits(%#x)", le(expr.Data[:8]))
+	default:
+		return "", fmt.Errorf("invalid opcode: %#x", expr.Opcode)
+	}
+	return v, nil
+}
+
+func (g *generator) genExports() error {
+	var names []string
+	for _, exp := range g.m.ExportSection {
+		name := goName(exp.Name)
+		switch exp.Type {
+		case wasm.ExternTypeFunc:
+			if int(exp.Index) >= len(g.funcTypes) {
+				return fmt.Errorf("export %s: func index out of range", exp.Name)
+			}
+			ft := g.funcTypes[exp.Index]
+			args := make([]string, len(ft.Params))
+			for i := range args {
+				args[i] = fmt.Sprintf("l%d", i)
+			}
+			g.printf("// %s calls the exported function %q.\n", name, exp.Name)
+			g.printf("func (m *Module) %s(%s)%s {\n", name, params(ft, ""), results(ft))
+			if len(ft.Results) > 0 {
+				g.printf("return ")
+			}
+			g.printf("%s\n}\n\n", g.callExpr(exp.Index, args))
+		case wasm.ExternTypeGlobal:
+			if int(exp.Index) >= len(g.m.GlobalSection) {
+				return fmt.Errorf("export %s: global index out of range", exp.Name)
+			}
+			t := g.m.GlobalSection[exp.Index].Type.ValType
+			g.printf("// %s returns the exported global %q.\n", name, exp.Name)
+			g.printf("func (m *Module) %s() %s {\nreturn m.g%d\n}\n\n", name, goType(t), exp.Index)
+		default:
+			// The memory is Module.Memory, and tables aren't used by any instruction.
+			continue
+		}
+		names = append(names, name)
+	}
+	if dup := duplicate(names); dup != "" {
+		return fmt.Errorf("duplicate export method: %s", dup)
+	}
+	return nil
+}
+
+// callExpr returns the Go expression calling the function at index.
+func (g *generator) callExpr(index wasm.Index, args []string) string {
+	if index < g.m.ImportFunctionCount {
+		return fmt.Sprintf("m.imports.%s(%s)", g.importNames[index], strings.Join(append([]string{"m"}, args...), ", "))
+	}
+	return fmt.Sprintf("m.f%d(%s)", index-g.m.ImportFunctionCount, strings.Join(args, ", "))
+}
+
+func (g *generator) genHelpers() {
+	g.printf(`
+func b2u(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+`)
+	if g.m.MemorySection == nil {
+		return
+	}
+	g.pkgs["encoding/binary"] = true
+	g.printf(`
+func (m *Module) load32(addr uint32, offset uint64) uint32 {
+	base := uint64(addr) + offset
+	if base+4 > uint64(len(m.Memory)) {
+		panic(ErrOutOfBoundsMemoryAccess)
+	}
+	return binary.LittleEndian.Uint32(m.Memory[base:])
+}
+
+func (m *Module) store32(addr uint32, offset uint64, v uint32) {
+	base := uint64(addr) + offset
+	if base+4 > uint64(len(m.Memory)) {
+		panic(ErrOutOfBoundsMemoryAccess)
+	}
+	binary.LittleEndian.PutUint32(m.Memory[base:], v)
+}
+`)
+}
+
+// params returns the parameter list l0 T0, l1 T1, ... of ft, preceded by sep if not empty.
+func params(ft *wasm.FunctionType, sep string) string {
+	if len(ft.Params) == 0 {
+		return ""
+	}
+	ps := make([]string, len(ft.Params))
+	for i, t := range ft.Params {
+		ps[i] = fmt.Sprintf("l%d %s", i, goType(t))
+	}
+	return sep + strings.Join(ps, ", ")
+}
+
+func results(ft *wasm.FunctionType) string {
+	if len(ft.Results) == 0 {
+		return ""
+	}
+	return " " + goType(ft.Results[0])
+}
+
+func goType(t wasm.ValueType) string {
+	switch t {
+	case wasm.ValueTypeI32:
+		return "uint32"
+	case wasm.ValueTypeI64:
+		return "uint64"
+	case wasm.ValueTypeF32:
+		return "float32"
+	case wasm.ValueTypeF64:
+		return "float64"
+	}
+	return "uint64"
+}
+
+// goName turns a wasm name like "fd_write" into an exported Go identifier like "FdWrite".
+func goName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	ret := b.String()
+	if ret == "" || !unicode.IsLetter([]rune(ret)[0]) {
+		ret = "X" + ret
+	}
+	return ret
+}
+
+func duplicate(names []string) string {
+	seen := map[string]bool{}
+	for _, n := range names {
+		if seen[n] {
+			return n
+		}
+		seen[n] = true
+	}
+	return ""
+}
+
+func le(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
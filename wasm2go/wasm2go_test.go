@@ -0,0 +1,228 @@
+package wasm2go
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kawabatas/toy-wasm-runtime/vm"
+	"github.com/kawabatas/toy-wasm-runtime/wasm"
+)
+
+// call is a call of an exported function.
+type call struct {
+	name string
+	args []uint32
+}
+
+// TestGenerate runs the Go generated for the modules of testdata and checks
+// that it prints the same as the interpreter for the same calls.
+func TestGenerate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the generated source")
+	}
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+
+	tests := []struct {
+		file  string
+		calls []call
+	}{
+		{file: "add.wasm", calls: []call{{"add", []uint32{40, 2}}, {"add", []uint32{0xffffffff, 2}}}},
+		{file: "fib.wasm", calls: []call{{"fib", []uint32{0}}, {"fib", []uint32{20}}}},
+		{file: "loop.wasm", calls: []call{{"loop", []uint32{0}}, {"loop", []uint32{10000}}}},
+		{file: "helloworld.wasm", calls: []call{{"_start", nil}, {"_start", nil}}},
+		{file: "trap.wasm", calls: []call{
+			{"store", []uint32{100, 42}},
+			{"load", []uint32{92}},
+			{"load", []uint32{65528}},
+			{"load", []uint32{0xfffffff8}},
+			{"store", []uint32{65533, 1}},
+			{"inc", []uint32{5}},
+			{"inc", []uint32{0xfffffff0}},
+			{"trap", nil},
+			{"inc", []uint32{1}},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("../testdata", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mod, err := wasm.DecodeModule(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := interpret(t, mod, tc.calls)
+			got := runGenerated(t, goCmd, mod, tc.calls)
+			if got != want {
+				t.Errorf("generated code printed:\n%s\nwant as the interpreter:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// interpret makes the calls on the stack engine and returns what they print.
+func interpret(t *testing.T, mod *wasm.Module, calls []call) string {
+	var out bytes.Buffer
+	inst, err := vm.InstantiateModuleWithConfig(mod, vm.NewConfig().WithWASI(vm.NewWASIConfig().WithStdout(&out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range calls {
+		args := make([]uint64, len(c.args))
+		for i, a := range c.args {
+			args[i] = uint64(a)
+		}
+		fmt.Fprintf(&out, "%s%v", c.name, c.args)
+		ret, err := inst.InvokeFunction(c.name, args...)
+		switch {
+		case err != nil:
+			fmt.Fprintf(&out, " trap: %s\n", strings.TrimPrefix(err.Error(), "wasm error: "))
+		case hasResult(mod, c.name):
+			fmt.Fprintf(&out, " = %d\n", uint32(ret))
+		default:
+			fmt.Fprintln(&out)
+		}
+	}
+	return out.String()
+}
+
+// runGenerated generates the package of mod, and runs a program making the
+// calls with it, printing as interpret does.
+func runGenerated(t *testing.T, goCmd string, mod *wasm.Module, calls []call) string {
+	src, err := Generate(mod, "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var main bytes.Buffer
+	wasi := importsFdWrite(mod)
+	main.WriteString("package main\n\nimport (\n")
+	if wasi {
+		main.WriteString("\t\"encoding/binary\"\n\t\"os\"\n")
+	}
+	main.WriteString("\t\"fmt\"\n\n\t\"wasm2gotest/guest\"\n)\n\ntype imports struct{}\n\n")
+	if wasi {
+		main.WriteString(`// WasiSnapshotPreview1FdWrite writes the iovecs to stdout, as the interpreter does.
+func (imports) WasiSnapshotPreview1FdWrite(m *guest.Module, fd, iovs, iovsLen, nwritten uint32) uint32 {
+	n := 0
+	for i := uint32(0); i < iovsLen; i++ {
+		base := binary.LittleEndian.Uint32(m.Memory[iovs+i*8:])
+		size := binary.LittleEndian.Uint32(m.Memory[iovs+i*8+4:])
+		w, _ := os.Stdout.Write(m.Memory[base : base+size])
+		n += w
+	}
+	binary.LittleEndian.PutUint32(m.Memory[nwritten:], uint32(n))
+	return 0
+}
+
+`)
+	}
+	main.WriteString(`// call prints name and args, then what f returns or its trap.
+func call(name string, args []uint32, f func() string) {
+	fmt.Printf("%s%v", name, args)
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf(" trap: %v\n", r)
+		}
+	}()
+	fmt.Printf("%s\n", f())
+}
+
+func main() {
+	m := guest.New(imports{})
+`)
+	for _, c := range calls {
+		args := make([]string, len(c.args))
+		for i, a := range c.args {
+			args[i] = fmt.Sprint(a)
+		}
+		expr := fmt.Sprintf("m.%s(%s)", goName(c.name), strings.Join(args, ", "))
+		if hasResult(mod, c.name) {
+			expr = fmt.Sprintf(`return fmt.Sprintf(" = %%d", %s)`, expr)
+		} else {
+			expr += "\nreturn \"\""
+		}
+		fmt.Fprintf(&main, "call(%q, %#v, func() string {\n%s\n})\n", c.name, c.args, expr)
+	}
+	main.WriteString("}\n")
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"go.mod":         []byte("module wasm2gotest\n\ngo 1.22\n"),
+		"main.go":        main.Bytes(),
+		"guest/guest.go": src,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(goCmd, "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=", "GOTOOLCHAIN=local")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("go run: %v\n%s\n%s", err, stderr.Bytes(), main.Bytes())
+	}
+	return string(out)
+}
+
+// importsFdWrite reports whether mod imports fd_write, the only import of
+// the modules in testdata.
+func importsFdWrite(mod *wasm.Module) bool {
+	for _, imp := range mod.ImportSection {
+		if imp.Module == "wasi_snapshot_preview1" && imp.Name == "fd_write" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasResult(mod *wasm.Module, name string) bool {
+	exp := mod.Exports[name]
+	index := exp.Index - mod.ImportFunctionCount
+	return len(mod.TypeSection[mod.FunctionSection[index]].Results) > 0
+}
+
+func TestGenerateMalformed(t *testing.T) {
+	i32 := []wasm.ValueType{wasm.ValueTypeI32}
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr string
+	}{
+		{"missing result", []byte{wasm.OpcodeEnd}, "stack underflow"},
+		{"return without result", []byte{wasm.OpcodeReturn, wasm.OpcodeEnd}, "stack underflow"},
+		{"return from block without result", []byte{
+			wasm.OpcodeI32Const, 1, wasm.OpcodeBlock, 0x40, wasm.OpcodeReturn, wasm.OpcodeEnd, wasm.OpcodeEnd,
+		}, "stack underflow"},
+		{"invalid block type", []byte{wasm.OpcodeBlock, 1, wasm.OpcodeEnd, wasm.OpcodeEnd}, "invalid block type: 1"},
+	}
+	for _, tc := range tests {
+		m := &wasm.Module{
+			TypeSection:     []wasm.FunctionType{{Results: i32}},
+			FunctionSection: []wasm.Index{0},
+			CodeSection:     []wasm.Code{{Body: tc.body}},
+		}
+		if _, err := Generate(m, "main"); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: Generate() error = %v, want %s", tc.name, err, tc.wantErr)
+		}
+	}
+}